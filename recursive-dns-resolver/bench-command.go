@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/socket"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchQuestion is one entry of the name list
+type benchQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// benchResult is the outcome of one query sent by the bench command
+type benchResult struct {
+	latency time.Duration
+	rcode   string // empty when the query timed out or failed
+	timeout bool
+}
+
+// benchCommand sends queries from a name list to a resolver at a fixed rate and reports how it coped
+func benchCommand(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1:5300", "resolver to send queries to, host:port")
+	namesFile := flags.String("names", "", "file with one name per line, optionally followed by a record type; names can also be given as arguments")
+	qtypeName := flags.String("type", "A", "record type for names listed without one")
+	qps := flags.Float64("qps", 100, "queries to send per second")
+	duration := flags.Duration("duration", 10*time.Second, "how long to send queries for")
+	timeout := flags.Duration("timeout", 2*time.Second, "how long to wait for each response")
+	metricsAddr := flags.String("metrics", "", "metrics address of our own server mode, to report its cache-hit ratio")
+	flags.Parse(args)
+
+	defaultType, ok := RecordTypes[strings.ToUpper(*qtypeName)]
+	if !ok {
+		fmt.Printf("Unknown record type %s\n", *qtypeName)
+		os.Exit(1)
+	}
+	questions, err := loadBenchQuestions(*namesFile, flags.Args(), uint16(defaultType))
+	if err != nil {
+		fmt.Println("Error reading names:", err)
+		os.Exit(1)
+	}
+	if len(questions) == 0 || *qps <= 0 {
+		fmt.Println("Need at least one name and a positive -qps")
+		os.Exit(1)
+	}
+
+	hitsBefore, missesBefore, scraped := scrapeCacheCounters(*metricsAddr)
+
+	results := make(chan benchResult, 1024)
+	var collected []benchResult
+	collecting := make(chan struct{})
+	go func() {
+		for result := range results {
+			collected = append(collected, result)
+		}
+		close(collecting)
+	}()
+
+	// Queries are sent on a fixed schedule whether or not earlier ones were answered, so a
+	// slow resolver shows up as latency and timeouts instead of a lower send rate
+	var wg sync.WaitGroup
+	interval := time.Duration(float64(time.Second) / *qps)
+	ticker := time.NewTicker(interval)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for i := 0; time.Now().Before(deadline); i++ {
+		question := questions[i%len(questions)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- benchQuery(*server, question, *timeout)
+		}()
+		<-ticker.C
+	}
+	ticker.Stop()
+	sending := time.Since(start)
+	wg.Wait()
+	close(results)
+	<-collecting
+
+	printBenchReport(collected, sending)
+	if scraped {
+		if hits, misses, ok := scrapeCacheCounters(*metricsAddr); ok {
+			hits, misses = hits-hitsBefore, misses-missesBefore
+			if hits+misses > 0 {
+				fmt.Printf("Cache hit ratio: %.1f%% (%.0f hits, %.0f misses)\n", 100*hits/(hits+misses), hits, misses)
+			}
+		}
+	} else if *metricsAddr != "" {
+		fmt.Printf("Cache hit ratio: unknown, could not read metrics from %s\n", *metricsAddr)
+	} else {
+		fmt.Println("Cache hit ratio: unknown, pass -metrics to read it from a server started with -metrics")
+	}
+}
+
+// loadBenchQuestions reads the name list from file, or takes the names given as arguments
+func loadBenchQuestions(file string, args []string, defaultType uint16) ([]benchQuestion, error) {
+	lines := args
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var questions []benchQuestion
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		question := benchQuestion{name: fields[0], qtype: defaultType}
+		if len(fields) > 1 {
+			qtype, ok := RecordTypes[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, fmt.Errorf("unknown record type %s for %s", fields[1], fields[0])
+			}
+			question.qtype = uint16(qtype)
+		}
+		questions = append(questions, question)
+	}
+	return questions, nil
+}
+
+// benchQuery sends one query over UDP with the same wire code the resolver uses and waits for its response
+func benchQuery(server string, question benchQuestion, timeout time.Duration) benchResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := socket.DialContext(ctx, "udp", server)
+	if err != nil {
+		return benchResult{latency: time.Since(start)}
+	}
+	defer conn.Close()
+
+	dnsquery := query.BuildQuery(question.name, question.qtype)
+	if _, err := conn.Write(dnsquery); err != nil {
+		return benchResult{latency: time.Since(start)}
+	}
+	pooled := query.GetMessageBuffer()
+	defer query.PutMessageBuffer(pooled)
+	for {
+		n, err := conn.Read(*pooled)
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			return benchResult{latency: time.Since(start), timeout: ok && netErr.Timeout()}
+		}
+		response, err := query.ParseDNSResponse((*pooled)[:n])
+		if err != nil || response.Header.ID != binary.BigEndian.Uint16(dnsquery[0:2]) {
+			continue
+		}
+		return benchResult{latency: time.Since(start), rcode: query.RcodeName(query.GetRcode(*response))}
+	}
+}
+
+// printBenchReport summarises the results of a run
+func printBenchReport(results []benchResult, sending time.Duration) {
+	var latencies []time.Duration
+	rcodes := make(map[string]int)
+	timeouts, failures := 0, 0
+	for _, result := range results {
+		switch {
+		case result.timeout:
+			timeouts++
+		case result.rcode == "":
+			failures++
+		default:
+			latencies = append(latencies, result.latency)
+			rcodes[result.rcode]++
+		}
+	}
+
+	fmt.Printf("Sent %d queries in %s (%.1f qps)\n", len(results), sending.Round(time.Millisecond), float64(len(results))/sending.Seconds())
+	fmt.Printf("Answered %d, timed out %d, failed %d\n", len(latencies), timeouts, failures)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf("Latency p50 %s  p90 %s  p99 %s  max %s\n",
+			percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99), latencies[len(latencies)-1].Round(10*time.Microsecond))
+	}
+	names := make([]string, 0, len(rcodes))
+	for rcode := range rcodes {
+		names = append(names, rcode)
+	}
+	sort.Strings(names)
+	for _, rcode := range names {
+		fmt.Printf("  %-9s %6d  %5.1f%%\n", rcode, rcodes[rcode], 100*float64(rcodes[rcode])/float64(len(latencies)))
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies by the nearest rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank].Round(10 * time.Microsecond)
+}
+
+// scrapeCacheCounters reads the cache hit and miss counters of our server mode from its metrics endpoint
+func scrapeCacheCounters(addr string) (hits float64, misses float64, ok bool) {
+	if addr == "" {
+		return 0, 0, false
+	}
+	response, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, 0, false
+	}
+	// Counters that were never incremented are not listed, so they stay at zero
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "dns_resolver_cache_hits_total":
+			hits = value
+		case "dns_resolver_cache_misses_total":
+			misses = value
+		}
+	}
+	return hits, misses, true
+}
@@ -0,0 +1,169 @@
+package blocklist
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Action is what to answer for a name that matches a rule
+type Action int
+
+const (
+	ActionPassthru Action = iota // resolve normally, used to allow names a broader rule blocks
+	ActionNXDOMAIN               // pretend the name does not exist
+	ActionNODATA                 // pretend the name has no records of the asked type
+	ActionSinkhole               // answer with the rule's addresses instead
+	ActionDrop                   // do not answer at all
+)
+
+var actionNames = map[Action]string{
+	ActionPassthru: "passthru",
+	ActionNXDOMAIN: "nxdomain",
+	ActionNODATA:   "nodata",
+	ActionSinkhole: "sinkhole",
+	ActionDrop:     "drop",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// ParseAction turns "nxdomain", "nodata" or "sinkhole" into an Action
+func ParseAction(name string) (Action, error) {
+	for action, actionName := range actionNames {
+		if strings.EqualFold(name, actionName) {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown block action %q", name)
+}
+
+// Rule is one entry of a list
+type Rule struct {
+	Name   string
+	Action Action
+	// Addresses are the answers of a sinkhole rule
+	Addresses []net.IP
+	// Subdomains makes the rule match every name below Name instead of Name itself
+	Subdomains bool
+	// Source is the file the rule came from
+	Source string
+}
+
+// Blocklist matches names against rules loaded from hosts files and RPZ zones.
+// It is safe for concurrent use, and Reload swaps in the new rules atomically.
+type Blocklist struct {
+	mutex sync.RWMutex
+	rules map[string]*Rule
+	files []string
+
+	// DefaultAction and Sinkhole apply to hosts file entries that point at 0.0.0.0 or a
+	// loopback address, which is how blocklists in that format mark a blocked name
+	DefaultAction Action
+	Sinkhole      []net.IP
+}
+
+// New creates a Blocklist for the given files without loading them yet. Files ending in
+// .rpz or .zone are read as RPZ zones, anything else as a hosts file. When two files have
+// a rule for the same name, the later file wins.
+func New(files []string, defaultAction Action, sinkhole []net.IP) *Blocklist {
+	return &Blocklist{
+		rules:         make(map[string]*Rule),
+		files:         files,
+		DefaultAction: defaultAction,
+		Sinkhole:      sinkhole,
+	}
+}
+
+// Reload reads every file again and replaces the rules. On error the old rules stay in place.
+func (b *Blocklist) Reload() (int, error) {
+	rules := make(map[string]*Rule)
+	for _, file := range b.files {
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, fmt.Errorf("opening blocklist: %w", err)
+		}
+		var parsed []*Rule
+		if strings.HasSuffix(file, ".rpz") || strings.HasSuffix(file, ".zone") {
+			parsed, err = parseRPZ(f, file)
+		} else {
+			parsed, err = b.parseHosts(f, file)
+		}
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		for _, rule := range parsed {
+			rules[ruleKey(rule.Name, rule.Subdomains)] = rule
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rules = rules
+	return len(rules), nil
+}
+
+// ruleKey keeps an exact rule and a subdomain rule for the same name apart, as RPZ does
+func ruleKey(name string, subdomains bool) string {
+	name = strings.ToLower(strings.Trim(name, "."))
+	if subdomains {
+		return "*." + name
+	}
+	return name
+}
+
+// Match returns the most specific rule for name, or nil if no rule applies. An exact rule
+// wins over a subdomain rule, and a rule for a longer name over one for a shorter name.
+func (b *Blocklist) Match(name string) *Rule {
+	if b == nil {
+		return nil
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	name = strings.ToLower(strings.Trim(name, "."))
+	if rule, ok := b.rules[name]; ok {
+		return rule
+	}
+	// Subdomain rules only match strictly below their name, so start from the parent
+	for dot := strings.IndexByte(name, '.'); dot >= 0; dot = strings.IndexByte(name, '.') {
+		name = name[dot+1:]
+		if rule, ok := b.rules["*."+name]; ok {
+			return rule
+		}
+	}
+	if rule, ok := b.rules["*."]; ok {
+		return rule
+	}
+	return nil
+}
+
+// Len returns the number of rules currently loaded
+func (b *Blocklist) Len() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.rules)
+}
+
+// ReloadHandler reloads the lists on POST and reports how many rules are loaded
+func (b *Blocklist) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to reload the blocklists", http.StatusMethodNotAllowed)
+			return
+		}
+		count, err := b.Reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"rules": count})
+	})
+}
@@ -0,0 +1,205 @@
+package blocklist
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// formatRules renders rules as "name action addresses", with a * in front of subdomain rules
+func formatRules(rules []*Rule) []string {
+	var lines []string
+	for _, rule := range rules {
+		name := rule.Name
+		if rule.Subdomains {
+			name = "*." + name
+		}
+		line := name + " " + rule.Action.String()
+		for _, ip := range rule.Addresses {
+			line += " " + ip.String()
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestParseRPZ(t *testing.T) {
+	tests := []struct {
+		name  string
+		zone  string
+		rules []string
+		err   string
+	}{
+		{
+			name: "actions",
+			zone: `$TTL 300
+$ORIGIN rpz.local.
+@ SOA ns.rpz.local. hostmaster.rpz.local. 1 3600 600 86400 60
+  NS ns.rpz.local.
+ads.example.com CNAME .
+tracker.example.com 300 IN CNAME *.
+ok.example.com CNAME rpz-passthru.
+silent.example.com CNAME rpz-drop. ; no answer at all
+sink.example.com A 192.0.2.1
+                 AAAA 2001:db8::1
+`,
+			rules: []string{
+				"ads.example.com nxdomain", "tracker.example.com nodata", "ok.example.com passthru",
+				"silent.example.com drop", "sink.example.com sinkhole 192.0.2.1 2001:db8::1",
+			},
+		},
+		{
+			name: "wildcard triggers",
+			zone: `$ORIGIN rpz.local.
+*.ads.example.com CNAME .
+ads.example.com CNAME *.
+*.example.net.rpz.local. CNAME .
+`,
+			rules: []string{"*.ads.example.com nxdomain", "ads.example.com nodata", "*.example.net nxdomain"},
+		},
+		{
+			name: "unsupported triggers and rewrites skipped",
+			zone: `$ORIGIN rpz.local.
+24.0.2.0.192.rpz-ip CNAME .
+ns.example.com.rpz-nsdname CNAME .
+www.example.com CNAME www.example.net.
+other.zone. CNAME .
+www.example.com TXT "local data"
+`,
+		},
+		{name: "bad address", zone: "$ORIGIN rpz.local.\nsink.example.com A 192.0.2\n", err: "test.rpz:2"},
+		{name: "missing data", zone: "$ORIGIN rpz.local.\nads.example.com CNAME\n", err: "test.rpz:2"},
+		{name: "origin without a name", zone: "$ORIGIN\n", err: "test.rpz:1"},
+	}
+	for _, test := range tests {
+		rules, err := parseRPZ(strings.NewReader(test.zone), "test.rpz")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, want an error with %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := formatRules(rules); !slices.Equal(got, test.rules) {
+			t.Errorf("%s: rules\n%q\nwant\n%q", test.name, got, test.rules)
+		}
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		name          string
+		hosts         string
+		defaultAction Action
+		sinkhole      []net.IP
+		rules         []string
+		err           string
+	}{
+		{
+			name: "comments and several names",
+			hosts: `# blocklist
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trackers
+   # indented comment
+
+0.0.0.0 Banner.Example.COM.
+`,
+			defaultAction: ActionNXDOMAIN,
+			rules: []string{
+				"ads.example.com nxdomain", "*.ads.example.com nxdomain",
+				"tracker.example.com nxdomain", "*.tracker.example.com nxdomain",
+				"banner.example.com nxdomain", "*.banner.example.com nxdomain",
+			},
+		},
+		{
+			name:          "names without an address",
+			hosts:         "ads.example.com\n",
+			defaultAction: ActionNODATA,
+			rules:         []string{"ads.example.com nodata", "*.ads.example.com nodata"},
+		},
+		{
+			name:          "other addresses are sinkholes",
+			hosts:         "192.0.2.7 portal.example.com\n::1 ads.example.com\n",
+			defaultAction: ActionSinkhole,
+			sinkhole:      []net.IP{net.ParseIP("192.0.2.1")},
+			rules: []string{
+				"portal.example.com sinkhole 192.0.2.7", "*.portal.example.com sinkhole 192.0.2.7",
+				"ads.example.com sinkhole 192.0.2.1", "*.ads.example.com sinkhole 192.0.2.1",
+			},
+		},
+		{name: "bad address", hosts: "0.0.0.0 ok.example.com\n0.0.0 ads.example.com\n", err: "hosts:2"},
+	}
+	for _, test := range tests {
+		b := New(nil, test.defaultAction, test.sinkhole)
+		rules, err := b.parseHosts(strings.NewReader(test.hosts), "hosts")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, want an error with %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := formatRules(rules); !slices.Equal(got, test.rules) {
+			t.Errorf("%s: rules\n%q\nwant\n%q", test.name, got, test.rules)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	zone := filepath.Join(dir, "policy.rpz")
+	hosts := filepath.Join(dir, "hosts")
+	os.WriteFile(zone, []byte(`$ORIGIN rpz.local.
+*.example.com CNAME .
+ads.example.com CNAME *.
+*.ads.example.com CNAME rpz-drop.
+ok.ads.example.com CNAME rpz-passthru.
+`), 0644)
+	os.WriteFile(hosts, []byte("0.0.0.0 tracker.example.net\n"), 0644)
+	b := New([]string{zone, hosts}, ActionNXDOMAIN, nil)
+	if _, err := b.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string // the matching rule as formatRules writes it, empty for none
+	}{
+		{"www.example.com", "*.example.com nxdomain"},
+		// The subdomain rule of a name does not match the name itself
+		{"example.com", ""},
+		// An exact rule wins over the subdomain rule of a parent
+		{"ads.example.com", "ads.example.com nodata"},
+		// A rule for a longer name wins over one for a shorter name
+		{"x.ads.example.com", "*.ads.example.com drop"},
+		{"a.b.ads.example.com.", "*.ads.example.com drop"},
+		{"OK.Ads.Example.com", "ok.ads.example.com passthru"},
+		{"tracker.example.net", "tracker.example.net nxdomain"},
+		{"cdn.tracker.example.net", "*.tracker.example.net nxdomain"},
+		{"example.net", ""},
+	}
+	for _, test := range tests {
+		rule := b.Match(test.name)
+		got := ""
+		if rule != nil {
+			got = formatRules([]*Rule{rule})[0]
+		}
+		if got != test.want {
+			t.Errorf("Match(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	var none *Blocklist
+	if rule := none.Match("www.example.com"); rule != nil {
+		t.Errorf("a nil Blocklist matched %q", formatRules([]*Rule{rule}))
+	}
+}
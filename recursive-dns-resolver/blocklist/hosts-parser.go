@@ -0,0 +1,59 @@
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// parseHosts reads a hosts file blocklist: "0.0.0.0 ads.example.com tracker.example.com".
+// A line with only a name is accepted too, as many lists are published that way. Names
+// pointing at an unspecified or loopback address get the DefaultAction, names pointing at
+// any other address are answered with it. Every entry covers the name's subdomains too.
+func (b *Blocklist) parseHosts(r io.Reader, source string) ([]*Rule, error) {
+	var rules []*Rule
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var ip net.IP
+		names := fields
+		if parsed := net.ParseIP(fields[0]); parsed != nil {
+			ip, names = parsed, fields[1:]
+		} else if len(fields) > 1 {
+			return nil, fmt.Errorf("%s:%d: %q is not an IP address", source, lineNumber, fields[0])
+		}
+
+		for _, name := range names {
+			name = strings.ToLower(strings.Trim(name, "."))
+			if name == "localhost" || name == "" {
+				continue
+			}
+			rule := Rule{Name: name, Action: b.DefaultAction, Source: source}
+			if ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+				rule.Action = ActionSinkhole
+				rule.Addresses = []net.IP{ip}
+			} else if b.DefaultAction == ActionSinkhole {
+				rule.Addresses = b.Sinkhole
+			}
+			subdomains := rule
+			subdomains.Subdomains = true
+			rules = append(rules, &rule, &subdomains)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", source, err)
+	}
+	return rules, nil
+}
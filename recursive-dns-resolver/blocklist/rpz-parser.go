@@ -0,0 +1,158 @@
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseRPZ reads the QNAME triggers of a response policy zone in master file format
+// (https://datatracker.ietf.org/doc/draft-vixie-dnsop-dns-rpz/). Owner names are relative
+// to the zone origin, so "ads.example.com.rpz.local. CNAME ." blocks ads.example.com.
+//
+//	name CNAME .              answer NXDOMAIN
+//	name CNAME *.             answer NODATA
+//	name CNAME rpz-passthru.  resolve normally
+//	name CNAME rpz-drop.      do not answer
+//	name A/AAAA address       answer with local data
+//	*.name ...                the same for every name below name
+//
+// IP, NSDNAME and client triggers and CNAME rewrites are not supported and are skipped.
+func parseRPZ(r io.Reader, source string) ([]*Rule, error) {
+	rules := make(map[string]*Rule)
+	var order []string
+	origin := ""
+	owner := ""
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, ';'); comment >= 0 {
+			line = line[:comment]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		startsWithSpace := line[0] == ' ' || line[0] == '\t'
+		fields := strings.Fields(line)
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: $ORIGIN needs a name", source, lineNumber)
+			}
+			origin = strings.ToLower(strings.Trim(fields[1], "."))
+			continue
+		case "$TTL":
+			continue
+		}
+
+		// A line starting with blank space continues the previous owner
+		if !startsWithSpace {
+			owner = absoluteName(fields[0], origin)
+			fields = fields[1:]
+		}
+		// Skip the optional TTL and class to get to the type
+		for len(fields) > 0 {
+			if _, err := strconv.Atoi(fields[0]); err == nil || strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+				continue
+			}
+			break
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a record type and data", source, lineNumber)
+		}
+		recordType, data := strings.ToUpper(fields[0]), fields[1]
+
+		name, ok := triggerName(owner, origin)
+		if !ok {
+			continue // the zone apex, or a trigger type we do not support
+		}
+		subdomains := strings.HasPrefix(name, "*.")
+		name = strings.TrimPrefix(name, "*.")
+		key := ruleKey(name, subdomains)
+		rule, exists := rules[key]
+		if !exists {
+			rule = &Rule{Name: name, Subdomains: subdomains, Source: source}
+		}
+
+		switch recordType {
+		case "CNAME":
+			switch strings.ToLower(data) {
+			case ".":
+				rule.Action = ActionNXDOMAIN
+			case "*.":
+				rule.Action = ActionNODATA
+			case "rpz-passthru.":
+				rule.Action = ActionPassthru
+			case "rpz-drop.":
+				rule.Action = ActionDrop
+			default:
+				continue
+			}
+		case "A", "AAAA":
+			ip := net.ParseIP(data)
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: %q is not an IP address", source, lineNumber, data)
+			}
+			rule.Action = ActionSinkhole
+			rule.Addresses = append(rule.Addresses, ip)
+		default:
+			continue // SOA and NS of the policy zone itself, or unsupported local data
+		}
+		if !exists {
+			rules[key] = rule
+			order = append(order, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", source, err)
+	}
+
+	parsed := make([]*Rule, 0, len(order))
+	for _, key := range order {
+		parsed = append(parsed, rules[key])
+	}
+	return parsed, nil
+}
+
+// absoluteName applies the origin to a relative owner name
+func absoluteName(name string, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	default:
+		return name + "." + origin
+	}
+}
+
+// triggerName strips the policy zone origin from an owner name. It reports false for the
+// apex of the zone and for the rpz-ip, rpz-nsdname, rpz-nsip and rpz-client-ip triggers.
+func triggerName(owner string, origin string) (string, bool) {
+	if owner == origin {
+		return "", false
+	}
+	name := owner
+	if origin != "" {
+		if !strings.HasSuffix(owner, "."+origin) {
+			return "", false
+		}
+		name = strings.TrimSuffix(owner, "."+origin)
+	}
+	for _, trigger := range []string{".rpz-ip", ".rpz-nsdname", ".rpz-nsip", ".rpz-client-ip"} {
+		if strings.HasSuffix(name, trigger) {
+			return "", false
+		}
+	}
+	return name, true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"recursive-dns-resolver/cache"
+)
+
+// cacheCommand exports the cache file to a versioned snapshot, or imports one into it, e.g. to
+// carry the cache over to a new host or a new version of the resolver
+func cacheCommand(args []string) {
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cache [flags] export [snapshot]")
+		fmt.Fprintln(flags.Output(), "       cache [flags] import <snapshot>")
+		flags.PrintDefaults()
+	}
+	cacheFile := flags.String("cache", "dns-cache.json", "file the cache is kept in")
+
+	positional := parseInterspersed(flags, args)
+	if len(positional) == 0 || len(positional) > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	dnsCache, err := cache.NewDNSCache(*cacheFile)
+	if err != nil {
+		fmt.Println("Error loading cache:", err)
+		os.Exit(1)
+	}
+	// - is stdout or stdin, as is leaving the snapshot out of an export
+	snapshot := "-"
+	if len(positional) > 1 {
+		snapshot = positional[1]
+	}
+
+	switch positional[0] {
+	case "export":
+		var out io.Writer = os.Stdout
+		var f *os.File
+		if snapshot != "-" {
+			f, err = os.Create(snapshot)
+			if err != nil {
+				fmt.Println("Error creating snapshot:", err)
+				os.Exit(1)
+			}
+			out = f
+		}
+		if err := dnsCache.Export(out); err != nil {
+			fmt.Println("Error exporting cache:", err)
+			os.Exit(1)
+		}
+		// Closing flushes the snapshot, so a failure here leaves it truncated
+		if f != nil {
+			if err := f.Close(); err != nil {
+				fmt.Println("Error writing snapshot:", err)
+				os.Exit(1)
+			}
+		}
+	case "import":
+		if len(positional) < 2 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		var in io.Reader = os.Stdin
+		if snapshot != "-" {
+			f, err := os.Open(snapshot)
+			if err != nil {
+				fmt.Println("Error opening snapshot:", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			in = f
+		}
+		count, err := dnsCache.Import(in)
+		if err != nil {
+			fmt.Println("Error importing cache:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d records into %s\n", count, *cacheFile)
+	default:
+		flags.Usage()
+		os.Exit(1)
+	}
+}
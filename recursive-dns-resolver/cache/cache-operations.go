@@ -2,8 +2,10 @@ package cache
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -31,7 +33,11 @@ func (cache *DNSCache) loadFromFile() error {
 		return err
 	}
 
-	return json.Unmarshal(data, &cache.Records)
+	if err := json.Unmarshal(data, &cache.Records); err != nil {
+		return err
+	}
+	cache.reindex()
+	return nil
 }
 
 // Save records to the file
@@ -44,35 +50,145 @@ func (cache *DNSCache) saveToFile() error {
 	return os.WriteFile(cache.file, data, 0644)
 }
 
-// Add a record to the cache
+// Add a record to the cache. Names are case-insensitive, and the resolver sends them
+// with random case, so keys are always stored in lower case.
 func (cache *DNSCache) Add(domain string, ip net.IP, ttl time.Duration) error {
-	cache.Records[domain] = CacheRecord{
+	if ip == nil {
+		return fmt.Errorf("refusing to cache invalid IP for %s", domain)
+	}
+	domain = strings.ToLower(domain)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.makeRoom(domain)
+	cache.put(domain, CacheRecord{
 		Domain:    domain,
 		IPAddress: ip,
 		ExpiresAt: time.Now().Add(ttl),
+	})
+
+	return cache.saveToFile()
+}
+
+// AddScoped adds a record that is only valid for clients in scope, as an authoritative server
+// said in its EDNS Client Subnet answer. A nil scope adds it for everyone like Add.
+func (cache *DNSCache) AddScoped(domain string, ip net.IP, ttl time.Duration, scope *net.IPNet) error {
+	if scope == nil {
+		return cache.Add(domain, ip, ttl)
 	}
+	if ip == nil {
+		return fmt.Errorf("refusing to cache invalid IP for %s", domain)
+	}
+	domain = strings.ToLower(domain)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.makeRoom(domain + "/" + scope.String())
+	cache.put(domain+"/"+scope.String(), CacheRecord{
+		Domain:    domain,
+		IPAddress: ip,
+		ExpiresAt: time.Now().Add(ttl),
+		Scope:     scope.String(),
+	})
 
 	return cache.saveToFile()
 }
 
+// LookupScoped returns the entry for a domain that is valid for client: the one with the most
+// specific scope containing client, up to maxPrefix bits, or else the one valid for everyone
+func (cache *DNSCache) LookupScoped(domain string, client net.IP, maxPrefix int) (CacheRecord, bool) {
+	bits := 128
+	if ip4 := client.To4(); ip4 != nil {
+		client, bits = ip4, 32
+	}
+	domain = strings.ToLower(domain)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.expire()
+	for prefix := min(maxPrefix, bits); prefix > 0; prefix-- {
+		scope := net.IPNet{IP: client.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+		if record, exists := cache.Records[domain+"/"+scope.String()]; exists {
+			return record, true
+		}
+	}
+	record, exists := cache.Records[domain]
+	return record, exists
+}
+
 // Get a record from the cache, removing expired records
 func (cache *DNSCache) Get(domain string) net.IP {
-	cache.removeExpired()
-	record, exists := cache.Records[domain]
+	record, exists := cache.Lookup(domain)
 	if !exists {
 		return nil
 	}
 	return record.IPAddress
 }
 
-// Remove expired records from the cache
-func (cache *DNSCache) removeExpired() {
+// Lookup returns the whole cache entry for a domain, so callers can see when it expires
+func (cache *DNSCache) Lookup(domain string) (CacheRecord, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.expire()
+	record, exists := cache.Records[strings.ToLower(domain)]
+	return record, exists
+}
 
+// removeExpired removes the expired records from the cache and reports whether there were any
+func (cache *DNSCache) removeExpired() bool {
 	now := time.Now()
-	for domain, record := range cache.Records {
-		if record.ExpiresAt.Before(now) {
-			delete(cache.Records, domain)
+	removed := false
+	for {
+		next, ok := cache.soonest()
+		if !ok || !next.expiresAt.Before(now) {
+			return removed
+		}
+		cache.removeSoonest()
+		cache.evictions++
+		removed = true
+	}
+}
+
+// expire removes the expired records and saves the cache file if that changed anything
+func (cache *DNSCache) expire() {
+	if cache.removeExpired() {
+		cache.saveToFile()
+	}
+}
+
+// SetMaxEntries bounds how many records the cache holds, 0 for no limit. A cache that is
+// already over the new limit shrinks as records are added.
+func (cache *DNSCache) SetMaxEntries(n int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.maxEntries = n
+}
+
+// makeRoom removes records until one more fits under the limit, unless key is already cached
+// and is only being replaced. Expired records go first, then the ones closest to expiring.
+func (cache *DNSCache) makeRoom(key string) {
+	if cache.maxEntries <= 0 || len(cache.Records) < cache.maxEntries {
+		return
+	}
+	if _, exists := cache.Records[key]; exists {
+		return
+	}
+	cache.removeExpired()
+	for len(cache.Records) >= cache.maxEntries {
+		if _, ok := cache.soonest(); !ok {
+			return
 		}
+		cache.removeSoonest()
 	}
-	cache.saveToFile() // Save the updated cache to the file
+}
+
+// Len returns how many records the cache holds
+func (cache *DNSCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.Records)
+}
+
+// Evictions returns how many expired records have been removed since the cache was created
+func (cache *DNSCache) Evictions() uint64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.evictions
 }
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) *DNSCache {
+	t.Helper()
+	cache, err := NewDNSCache(filepath.Join(t.TempDir(), "dns-cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestLookupScoped(t *testing.T) {
+	cache := newTestCache(t)
+	for _, entry := range []struct {
+		ip    string
+		scope string
+	}{
+		{"203.0.113.1", ""},
+		{"203.0.113.16", "192.0.0.0/16"},
+		{"203.0.113.24", "192.0.2.0/24"},
+		{"203.0.113.66", "2001:db8:abcd::/48"},
+	} {
+		var scope *net.IPNet
+		if entry.scope != "" {
+			scope = mustCIDR(t, entry.scope)
+		}
+		if err := cache.AddScoped("Example.com", net.ParseIP(entry.ip), time.Minute, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		client    string
+		maxPrefix int
+		ip        string
+	}{
+		{"192.0.2.9", 24, "203.0.113.24"},
+		{"192.0.3.9", 24, "203.0.113.16"},
+		{"198.51.100.9", 24, "203.0.113.1"},
+		// A client that only sends 16 bits upstream cannot use an answer scoped to 24
+		{"192.0.2.9", 16, "203.0.113.16"},
+		{"192.0.2.9", 0, "203.0.113.1"},
+		{"2001:db8:abcd:1::9", 56, "203.0.113.66"},
+		{"2001:db8:abce:1::9", 56, "203.0.113.1"},
+		// An IPv4-mapped IPv6 client is matched against the IPv4 scopes
+		{"::ffff:192.0.2.9", 24, "203.0.113.24"},
+	}
+	for _, test := range tests {
+		record, ok := cache.LookupScoped("example.COM", net.ParseIP(test.client), test.maxPrefix)
+		if !ok || record.IPAddress.String() != test.ip {
+			t.Errorf("LookupScoped for %s up to /%d = %v, %v, want %s", test.client, test.maxPrefix, record.IPAddress, ok, test.ip)
+		}
+	}
+
+	if _, ok := cache.LookupScoped("other.example", net.ParseIP("192.0.2.9"), 24); ok {
+		t.Error("LookupScoped found a name that was never added")
+	}
+}
+
+func TestLookupScopedExpired(t *testing.T) {
+	cache := newTestCache(t)
+	cache.AddScoped("example.com", net.ParseIP("203.0.113.1"), time.Minute, nil)
+	cache.AddScoped("example.com", net.ParseIP("203.0.113.24"), -time.Second, mustCIDR(t, "192.0.2.0/24"))
+	record, ok := cache.LookupScoped("example.com", net.ParseIP("192.0.2.9"), 24)
+	if !ok || record.IPAddress.String() != "203.0.113.1" {
+		t.Errorf("expired scoped entry was not skipped: got %v, %v", record.IPAddress, ok)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	cache := newTestCache(t)
+	cache.SetMaxEntries(3)
+	add := func(domain string, ttl time.Duration) {
+		t.Helper()
+		if err := cache.Add(domain, net.ParseIP("192.0.2.1"), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("expired.example", -time.Second)
+	add("soon.example", time.Minute)
+	add("later.example", time.Hour)
+	// Expired records make room first
+	add("new.example", 2*time.Hour)
+	if _, ok := cache.Lookup("soon.example"); !ok || cache.Len() != 3 {
+		t.Fatalf("expired record was not the one removed, %d records", cache.Len())
+	}
+	if cache.Evictions() != 1 {
+		t.Errorf("%d evictions, want 1", cache.Evictions())
+	}
+
+	// Refreshing soon.example leaves its old expiry behind, which must not count
+	add("soon.example", 3*time.Hour)
+	add("newest.example", 4*time.Hour)
+	for domain, want := range map[string]bool{"soon.example": true, "later.example": false, "new.example": true, "newest.example": true} {
+		if _, ok := cache.Lookup(domain); ok != want {
+			t.Errorf("%s cached = %v, want %v", domain, ok, want)
+		}
+	}
+	if cache.Len() != 3 {
+		t.Errorf("%d records, want 3", cache.Len())
+	}
+}
+
+func TestExpiryIndexBounded(t *testing.T) {
+	cache := newTestCache(t)
+	for i := 0; i < 1000; i++ {
+		cache.Add("example.com", net.ParseIP("192.0.2.1"), time.Duration(i+1)*time.Second)
+	}
+	if n := len(cache.expiries); n > 2*len(cache.Records)+64 {
+		t.Errorf("the expiry index holds %d entries for %d records", n, len(cache.Records))
+	}
+}
+
+func TestSaveAndReload(t *testing.T) {
+	cache := newTestCache(t)
+	cache.Add("expired.example", net.ParseIP("192.0.2.1"), -time.Second)
+	cache.Add("example.com", net.ParseIP("192.0.2.2"), time.Minute)
+
+	reloaded, err := NewDNSCache(cache.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := reloaded.Get("example.com"); ip.String() != "192.0.2.2" {
+		t.Errorf("reloaded example.com = %v", ip)
+	}
+	// The reloaded records are indexed, so the expired one goes on the next lookup
+	if _, ok := reloaded.Lookup("expired.example"); ok || reloaded.Len() != 1 || reloaded.Evictions() != 1 {
+		t.Errorf("expired record kept after reload: %d records, %d evictions", reloaded.Len(), reloaded.Evictions())
+	}
+}
@@ -10,10 +10,18 @@ type CacheRecord struct {
 	Domain    string
 	IPAddress net.IP
 	ExpiresAt time.Time
+	// Scope is the client network an EDNS Client Subnet answer is valid for, empty when it
+	// is valid for everyone
+	Scope string `json:",omitempty"`
 }
 
 type DNSCache struct {
-	Records map[string]CacheRecord
-	mutex   sync.Mutex
-	file    string
+	Records   map[string]CacheRecord
+	mutex     sync.Mutex
+	file      string
+	evictions uint64 // expired records removed so far
+	// maxEntries bounds how many records are kept, 0 for no limit
+	maxEntries int
+	// expiries indexes the records by when they expire
+	expiries expiryIndex
 }
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiry is one entry of the expiry index: the key of a record and when it expires
+type expiry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// expiryIndex is a min-heap of record expiry times, so the record that expires first is found
+// without scanning the whole cache. Replacing or removing a record leaves its old entry behind;
+// an entry only counts while the record under its key still expires at the same time.
+type expiryIndex []expiry
+
+func (index expiryIndex) Len() int           { return len(index) }
+func (index expiryIndex) Less(i, j int) bool { return index[i].expiresAt.Before(index[j].expiresAt) }
+func (index expiryIndex) Swap(i, j int)      { index[i], index[j] = index[j], index[i] }
+func (index *expiryIndex) Push(x any)        { *index = append(*index, x.(expiry)) }
+
+func (index *expiryIndex) Pop() any {
+	old := *index
+	last := old[len(old)-1]
+	*index = old[:len(old)-1]
+	return last
+}
+
+// put stores a record under key and indexes its expiry. Old entries are dropped once they
+// outnumber the records, so refreshing the same names does not grow the index without bound.
+func (cache *DNSCache) put(key string, record CacheRecord) {
+	cache.Records[key] = record
+	heap.Push(&cache.expiries, expiry{key: key, expiresAt: record.ExpiresAt})
+	if len(cache.expiries) > 2*len(cache.Records)+64 {
+		cache.reindex()
+	}
+}
+
+// reindex rebuilds the expiry index from the records
+func (cache *DNSCache) reindex() {
+	cache.expiries = make(expiryIndex, 0, len(cache.Records))
+	for key, record := range cache.Records {
+		cache.expiries = append(cache.expiries, expiry{key: key, expiresAt: record.ExpiresAt})
+	}
+	heap.Init(&cache.expiries)
+}
+
+// soonest returns the entry of the record that expires first, dropping the old entries in
+// front of it, or false when the cache is empty. The entry stays in the index.
+func (cache *DNSCache) soonest() (expiry, bool) {
+	for len(cache.expiries) > 0 {
+		next := cache.expiries[0]
+		if record, exists := cache.Records[next.key]; exists && record.ExpiresAt.Equal(next.expiresAt) {
+			return next, true
+		}
+		heap.Pop(&cache.expiries)
+	}
+	return expiry{}, false
+}
+
+// removeSoonest removes the record soonest just returned
+func (cache *DNSCache) removeSoonest() {
+	next := heap.Pop(&cache.expiries).(expiry)
+	delete(cache.Records, next.key)
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by Export. Import refuses
+// snapshots of any other version rather than guess what they mean.
+const SnapshotVersion = 1
+
+// Snapshot is the portable form of a cache. Unlike the cache file, which holds the internal
+// map as it is, it does not depend on how the cache keys its records, and it stores the TTL
+// each record had left when it was taken instead of an absolute expiry time.
+type Snapshot struct {
+	Version int             `json:"version"`
+	Created time.Time       `json:"created"`
+	Records []SnapshotEntry `json:"records"`
+}
+
+// SnapshotEntry is one cached A record
+type SnapshotEntry struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	TTL     uint32 `json:"ttl"`
+	// Scope is the client network of an EDNS Client Subnet answer, empty for everyone
+	Scope string `json:"scope,omitempty"`
+}
+
+// Export writes a snapshot of the records that have not expired yet to w
+func (cache *DNSCache) Export(w io.Writer) error {
+	now := time.Now()
+	snapshot := Snapshot{Version: SnapshotVersion, Created: now.UTC().Truncate(time.Second), Records: []SnapshotEntry{}}
+	cache.mutex.Lock()
+	for _, record := range cache.Records {
+		ttl := record.ExpiresAt.Sub(now) / time.Second
+		if ttl <= 0 {
+			continue
+		}
+		snapshot.Records = append(snapshot.Records, SnapshotEntry{
+			Name:    record.Domain,
+			Address: record.IPAddress.String(),
+			TTL:     uint32(ttl),
+			Scope:   record.Scope,
+		})
+	}
+	cache.mutex.Unlock()
+	sort.Slice(snapshot.Records, func(i, j int) bool {
+		a, b := snapshot.Records[i], snapshot.Records[j]
+		return a.Name < b.Name || (a.Name == b.Name && a.Scope < b.Scope)
+	})
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+// Import adds the records of a snapshot read from r to the cache. The time since the snapshot
+// was taken is taken off every TTL, and records whose TTL has run out are left out. Like Add,
+// it makes room for each record when the cache is full. It returns how many records were added.
+func (cache *DNSCache) Import(r io.Reader) (int, error) {
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return 0, fmt.Errorf("reading snapshot: %w", err)
+	}
+	if snapshot.Version != SnapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d, expected %d", snapshot.Version, SnapshotVersion)
+	}
+	now := time.Now()
+	elapsed := now.Sub(snapshot.Created)
+	if elapsed < 0 {
+		elapsed = 0 // taken on a host whose clock is ahead of ours
+	}
+
+	records := make(map[string]CacheRecord)
+	for i, entry := range snapshot.Records {
+		ip := net.ParseIP(entry.Address)
+		if ip == nil || entry.Name == "" {
+			return 0, fmt.Errorf("snapshot record %d: invalid name %q or address %q", i+1, entry.Name, entry.Address)
+		}
+		key := strings.ToLower(entry.Name)
+		// Scopes are stored the way AddScoped writes them, 10.0.0.0/24 rather than 10.0.0.5/24
+		scope := ""
+		if entry.Scope != "" {
+			_, network, err := net.ParseCIDR(entry.Scope)
+			if err != nil {
+				return 0, fmt.Errorf("snapshot record %d: %w", i+1, err)
+			}
+			scope = network.String()
+			key += "/" + scope
+		}
+		remaining := time.Duration(entry.TTL)*time.Second - elapsed
+		if remaining <= 0 {
+			continue
+		}
+		records[key] = CacheRecord{
+			Domain:    strings.ToLower(entry.Name),
+			IPAddress: ip,
+			ExpiresAt: now.Add(remaining),
+			Scope:     scope,
+		}
+	}
+
+	// Nothing is added unless the whole snapshot is valid
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key, record := range records {
+		cache.makeRoom(key)
+		cache.put(key, record)
+	}
+	return len(records), cache.saveToFile()
+}
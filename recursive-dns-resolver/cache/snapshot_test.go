@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// aged exports cache and makes the snapshot look as if it had been taken age ago
+func aged(t *testing.T, cache *DNSCache, age time.Duration) *bytes.Buffer {
+	t.Helper()
+	var exported bytes.Buffer
+	if err := cache.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(exported.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Created = snapshot.Created.Add(-age)
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewBuffer(data)
+}
+
+func TestExportImport(t *testing.T) {
+	source := newTestCache(t)
+	source.Add("Example.com", net.ParseIP("192.0.2.1"), time.Hour)
+	source.AddScoped("example.com", net.ParseIP("192.0.2.24"), time.Hour, mustCIDR(t, "198.51.100.0/24"))
+	source.Add("short.example", net.ParseIP("192.0.2.2"), 20*time.Second)
+	source.Add("expired.example", net.ParseIP("192.0.2.3"), -time.Second)
+
+	target := newTestCache(t)
+	count, err := target.Import(aged(t, source, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// short.example ran out while the snapshot aged, expired.example was never exported
+	if count != 2 || target.Len() != 2 {
+		t.Fatalf("imported %d records, the cache holds %d, want 2", count, target.Len())
+	}
+	record, ok := target.Lookup("example.com")
+	if !ok || record.IPAddress.String() != "192.0.2.1" {
+		t.Fatalf("example.com = %v, %v", record.IPAddress, ok)
+	}
+	// An hour, less the minute the snapshot aged and the second Export truncates
+	if remaining := time.Until(record.ExpiresAt); remaining > 59*time.Minute || remaining < 58*time.Minute {
+		t.Errorf("example.com expires in %v, want about 59 minutes", remaining)
+	}
+	scoped, ok := target.LookupScoped("example.com", net.ParseIP("198.51.100.7"), 24)
+	if !ok || scoped.IPAddress.String() != "192.0.2.24" || scoped.Scope != "198.51.100.0/24" {
+		t.Errorf("scoped entry = %+v, %v", scoped, ok)
+	}
+}
+
+func TestImportScopeNormalised(t *testing.T) {
+	cache := newTestCache(t)
+	snapshot := `{"version": 1, "created": "` + time.Now().UTC().Format(time.RFC3339) + `", "records": [
+		{"name": "example.com", "address": "192.0.2.1", "ttl": 300, "scope": "198.51.100.5/24"}
+	]}`
+	if _, err := cache.Import(strings.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	// The same network added again replaces the imported record instead of sitting beside it
+	cache.AddScoped("example.com", net.ParseIP("192.0.2.2"), time.Minute, mustCIDR(t, "198.51.100.0/24"))
+	record, ok := cache.LookupScoped("example.com", net.ParseIP("198.51.100.9"), 24)
+	if !ok || record.Scope != "198.51.100.0/24" || record.IPAddress.String() != "192.0.2.2" || cache.Len() != 1 {
+		t.Errorf("got %+v, %v with %d records", record, ok, cache.Len())
+	}
+}
+
+func TestImportMaxEntries(t *testing.T) {
+	source := newTestCache(t)
+	for i, name := range []string{"a.example", "b.example", "c.example"} {
+		source.Add(name, net.ParseIP("192.0.2.1"), time.Duration(i+1)*time.Hour)
+	}
+	target := newTestCache(t)
+	target.SetMaxEntries(2)
+	if _, err := target.Import(aged(t, source, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if target.Len() != 2 {
+		t.Errorf("the cache holds %d records, its limit is 2", target.Len())
+	}
+	if _, ok := target.Lookup("c.example"); !ok {
+		t.Error("the record that expires last was not kept")
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	tests := []struct {
+		name     string
+		snapshot string
+		err      string
+	}{
+		{"not json", "cache", "reading snapshot"},
+		{"other version", `{"version": 2, "created": "` + now + `", "records": []}`, "unsupported snapshot version 2"},
+		{"invalid address", `{"version": 1, "created": "` + now + `", "records": [
+			{"name": "good.example", "address": "192.0.2.1", "ttl": 300},
+			{"name": "bad.example", "address": "192.0.2", "ttl": 300}
+		]}`, "snapshot record 2"},
+		{"invalid scope", `{"version": 1, "created": "` + now + `", "records": [
+			{"name": "good.example", "address": "192.0.2.1", "ttl": 300},
+			{"name": "bad.example", "address": "192.0.2.1", "ttl": 300, "scope": "198.51.100.0/33"}
+		]}`, "snapshot record 2"},
+	}
+	for _, test := range tests {
+		cache := newTestCache(t)
+		count, err := cache.Import(strings.NewReader(test.snapshot))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error with %q", test.name, err, test.err)
+		}
+		// Nothing of a snapshot with an invalid record is added
+		if count != 0 || cache.Len() != 0 {
+			t.Errorf("%s: %d records imported, the cache holds %d", test.name, count, cache.Len())
+		}
+	}
+}
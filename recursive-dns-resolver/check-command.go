@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"recursive-dns-resolver/healthcheck"
+	"recursive-dns-resolver/resolver"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// checkCommand checks the delegation of a zone and the health of its nameservers, and exits
+// non-zero when it finds an error
+func checkCommand(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: check [flags] <zone>")
+		flags.PrintDefaults()
+	}
+	asJSON := flags.Bool("json", false, "print the report as JSON instead of a table")
+	network := flags.String("network", "ip", "nameserver address families to check: ip, ip4 or ip6")
+	roots := flags.String("roots", "", "comma separated root servers to start from instead of the built in ones")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long the whole check may take")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	r := resolver.New(resolver.WithNetwork(*network))
+	if *roots != "" {
+		r.Roots = strings.Split(*roots, ",")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report, err := healthcheck.Check(ctx, r, flags.Arg(0))
+	if err != nil {
+		fmt.Println("Error checking zone:", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printCheckReport(report)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+// printCheckReport prints the servers of the zone as a table followed by the findings
+func printCheckReport(report *healthcheck.Report) {
+	parent := report.Parent
+	if parent == "" {
+		parent = "."
+	}
+	fmt.Printf("Zone %s, delegated from %s to %s\n\n", report.Zone, parent, strings.Join(report.ParentNS, ", "))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESERVER\tADDRESS\tSERIAL\tAA\tRA\tEDNS\tTCP\tRTT")
+	for _, server := range report.Servers {
+		if server.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t-\n", server.Name, server.Address)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", server.Name, server.Address, server.Serial,
+			yesNo(server.Authoritative), yesNo(server.Recursion), yesNo(server.EDNS), yesNo(server.TCP), server.RTT.Round(10*time.Microsecond))
+	}
+	w.Flush()
+
+	fmt.Println()
+	if len(report.Findings) == 0 {
+		fmt.Println("No problems found")
+		return
+	}
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEVERITY\tCHECK\tSERVER\tPROBLEM")
+	for _, finding := range report.Findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", finding.Severity, finding.Check, finding.Server, finding.Message)
+	}
+	w.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,35 @@
+package main
+
+import "flag"
+
+// commands are the subcommands that can be given instead of a list of names,
+// e.g. `go run . serve -listen 127.0.0.1:5300`
+var commands = map[string]func(args []string){
+	"serve":       serveCommand,
+	"reload":      reloadCommand,
+	"bench":       benchCommand,
+	"transfer":    transferCommand,
+	"check":       checkCommand,
+	"propagation": propagationCommand,
+	"update":      updateCommand,
+	"cache":       cacheCommand,
+}
+
+// parseInterspersed parses args with flags, letting flags come before, between or after the
+// positional arguments, which it returns in order. Everything after -- is positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for rest := args; len(rest) > 0; {
+		flags.Parse(rest)
+		remaining := flags.Args()
+		if consumed := len(rest) - len(remaining); consumed > 0 && rest[consumed-1] == "--" {
+			return append(positional, remaining...)
+		}
+		rest = remaining
+		if len(rest) > 0 {
+			positional = append(positional, rest[0])
+			rest = rest[1:]
+		}
+	}
+	return positional
+}
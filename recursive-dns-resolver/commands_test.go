@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	tests := []struct {
+		args       []string
+		positional []string
+		timeout    string
+		json       bool
+	}{
+		{[]string{"example.com", "A"}, []string{"example.com", "A"}, "", false},
+		{[]string{"-json", "example.com", "-timeout", "5s", "A"}, []string{"example.com", "A"}, "5s", true},
+		{[]string{"example.com", "A", "-json"}, []string{"example.com", "A"}, "", true},
+		// After -- even arguments that look like flags are positional
+		{[]string{"-json", "--", "-example.com", "-timeout"}, []string{"-example.com", "-timeout"}, "", true},
+		{nil, nil, "", false},
+	}
+	for _, test := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		timeout := flags.String("timeout", "", "")
+		asJSON := flags.Bool("json", false, "")
+		positional := parseInterspersed(flags, test.args)
+		if !slices.Equal(positional, test.positional) || *timeout != test.timeout || *asJSON != test.json {
+			t.Errorf("%q: positional %q, -timeout %q, -json %v", test.args, positional, *timeout, *asJSON)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"recursive-dns-resolver/blocklist"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+	"recursive-dns-resolver/server"
+	"strings"
+	"time"
+)
+
+// Config holds every setting of the serve command. The file sections and keys match the
+// fields, e.g. [server] allow or [cache] max-entries, and command line flags override them.
+type Config struct {
+	Server    ServerConfig
+	Resolver  ResolverConfig
+	Cache     CacheConfig
+	Log       LogConfig
+	Blocklist BlocklistConfig
+	Policy    PolicyConfig
+
+	// file is the config file the settings were read from, and lines the line each key was
+	// set on there, so Validate can point at them
+	file  string
+	lines map[string]int
+}
+
+// ServerConfig is the [server] section: where clients are answered and who may use it
+type ServerConfig struct {
+	Listen       string
+	Metrics      string
+	Timeout      time.Duration
+	Allow        []string
+	QueryRate    float64
+	RRLRate      float64
+	RRLSlip      int
+	TSIGKeys     []string
+	RequireTSIG  bool
+	Cookies      bool
+	DNS64        bool
+	DNS64Prefix  string
+	DNS64Exclude []string
+}
+
+// ResolverConfig is the [resolver] section: how names are resolved upstream
+type ResolverConfig struct {
+	// Roots are the servers lookups start from. Empty uses the built in ones. Forwarders, when
+	// set, answer every lookup in place of the roots.
+	Roots             []string
+	Forwarders        []string
+	Network           string
+	Timeout           time.Duration
+	ResolutionTimeout time.Duration
+	AttemptDelay      time.Duration
+	Minimise          bool
+	MaxReferrals      int
+	MaxQueries        int
+	MaxCNAMEDepth     int
+	Hosts             string
+	ECSIPv4           int
+	ECSIPv6           int
+	MDNS              bool
+}
+
+// CacheConfig is the [cache] section
+type CacheConfig struct {
+	File string
+	// MaxEntries bounds how many records the cache holds, 0 for no limit
+	MaxEntries        int
+	Warmup            string
+	WarmupConcurrency int
+}
+
+// LogConfig is the [log] section. File is where the server log goes, empty for stderr.
+type LogConfig struct {
+	File           string
+	QueryLog       string
+	QueryLogSample float64
+	Dnstap         string
+}
+
+// BlocklistConfig is the [blocklist] section
+type BlocklistConfig struct {
+	Files    []string
+	Action   string
+	Sinkhole []string
+}
+
+// PolicyConfig is the [policy] section: how answers are rewritten before they are cached
+type PolicyConfig struct {
+	// MinTTL and MaxTTL clamp answer TTLs, in seconds. 0 leaves that side unbounded.
+	MinTTL int
+	MaxTTL int
+	// RebindingProtection strips private addresses from answers for names outside
+	// PrivateDomains
+	RebindingProtection bool
+	PrivateDomains      []string
+	// Overrides are records, written as name [ttl] type data, that replace the answer for
+	// their name and type
+	Overrides []string
+}
+
+// Default returns the settings serve uses without a config file or flags
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:       "127.0.0.1:5300",
+			Timeout:      10 * time.Second,
+			Allow:        append([]string(nil), server.DefaultRecursionACL...),
+			RRLSlip:      2,
+			DNS64Prefix:  server.DefaultDNS64Prefix,
+			DNS64Exclude: append([]string(nil), server.DefaultDNS64Exclude...),
+		},
+		Resolver: ResolverConfig{
+			Network:           "ip",
+			Timeout:           5 * time.Second,
+			ResolutionTimeout: 15 * time.Second,
+			AttemptDelay:      250 * time.Millisecond,
+			MaxReferrals:      30,
+			MaxQueries:        100,
+			MaxCNAMEDepth:     8,
+		},
+		Cache: CacheConfig{
+			File:              "dns-cache.json",
+			WarmupConcurrency: 8,
+		},
+		Log: LogConfig{
+			QueryLogSample: 1,
+		},
+		Blocklist: BlocklistConfig{
+			Action:   "nxdomain",
+			Sinkhole: []string{"0.0.0.0", "::"},
+		},
+	}
+}
+
+// maxTTL is the largest TTL a record may have (RFC 2181 section 8)
+const maxTTL = 1<<31 - 1
+
+// unsupported are settings people expect from other resolvers that this one does not have.
+// They are rejected rather than ignored, so nobody believes they are in effect.
+var unsupported = map[string]string{
+	"resolver.dnssec": "DNSSEC validation is not supported",
+	"dnssec":          "DNSSEC validation is not supported",
+}
+
+// Load reads a config file on top of the defaults. Every problem with it is an *Error that
+// points at the line it is on.
+func Load(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := Default()
+	if err := c.apply(file, string(data)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// apply sets the fields named in a document
+func (c *Config) apply(file string, data string) error {
+	sections, err := parse(file, data)
+	if err != nil {
+		return err
+	}
+	fields := c.fields()
+	c.file, c.lines = file, make(map[string]int)
+	for _, section := range sections {
+		if reason, ok := unsupported[section.name]; ok {
+			return &Error{File: file, Line: section.line, Msg: fmt.Sprintf("[%s]: %s", section.name, reason)}
+		}
+		if _, ok := fields[section.name]; !ok {
+			if section.name == "" && len(section.entries) > 0 {
+				first := section.entries[0]
+				if reason, ok := unsupported[first.key]; ok {
+					return &Error{File: file, Line: first.value.line, Msg: fmt.Sprintf("%s: %s", first.key, reason)}
+				}
+				return &Error{File: file, Line: first.value.line, Msg: fmt.Sprintf("%s must be in a section", first.key)}
+			}
+			if section.name != "" {
+				return &Error{File: file, Line: section.line, Msg: fmt.Sprintf("unknown section [%s]", section.name)}
+			}
+		}
+		for _, entry := range section.entries {
+			key := qualified(section.name, entry.key)
+			if reason, ok := unsupported[key]; ok {
+				return &Error{File: file, Line: entry.value.line, Msg: fmt.Sprintf("%s: %s", key, reason)}
+			}
+			set, ok := fields[section.name][entry.key]
+			if !ok {
+				return &Error{File: file, Line: entry.value.line, Msg: fmt.Sprintf("unknown key %s", key)}
+			}
+			c.lines[key] = entry.value.line
+			if err := set(entry.value); err != nil {
+				var lineErr *Error
+				if errors.As(err, &lineErr) {
+					lineErr.File = file
+					lineErr.Msg = key + ": " + lineErr.Msg
+					return lineErr
+				}
+				return &Error{File: file, Line: entry.value.line, Msg: fmt.Sprintf("%s: %v", key, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// setter checks a value from the file and stores it in its field
+type setter func(v value) error
+
+// fields maps every section and key of the file to the setter of its field
+func (c *Config) fields() map[string]map[string]setter {
+	return map[string]map[string]setter{
+		"server": {
+			"listen":        stringField(&c.Server.Listen, checkHostPort),
+			"metrics":       stringField(&c.Server.Metrics, optional(checkHostPort)),
+			"timeout":       durationField(&c.Server.Timeout),
+			"allow":         listField(&c.Server.Allow, checkNetwork),
+			"query-rate":    floatField(&c.Server.QueryRate, 0, -1),
+			"rrl-rate":      floatField(&c.Server.RRLRate, 0, -1),
+			"rrl-slip":      intField(&c.Server.RRLSlip, 0, -1),
+			"tsig-keys":     listField(&c.Server.TSIGKeys, checkTSIGKey),
+			"require-tsig":  boolField(&c.Server.RequireTSIG),
+			"cookies":       boolField(&c.Server.Cookies),
+			"dns64":         boolField(&c.Server.DNS64),
+			"dns64-prefix":  stringField(&c.Server.DNS64Prefix, checkDNS64Prefix),
+			"dns64-exclude": listField(&c.Server.DNS64Exclude, checkNetwork),
+		},
+		"resolver": {
+			"roots":              listField(&c.Resolver.Roots, checkServer),
+			"forwarders":         listField(&c.Resolver.Forwarders, checkServer),
+			"network":            stringField(&c.Resolver.Network, checkAddressFamily),
+			"timeout":            durationField(&c.Resolver.Timeout),
+			"resolution-timeout": durationField(&c.Resolver.ResolutionTimeout),
+			"attempt-delay":      durationField(&c.Resolver.AttemptDelay),
+			"minimise":           boolField(&c.Resolver.Minimise),
+			"max-referrals":      intField(&c.Resolver.MaxReferrals, 1, -1),
+			"max-queries":        intField(&c.Resolver.MaxQueries, 1, -1),
+			"max-cname-depth":    intField(&c.Resolver.MaxCNAMEDepth, 0, -1),
+			"hosts":              stringField(&c.Resolver.Hosts, nil),
+			"ecs-ipv4":           intField(&c.Resolver.ECSIPv4, 0, 32),
+			"ecs-ipv6":           intField(&c.Resolver.ECSIPv6, 0, 128),
+			"mdns":               boolField(&c.Resolver.MDNS),
+		},
+		"cache": {
+			"file":               stringField(&c.Cache.File, checkNotEmpty),
+			"max-entries":        intField(&c.Cache.MaxEntries, 0, -1),
+			"warmup":             stringField(&c.Cache.Warmup, nil),
+			"warmup-concurrency": intField(&c.Cache.WarmupConcurrency, 1, -1),
+		},
+		"log": {
+			"file":            stringField(&c.Log.File, nil),
+			"querylog":        stringField(&c.Log.QueryLog, nil),
+			"querylog-sample": floatField(&c.Log.QueryLogSample, 0, 1),
+			"dnstap":          stringField(&c.Log.Dnstap, nil),
+		},
+		"policy": {
+			"min-ttl":              intField(&c.Policy.MinTTL, 0, maxTTL),
+			"max-ttl":              intField(&c.Policy.MaxTTL, 0, maxTTL),
+			"rebinding-protection": boolField(&c.Policy.RebindingProtection),
+			"private-domains":      listField(&c.Policy.PrivateDomains, nil),
+			"overrides":            listField(&c.Policy.Overrides, checkOverride),
+		},
+		"blocklist": {
+			"files":    listField(&c.Blocklist.Files, nil),
+			"action":   stringField(&c.Blocklist.Action, checkBlockAction),
+			"sinkhole": listField(&c.Blocklist.Sinkhole, checkIP),
+		},
+	}
+}
+
+// Validate checks the settings as a whole, after command line flags have been applied on top
+// of the file. The file has been checked line by line already, so what is left to catch here
+// are bad flag values and settings that only make sense together. The latter are reported at
+// the line of the file that set the last of them, if the file set any.
+func (c *Config) Validate() error {
+	var errs []error
+	conflict := func(msg string, keys ...string) {
+		line := 0
+		for _, key := range keys {
+			line = max(line, c.lines[key])
+		}
+		if line == 0 {
+			errs = append(errs, errors.New(msg))
+			return
+		}
+		errs = append(errs, &Error{File: c.file, Line: line, Msg: msg})
+	}
+	check := func(key string, value string, check func(string) error) {
+		if err := check(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	checkAll := func(key string, values []string, fn func(string) error) {
+		for _, value := range values {
+			check(key, value, fn)
+		}
+	}
+	atLeast := func(key string, n int, min int) {
+		if n < min {
+			errs = append(errs, fmt.Errorf("%s: must be at least %d, not %d", key, min, n))
+		}
+	}
+
+	check("server.listen", c.Server.Listen, checkHostPort)
+	check("server.metrics", c.Server.Metrics, optional(checkHostPort))
+	checkAll("server.allow", c.Server.Allow, checkNetwork)
+	checkAll("server.tsig-keys", c.Server.TSIGKeys, checkTSIGKey)
+	check("server.dns64-prefix", c.Server.DNS64Prefix, checkDNS64Prefix)
+	checkAll("server.dns64-exclude", c.Server.DNS64Exclude, checkNetwork)
+	atLeast("server.rrl-slip", c.Server.RRLSlip, 0)
+	if c.Server.QueryRate < 0 || c.Server.RRLRate < 0 {
+		errs = append(errs, errors.New("server.query-rate and server.rrl-rate must not be negative"))
+	}
+	if c.Server.RequireTSIG && len(c.Server.TSIGKeys) == 0 {
+		conflict("server.require-tsig needs server.tsig-keys", "server.require-tsig", "server.tsig-keys")
+	}
+
+	checkAll("resolver.roots", c.Resolver.Roots, checkServer)
+	checkAll("resolver.forwarders", c.Resolver.Forwarders, checkServer)
+	check("resolver.network", c.Resolver.Network, checkAddressFamily)
+	if c.Resolver.ECSIPv4 < 0 || c.Resolver.ECSIPv4 > 32 || c.Resolver.ECSIPv6 < 0 || c.Resolver.ECSIPv6 > 128 {
+		errs = append(errs, fmt.Errorf("resolver.ecs-ipv4 and resolver.ecs-ipv6 must be prefix lengths, not %d and %d", c.Resolver.ECSIPv4, c.Resolver.ECSIPv6))
+	}
+	for key, d := range map[string]time.Duration{"server.timeout": c.Server.Timeout, "resolver.timeout": c.Resolver.Timeout, "resolver.resolution-timeout": c.Resolver.ResolutionTimeout} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive", key))
+		}
+	}
+	if c.Resolver.Timeout > c.Resolver.ResolutionTimeout {
+		conflict(fmt.Sprintf("resolver.timeout %s must not be longer than resolver.resolution-timeout %s", c.Resolver.Timeout, c.Resolver.ResolutionTimeout),
+			"resolver.timeout", "resolver.resolution-timeout")
+	}
+
+	check("cache.file", c.Cache.File, checkNotEmpty)
+	atLeast("cache.max-entries", c.Cache.MaxEntries, 0)
+	atLeast("cache.warmup-concurrency", c.Cache.WarmupConcurrency, 1)
+	if c.Log.QueryLogSample < 0 || c.Log.QueryLogSample > 1 {
+		errs = append(errs, fmt.Errorf("log.querylog-sample: must be between 0 and 1, not %g", c.Log.QueryLogSample))
+	}
+	check("blocklist.action", c.Blocklist.Action, checkBlockAction)
+	checkAll("blocklist.sinkhole", c.Blocklist.Sinkhole, checkIP)
+
+	if c.Policy.MinTTL < 0 || c.Policy.MinTTL > maxTTL || c.Policy.MaxTTL < 0 || c.Policy.MaxTTL > maxTTL {
+		errs = append(errs, fmt.Errorf("policy.min-ttl and policy.max-ttl must be between 0 and %d", maxTTL))
+	}
+	if c.Policy.MaxTTL > 0 && c.Policy.MinTTL > c.Policy.MaxTTL {
+		conflict(fmt.Sprintf("policy.min-ttl %d is above policy.max-ttl %d", c.Policy.MinTTL, c.Policy.MaxTTL), "policy.min-ttl", "policy.max-ttl")
+	}
+	checkAll("policy.overrides", c.Policy.Overrides, checkOverride)
+	return errors.Join(errs...)
+}
+
+func mismatch(v value, want kind) error {
+	return &Error{Line: v.line, Msg: fmt.Sprintf("expected %s, found %s", want, v.kind)}
+}
+
+func stringField(p *string, check func(string) error) setter {
+	return func(v value) error {
+		if v.kind != kindString {
+			return mismatch(v, kindString)
+		}
+		if check != nil {
+			if err := check(v.str); err != nil {
+				return err
+			}
+		}
+		*p = v.str
+		return nil
+	}
+}
+
+// listField sets a list of strings. A bad element is reported on its own line.
+func listField(p *[]string, check func(string) error) setter {
+	return func(v value) error {
+		if v.kind != kindArray {
+			return mismatch(v, kindArray)
+		}
+		list := []string{}
+		for _, element := range v.array {
+			if element.kind != kindString {
+				return mismatch(element, kindString)
+			}
+			if check != nil {
+				if err := check(element.str); err != nil {
+					return &Error{Line: element.line, Msg: err.Error()}
+				}
+			}
+			list = append(list, element.str)
+		}
+		*p = list
+		return nil
+	}
+}
+
+// intField sets an integer of at least min and at most max, or without a maximum when max is -1
+func intField(p *int, min int64, max int64) setter {
+	return func(v value) error {
+		if v.kind != kindInteger {
+			return mismatch(v, kindInteger)
+		}
+		if v.integer < min || (max >= 0 && v.integer > max) {
+			if max < 0 {
+				return fmt.Errorf("must be at least %d, not %d", min, v.integer)
+			}
+			return fmt.Errorf("must be between %d and %d, not %d", min, max, v.integer)
+		}
+		*p = int(v.integer)
+		return nil
+	}
+}
+
+// floatField sets a number of at least min and at most max, or without a maximum when max is -1.
+// Integers are numbers too.
+func floatField(p *float64, min float64, max float64) setter {
+	return func(v value) error {
+		f := v.float
+		switch v.kind {
+		case kindInteger:
+			f = float64(v.integer)
+		case kindFloat:
+		default:
+			return mismatch(v, kindFloat)
+		}
+		if f < min || (max >= 0 && f > max) {
+			if max < 0 {
+				return fmt.Errorf("must be at least %g, not %g", min, f)
+			}
+			return fmt.Errorf("must be between %g and %g, not %g", min, max, f)
+		}
+		*p = f
+		return nil
+	}
+}
+
+func boolField(p *bool) setter {
+	return func(v value) error {
+		if v.kind != kindBool {
+			return mismatch(v, kindBool)
+		}
+		*p = v.boolean
+		return nil
+	}
+}
+
+// durationField sets a positive duration written like "5s" or "250ms"
+func durationField(p *time.Duration) setter {
+	return func(v value) error {
+		if v.kind != kindString {
+			return &Error{Line: v.line, Msg: fmt.Sprintf("expected a duration in quotes like \"5s\", found %s", v.kind)}
+		}
+		d, err := time.ParseDuration(v.str)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v.str)
+		}
+		if d <= 0 {
+			return fmt.Errorf("must be positive, not %s", v.str)
+		}
+		*p = d
+		return nil
+	}
+}
+
+// optional lets an empty string through a check, for settings that empty turns off
+func optional(check func(string) error) func(string) error {
+	return func(s string) error {
+		if s == "" {
+			return nil
+		}
+		return check(s)
+	}
+}
+
+func checkOverride(s string) error {
+	_, err := resolver.ParseOverride(s)
+	return err
+}
+
+func checkNotEmpty(s string) error {
+	if s == "" {
+		return errors.New("must not be empty")
+	}
+	return nil
+}
+
+func checkHostPort(s string) error {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return fmt.Errorf("expected host:port, found %q", s)
+	}
+	return nil
+}
+
+func checkNetwork(s string) error {
+	_, err := server.ParseACL([]string{s})
+	return err
+}
+
+func checkTSIGKey(s string) error {
+	_, err := query.ParseTSIGKey(s)
+	return err
+}
+
+func checkDNS64Prefix(s string) error {
+	_, err := server.ParseDNS64Prefix(s)
+	return err
+}
+
+func checkIP(s string) error {
+	if net.ParseIP(s) == nil {
+		return fmt.Errorf("invalid address %q", s)
+	}
+	return nil
+}
+
+// checkServer accepts a nameserver address, optionally with a port
+func checkServer(s string) error {
+	host := s
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid nameserver address %q", s)
+	}
+	return nil
+}
+
+func checkAddressFamily(s string) error {
+	switch s {
+	case "ip", "ip4", "ip6":
+		return nil
+	}
+	return fmt.Errorf("must be ip, ip4 or ip6, not %q", s)
+}
+
+// checkBlockAction accepts the actions that make sense for every name on a list. The others
+// only come from RPZ rules.
+func checkBlockAction(s string) error {
+	action, err := blocklist.ParseAction(s)
+	if err != nil {
+		return err
+	}
+	if action != blocklist.ActionNXDOMAIN && action != blocklist.ActionNODATA && action != blocklist.ActionSinkhole {
+		return fmt.Errorf("must be nxdomain, nodata or sinkhole, not %q", strings.ToLower(s))
+	}
+	return nil
+}
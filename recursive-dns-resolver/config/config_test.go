@@ -0,0 +1,131 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, doc string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "resolver.toml")
+	if err := os.WriteFile(file, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(writeConfig(t, `
+[server]
+listen = "127.0.0.1:5301"
+allow = ["10.0.0.0/8"]
+
+[resolver]
+timeout = "2s"
+forwarders = ["192.0.2.53", "[2001:db8::53]:5353"]
+mdns = true
+
+[policy]
+min-ttl = 60
+overrides = ["intranet.example.com A 10.1.2.3"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.Listen != "127.0.0.1:5301" || len(c.Server.Allow) != 1 || c.Resolver.Timeout != 2*time.Second || !c.Resolver.MDNS || len(c.Resolver.Forwarders) != 2 || c.Policy.MinTTL != 60 {
+		t.Errorf("loaded %+v", c)
+	}
+	// What the file leaves out keeps its default
+	if c.Cache.File != Default().Cache.File || c.Resolver.ResolutionTimeout != Default().Resolver.ResolutionTimeout {
+		t.Errorf("defaults were not kept: %+v", c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestDefaultValid(t *testing.T) {
+	c := Default()
+	if err := c.Validate(); err != nil {
+		t.Errorf("the defaults do not validate: %v", err)
+	}
+	if c.Resolver.MDNS {
+		t.Error("mDNS is on by default, serve must only use it when asked to")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		line int
+		msg  string
+	}{
+		{"unknown section", "[server]\nlisten = \"127.0.0.1:53\"\n[servr]\n", 3, "unknown section [servr]"},
+		{"unknown key", "[server]\n\nlisen = \"127.0.0.1:53\"\n", 3, "unknown key server.lisen"},
+		{"key outside a section", "listen = \"127.0.0.1:53\"\n", 1, "must be in a section"},
+		{"wrong type", "[resolver]\nmax-queries = \"many\"\n", 2, "resolver.max-queries: expected an integer, found a string"},
+		{"out of range", "[log]\nquerylog-sample = 1.5\n", 2, "must be between 0 and 1"},
+		{"bad duration", "[resolver]\ntimeout = \"5 seconds\"\n", 2, "resolver.timeout"},
+		{"bad address", "[server]\nlisten = \"localhost\"\n", 2, "server.listen"},
+		{"bad list element", "[server]\nallow = [\n  \"10.0.0.0/8\",\n  \"10.0.0.0/33\",\n]\n", 4, "server.allow"},
+		{"bad forwarder", "[resolver]\nforwarders = [\"dns.example\"]\n", 2, "resolver.forwarders"},
+		{"bad override", "[policy]\noverrides = [\"intranet.example.com A not-an-ip\"]\n", 2, "policy.overrides"},
+		{"dnssec key", "[resolver]\ndnssec = true\n", 2, "DNSSEC validation is not supported"},
+		{"dnssec section", "[server]\n[dnssec]\n", 2, "DNSSEC validation is not supported"},
+	}
+	for _, test := range tests {
+		_, err := Load(writeConfig(t, test.doc))
+		var lineErr *Error
+		if !errors.As(err, &lineErr) {
+			t.Errorf("%s: got %v, want an error on line %d", test.name, err, test.line)
+			continue
+		}
+		if lineErr.Line != test.line || !strings.Contains(lineErr.Msg, test.msg) || !strings.HasSuffix(lineErr.File, "resolver.toml") {
+			t.Errorf("%s: got %q, want line %d with %q", test.name, lineErr, test.line, test.msg)
+		}
+	}
+}
+
+// Settings that only conflict together are reported at the line of whichever came last
+func TestValidateLines(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		line int
+		msg  string
+	}{
+		{"min-ttl above max-ttl", "[policy]\nmin-ttl = 600\n\nmax-ttl = 60\n", 4, "policy.min-ttl 600 is above policy.max-ttl 60"},
+		{"require-tsig without keys", "[server]\nrequire-tsig = true\n", 2, "server.require-tsig needs server.tsig-keys"},
+		{"timeout longer than the lookup", "[resolver]\nresolution-timeout = \"2s\"\ntimeout = \"5s\"\n", 3, "resolver.timeout 5s must not be longer than resolver.resolution-timeout 2s"},
+		{"timeout longer than the default lookup", "[resolver]\ntimeout = \"1m\"\n", 2, "resolver.resolution-timeout 15s"},
+	}
+	for _, test := range tests {
+		c, err := Load(writeConfig(t, test.doc))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var lineErr *Error
+		if err := c.Validate(); !errors.As(err, &lineErr) {
+			t.Errorf("%s: got %v, want an error on line %d", test.name, err, test.line)
+			continue
+		}
+		if lineErr.Line != test.line || !strings.Contains(lineErr.Msg, test.msg) {
+			t.Errorf("%s: got %q, want line %d with %q", test.name, lineErr, test.line, test.msg)
+		}
+	}
+
+	// Without a file there is no line to point at
+	c := Default()
+	c.Policy.MinTTL, c.Policy.MaxTTL = 600, 60
+	err := c.Validate()
+	var lineErr *Error
+	if err == nil || errors.As(err, &lineErr) {
+		t.Errorf("flags alone gave %v, want an error without a line", err)
+	}
+}
@@ -0,0 +1,309 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The config file is written in a subset of TOML: [section] headers, key = value pairs and
+// # comments. Values are strings in double or single quotes, integers, floats, true and false,
+// and arrays of those in square brackets, which may span several lines. That is all the
+// settings need, and it keeps the parser small enough to report every error with its line.
+
+// Error is a problem with a config file, reported with the line it is on
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindInteger
+	kindFloat
+	kindBool
+	kindArray
+)
+
+func (k kind) String() string {
+	return [...]string{"a string", "an integer", "a number", "true or false", "an array"}[k]
+}
+
+// value is one parsed value and the line it starts on
+type value struct {
+	line    int
+	kind    kind
+	str     string
+	integer int64
+	float   float64
+	boolean bool
+	array   []value
+}
+
+// entry is one key = value pair of a section
+type entry struct {
+	key   string
+	value value
+}
+
+// section is a [section] of the file and its entries in the order they were written. The
+// entries before the first header belong to the section with an empty name.
+type section struct {
+	name    string
+	line    int
+	entries []entry
+}
+
+// parser reads a document one line at a time. Arrays may continue on the following lines.
+type parser struct {
+	file  string
+	lines []string
+	line  int // index of the current line
+	rest  string
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &Error{File: p.file, Line: p.line + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// parse splits a document into its sections
+func parse(file string, data string) ([]section, error) {
+	p := &parser{file: file, lines: strings.Split(data, "\n")}
+	sections := []section{{line: 1}}
+	seenSections := map[string]bool{"": true}
+	seenKeys := map[string]bool{}
+	for ; p.line < len(p.lines); p.line++ {
+		p.rest = p.lines[p.line]
+		p.skipSpace()
+		if p.rest == "" {
+			continue
+		}
+
+		if strings.HasPrefix(p.rest, "[") {
+			end := strings.Index(p.rest, "]")
+			if end < 0 {
+				return nil, p.errorf("section header is missing its closing ]")
+			}
+			name := strings.TrimSpace(p.rest[1:end])
+			if !validKey(name) {
+				return nil, p.errorf("invalid section name %q", name)
+			}
+			if seenSections[name] {
+				return nil, p.errorf("section [%s] appears twice", name)
+			}
+			seenSections[name] = true
+			p.rest = p.rest[end+1:]
+			if err := p.endOfLine(); err != nil {
+				return nil, err
+			}
+			sections = append(sections, section{name: name, line: p.line + 1})
+			continue
+		}
+
+		current := &sections[len(sections)-1]
+		equals := strings.Index(p.rest, "=")
+		if equals < 0 {
+			return nil, p.errorf("expected key = value or [section]")
+		}
+		key := strings.TrimSpace(p.rest[:equals])
+		if !validKey(key) {
+			return nil, p.errorf("invalid key %q", key)
+		}
+		if seenKeys[current.name+"."+key] {
+			return nil, p.errorf("%s is set twice", qualified(current.name, key))
+		}
+		seenKeys[current.name+"."+key] = true
+		p.rest = p.rest[equals+1:]
+		p.skipSpace()
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+		current.entries = append(current.entries, entry{key: key, value: v})
+	}
+	return sections, nil
+}
+
+// validKey reports whether a key or section name only uses the characters of TOML bare keys
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// qualified returns the name a key goes by in error messages, e.g. server.listen
+func qualified(section string, key string) string {
+	if section == "" {
+		return key
+	}
+	return section + "." + key
+}
+
+// skipSpace drops blanks and a comment from the front of the rest of the line
+func (p *parser) skipSpace() {
+	p.rest = strings.TrimLeft(p.rest, " \t\r")
+	if strings.HasPrefix(p.rest, "#") {
+		p.rest = ""
+	}
+}
+
+// endOfLine checks that nothing but a comment follows a value or header
+func (p *parser) endOfLine() error {
+	p.skipSpace()
+	if p.rest != "" {
+		return p.errorf("unexpected %q after the value", p.rest)
+	}
+	return nil
+}
+
+// value parses the value at the front of the rest of the line
+func (p *parser) value() (value, error) {
+	v := value{line: p.line + 1}
+	switch {
+	case p.rest == "":
+		return v, p.errorf("missing value")
+	case p.rest[0] == '"':
+		return p.basicString(v)
+	case p.rest[0] == '\'':
+		end := strings.Index(p.rest[1:], "'")
+		if end < 0 {
+			return v, p.errorf("string is missing its closing quote")
+		}
+		v.kind, v.str = kindString, p.rest[1:1+end]
+		p.rest = p.rest[2+end:]
+		return v, nil
+	case p.rest[0] == '[':
+		return p.arrayValue(v)
+	}
+
+	// A bare word runs until a blank, comma, bracket or comment
+	end := strings.IndexAny(p.rest, " \t\r,]#")
+	if end < 0 {
+		end = len(p.rest)
+	}
+	word := p.rest[:end]
+	p.rest = p.rest[end:]
+	switch {
+	case word == "true" || word == "false":
+		v.kind, v.boolean = kindBool, word == "true"
+	case word == "" || !strings.ContainsAny(word[:1], "0123456789+-."):
+		return v, p.errorf("invalid value %q, strings must be quoted", word)
+	case strings.ContainsAny(word, ".eE") && !strings.HasPrefix(word, "0x"):
+		f, err := strconv.ParseFloat(strings.ReplaceAll(word, "_", ""), 64)
+		if err != nil {
+			return v, p.errorf("invalid number %q", word)
+		}
+		v.kind, v.float = kindFloat, f
+	default:
+		n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 0, 64)
+		if err != nil {
+			return v, p.errorf("invalid value %q, strings must be quoted", word)
+		}
+		v.kind, v.integer = kindInteger, n
+	}
+	return v, nil
+}
+
+// basicString parses a double quoted string with the escapes TOML allows
+func (p *parser) basicString(v value) (value, error) {
+	var b strings.Builder
+	for i := 1; i < len(p.rest); i++ {
+		c := p.rest[i]
+		switch {
+		case c == '"':
+			v.kind, v.str = kindString, b.String()
+			p.rest = p.rest[i+1:]
+			return v, nil
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(p.rest) {
+			break
+		}
+		switch p.rest[i] {
+		case '"', '\\':
+			b.WriteByte(p.rest[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if i+4 >= len(p.rest) {
+				return v, p.errorf("incomplete \\u escape")
+			}
+			r, err := strconv.ParseUint(p.rest[i+1:i+5], 16, 32)
+			if err != nil {
+				return v, p.errorf("invalid \\u escape %q", p.rest[i-1:i+5])
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			return v, p.errorf("invalid escape \\%c", p.rest[i])
+		}
+	}
+	return v, p.errorf("string is missing its closing quote")
+}
+
+// arrayValue parses an array, moving on to the next lines until its closing bracket. The
+// elements keep their own lines, so a bad element is reported where it is.
+func (p *parser) arrayValue(v value) (value, error) {
+	v.kind = kindArray
+	p.rest = p.rest[1:]
+	for {
+		p.skipSpace()
+		for p.rest == "" {
+			if p.line+1 == len(p.lines) {
+				return v, &Error{File: p.file, Line: v.line, Msg: "array is missing its closing ]"}
+			}
+			p.line++
+			p.rest = p.lines[p.line]
+			p.skipSpace()
+		}
+		if p.rest[0] == ']' {
+			p.rest = p.rest[1:]
+			return v, nil
+		}
+		element, err := p.value()
+		if err != nil {
+			return v, err
+		}
+		if element.kind == kindArray {
+			return v, p.errorf("arrays of arrays are not supported")
+		}
+		v.array = append(v.array, element)
+
+		p.skipSpace()
+		for p.rest == "" && p.line+1 < len(p.lines) {
+			p.line++
+			p.rest = p.lines[p.line]
+			p.skipSpace()
+		}
+		switch {
+		case strings.HasPrefix(p.rest, ","):
+			p.rest = p.rest[1:]
+		case strings.HasPrefix(p.rest, "]"):
+		case p.rest == "":
+			return v, &Error{File: p.file, Line: v.line, Msg: "array is missing its closing ]"}
+		default:
+			return v, p.errorf("expected , or ] after an array element, found %q", p.rest)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	sections, err := parse("test.toml", `# top comment
+name = "top" # trailing comment
+
+[server]
+listen = '127.0.0.1:53'
+timeout = "5s"
+rate = 1_000
+sample = 0.25
+enabled = true
+escaped = "tab\there \"quoted\" \u00e9"
+allow = [
+  "10.0.0.0/8",   # private
+  "192.0.2.0/24",
+]
+empty = []
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 2 || sections[0].name != "" || sections[1].name != "server" || sections[1].line != 4 {
+		t.Fatalf("sections = %+v", sections)
+	}
+	entries := map[string]value{}
+	for _, entry := range sections[1].entries {
+		entries[entry.key] = entry.value
+	}
+	checks := []struct {
+		key  string
+		ok   bool
+		line int
+	}{
+		{"listen", entries["listen"].str == "127.0.0.1:53", 5},
+		{"rate", entries["rate"].kind == kindInteger && entries["rate"].integer == 1000, 7},
+		{"sample", entries["sample"].kind == kindFloat && entries["sample"].float == 0.25, 8},
+		{"enabled", entries["enabled"].kind == kindBool && entries["enabled"].boolean, 9},
+		{"escaped", entries["escaped"].str == "tab\there \"quoted\" é", 10},
+		{"allow", len(entries["allow"].array) == 2 && entries["allow"].array[1].str == "192.0.2.0/24", 11},
+		{"empty", entries["empty"].kind == kindArray && len(entries["empty"].array) == 0, 15},
+	}
+	for _, check := range checks {
+		if !check.ok || entries[check.key].line != check.line {
+			t.Errorf("%s parsed as %+v, want it on line %d", check.key, entries[check.key], check.line)
+		}
+	}
+	// Array elements keep the lines they are on
+	if lines := []int{entries["allow"].array[0].line, entries["allow"].array[1].line}; lines[0] != 12 || lines[1] != 13 {
+		t.Errorf("array elements are on lines %v, want 12 and 13", lines)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		line int
+		msg  string
+	}{
+		{"missing equals", "[server]\nlisten\n", 2, "expected key = value"},
+		{"unclosed section", "[server\n", 1, "missing its closing ]"},
+		{"bad section name", "[ser ver]\n", 1, "invalid section name"},
+		{"section twice", "[server]\n[cache]\n[server]\n", 3, "appears twice"},
+		{"key twice", "[server]\nlisten = \"a\"\n\nlisten = \"b\"\n", 4, "server.listen is set twice"},
+		{"same key in two sections", "[server]\ntimeout = \"1s\"\n[resolver]\ntimeout = \"1s\"\n", 0, ""},
+		{"bad key", "[server]\nlis ten = 1\n", 2, "invalid key"},
+		{"missing value", "[server]\nlisten =\n", 2, "missing value"},
+		{"bare word", "[server]\nlisten = localhost\n", 2, "strings must be quoted"},
+		{"bad number", "[server]\nrate = 1.2.3\n", 2, "invalid number"},
+		{"unclosed string", "[server]\nlisten = \"127.0.0.1\n", 2, "missing its closing quote"},
+		{"unclosed literal string", "[server]\nlisten = '127.0.0.1\n", 2, "missing its closing quote"},
+		{"bad escape", "[server]\nlisten = \"\\x\"\n", 2, "invalid escape"},
+		{"short unicode escape", "[server]\nlisten = \"\\u12\"\n", 2, "incomplete \\u escape"},
+		{"trailing garbage", "[server]\nlisten = \"a\" \"b\"\n", 2, "after the value"},
+		{"garbage after header", "[server] x\n", 1, "after the value"},
+		// An unclosed array is reported where it starts, not at the end of the file
+		{"unclosed array", "[server]\nallow = [\n  \"10.0.0.0/8\",\n\n", 2, "array is missing its closing ]"},
+		{"missing comma", "[server]\nallow = [\n  \"10.0.0.0/8\"\n  \"192.0.2.0/24\"\n]\n", 4, "expected , or ]"},
+		{"nested array", "[server]\nallow = [\n  [\"10.0.0.0/8\"],\n]\n", 3, "arrays of arrays"},
+		{"empty element", "[server]\nallow = [,]\n", 2, "strings must be quoted"},
+		{"closing bracket as value", "[server]\nlisten = ]\n", 2, "strings must be quoted"},
+		{"bad element", "[server]\nallow = [\n  \"10.0.0.0/8\",\n  ten,\n]\n", 4, "strings must be quoted"},
+	}
+	for _, test := range tests {
+		_, err := parse("test.toml", test.doc)
+		if test.msg == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		var lineErr *Error
+		if !errors.As(err, &lineErr) {
+			t.Errorf("%s: got %v, want an error on line %d", test.name, err, test.line)
+			continue
+		}
+		if lineErr.File != "test.toml" || lineErr.Line != test.line || !strings.Contains(lineErr.Msg, test.msg) {
+			t.Errorf("%s: got %q, want line %d with %q", test.name, lineErr, test.line, test.msg)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity says how bad a finding is. Errors break resolution for some clients, warnings
+// are misconfigurations that still resolve.
+type Severity string
+
+const (
+	Warning Severity = "warning"
+	Error   Severity = "error"
+)
+
+// Finding is one problem found with the zone or one of its servers
+type Finding struct {
+	Server   string   `json:"server,omitempty"`
+	Check    string   `json:"check"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// ServerReport is what one address of one nameserver answered
+type ServerReport struct {
+	Name          string        `json:"name"`
+	Address       string        `json:"address"`
+	Serial        uint32        `json:"serial,omitempty"`
+	NS            []string      `json:"ns,omitempty"`
+	Authoritative bool          `json:"authoritative"`
+	Recursion     bool          `json:"recursion"`
+	EDNS          bool          `json:"edns"`
+	TCP           bool          `json:"tcp"`
+	RTT           time.Duration `json:"rtt"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// Report is the outcome of checking one zone
+type Report struct {
+	Zone     string              `json:"zone"`
+	Parent   string              `json:"parent"`
+	ParentNS []string            `json:"parent_ns"`
+	Glue     map[string][]string `json:"glue,omitempty"`
+	Servers  []ServerReport      `json:"servers"`
+	Findings []Finding           `json:"findings"`
+}
+
+// OK reports whether nothing worse than a warning was found
+func (r *Report) OK() bool {
+	for _, finding := range r.Findings {
+		if finding.Severity == Error {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) add(server string, check string, severity Severity, format string, args ...any) {
+	r.Findings = append(r.Findings, Finding{Server: server, Check: check, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check finds the delegation of zone with the iterative logic of res, asks every address of
+// every nameserver for the SOA and NS records of the zone, and reports lame servers, serial
+// and NS mismatches, missing or stale glue, open recursion and broken TCP or EDNS. Only the
+// addresses res.Network allows are probed.
+func Check(ctx context.Context, res *resolver.Resolver, zone string) (*Report, error) {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	delegation, err := res.FindDelegation(ctx, zone)
+	if err != nil {
+		return nil, fmt.Errorf("finding the delegation of %s: %w", zone, err)
+	}
+	report := &Report{Zone: zone, Parent: delegation.Parent, Glue: make(map[string][]string)}
+	nameservers := lookupNameservers(ctx, res, delegation)
+	network := res.Network
+	if network == "" {
+		network = "ip"
+	}
+	var targets []target
+	for _, ns := range nameservers {
+		report.ParentNS = append(report.ParentNS, ns.name)
+		if len(ns.glue) > 0 {
+			report.Glue[ns.name] = ns.glue
+		}
+		checkGlue(report, zone, ns)
+		targets = append(targets, ns.targets(network)...)
+	}
+	if len(targets) == 0 {
+		report.add("", "addresses", Error, "no nameserver of %s has an address usable with network %s", zone, network)
+		return report, nil
+	}
+
+	report.Servers = make([]ServerReport, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Servers[i] = checkServer(ctx, res.Timeout, zone, t.name, t.address)
+		}()
+	}
+	wg.Wait()
+
+	for _, server := range report.Servers {
+		serverFindings(report, server)
+	}
+	compareSerials(report)
+	compareNS(report)
+	return report, nil
+}
+
+// checkServer probes one address of a nameserver, giving each probe timeout
+func checkServer(ctx context.Context, timeout time.Duration, zone string, name string, address string) ServerReport {
+	server := ServerReport{Name: name, Address: address}
+	response, rtt, err := probe(ctx, timeout, "udp", address, zone, query.TYPE_SOA, true)
+	if err == nil && query.GetRcode(*response) == query.RCODE_FORMERR {
+		// Some servers reject any OPT record, and answer without one
+		response, rtt, err = probe(ctx, timeout, "udp", address, zone, query.TYPE_SOA, false)
+	} else if err == nil {
+		server.EDNS = query.GetOPT(*response) != nil
+	}
+	if err != nil {
+		server.Error = err.Error()
+		return server
+	}
+	server.RTT = rtt
+	server.Authoritative = response.Header.Flags&query.FLAG_AA != 0
+	server.Recursion = response.Header.Flags&query.FLAG_RA != 0
+	if rcode := query.GetRcode(*response); rcode != query.RCODE_NOERROR {
+		server.Error = "answered " + query.RcodeName(rcode)
+		return server
+	}
+	soa, ok := answerSOA(response, zone)
+	if !ok {
+		server.Error = "no SOA record in the answer"
+		return server
+	}
+	server.Serial = soa.Serial
+
+	if response, _, err := probe(ctx, timeout, "udp", address, zone, query.TYPE_NS, true); err == nil {
+		server.NS = answerNS(response, zone)
+		sort.Strings(server.NS)
+	}
+	if response, _, err := probe(ctx, timeout, "tcp", address, zone, query.TYPE_SOA, false); err == nil {
+		_, server.TCP = answerSOA(response, zone)
+	}
+	return server
+}
+
+// serverFindings turns what one server answered into findings
+func serverFindings(report *Report, server ServerReport) {
+	label := server.Name + " " + server.Address
+	if server.Error != "" {
+		report.add(label, "lame", Error, "%s", server.Error)
+		return
+	}
+	if !server.Authoritative {
+		report.add(label, "lame", Error, "answers without the authoritative bit for %s", report.Zone)
+	}
+	if server.Recursion {
+		report.add(label, "recursion", Warning, "offers recursion, authoritative servers should not")
+	}
+	if !server.EDNS {
+		report.add(label, "edns", Warning, "does not answer with EDNS")
+	}
+	if !server.TCP {
+		report.add(label, "tcp", Error, "does not answer over TCP")
+	}
+}
+
+// checkGlue compares the glue the parent gives for a nameserver with its addresses in its own
+// zone. Glue is needed only for nameservers inside the zone they serve. Each address family is
+// compared on its own, and only when the parent gives glue of that family: A glue alone for a
+// name that also has AAAA records is not stale.
+func checkGlue(report *Report, zone string, ns nameserver) {
+	inZone := ns.name == zone || strings.HasSuffix(ns.name, "."+zone)
+	switch {
+	case inZone && len(ns.glue) == 0:
+		report.add(ns.name, "glue", Error, "is inside %s but the parent gives no glue for it", zone)
+	case ns.lookupErr != nil && len(ns.glue) == 0:
+		report.add(ns.name, "addresses", Error, "has no address: %v", ns.lookupErr)
+	case ns.lookupErr != nil:
+		report.add(ns.name, "glue", Warning, "has glue %s but no address of its own: %v", strings.Join(ns.glue, ", "), ns.lookupErr)
+	default:
+		for _, family := range []struct{ network, name string }{{"ip4", "IPv4"}, {"ip6", "IPv6"}} {
+			glue, addresses := inFamily(ns.glue, family.network), inFamily(ns.addresses, family.network)
+			if len(glue) == 0 || slices.Equal(glue, addresses) {
+				continue
+			}
+			if len(addresses) == 0 {
+				report.add(ns.name, "glue", Warning, "%s glue %s is stale, the name has no %s address", family.name, strings.Join(glue, ", "), family.name)
+				continue
+			}
+			report.add(ns.name, "glue", Warning, "%s glue %s is stale, the name has %s", family.name, strings.Join(glue, ", "), strings.Join(addresses, ", "))
+		}
+	}
+}
+
+// compareSerials reports every server that is behind the newest serial any server has
+func compareSerials(report *Report) {
+	var newest uint32
+	found := false
+	for _, server := range report.Servers {
+		if server.Error == "" && (!found || query.SerialNewer(server.Serial, newest)) {
+			newest, found = server.Serial, true
+		}
+	}
+	for _, server := range report.Servers {
+		if server.Error == "" && server.Serial != newest {
+			report.add(server.Name+" "+server.Address, "serial", Warning, "has serial %d, others have %d", server.Serial, newest)
+		}
+	}
+}
+
+// compareNS reports servers whose NS set differs from the one the parent delegates to
+func compareNS(report *Report) {
+	for _, server := range report.Servers {
+		if server.Error != "" || server.NS == nil {
+			continue
+		}
+		missing := difference(report.ParentNS, server.NS)
+		extra := difference(server.NS, report.ParentNS)
+		if len(missing) > 0 {
+			report.add(server.Name+" "+server.Address, "ns", Warning, "child NS set lacks %s, which the parent delegates to", strings.Join(missing, ", "))
+		}
+		if len(extra) > 0 {
+			report.add(server.Name+" "+server.Address, "ns", Warning, "child NS set has %s, which the parent does not delegate to", strings.Join(extra, ", "))
+		}
+	}
+}
+
+// difference returns the entries of a that are not in b
+func difference(a []string, b []string) []string {
+	var out []string
+	for _, entry := range a {
+		if !slices.Contains(b, entry) {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package healthcheck
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCheckGlue(t *testing.T) {
+	tests := []struct {
+		name     string
+		ns       nameserver
+		severity Severity
+		messages []string
+	}{
+		{
+			name: "A glue for a dual stack name",
+			ns:   nameserver{name: "ns1.example.com", glue: []string{"192.0.2.1"}, addresses: []string{"192.0.2.1", "2001:db8::1"}},
+		},
+		{
+			name: "glue of both families",
+			ns:   nameserver{name: "ns1.example.com", glue: []string{"192.0.2.1", "2001:db8::1"}, addresses: []string{"192.0.2.1", "2001:db8::1"}},
+		},
+		{
+			name:     "stale A glue",
+			ns:       nameserver{name: "ns1.example.com", glue: []string{"192.0.2.9"}, addresses: []string{"192.0.2.1", "2001:db8::1"}},
+			severity: Warning,
+			messages: []string{"IPv4 glue 192.0.2.9 is stale, the name has 192.0.2.1"},
+		},
+		{
+			name:     "AAAA glue for an IPv4 only name",
+			ns:       nameserver{name: "ns1.example.com", glue: []string{"192.0.2.1", "2001:db8::1"}, addresses: []string{"192.0.2.1"}},
+			severity: Warning,
+			messages: []string{"IPv6 glue 2001:db8::1 is stale, the name has no IPv6 address"},
+		},
+		{
+			name:     "no glue inside the zone",
+			ns:       nameserver{name: "ns1.example.com", addresses: []string{"192.0.2.1"}},
+			severity: Error,
+			messages: []string{"is inside example.com but the parent gives no glue for it"},
+		},
+		{
+			name: "no glue outside the zone",
+			ns:   nameserver{name: "ns1.example.net", addresses: []string{"192.0.2.1"}},
+		},
+		{
+			name:     "glue without an address of its own",
+			ns:       nameserver{name: "ns1.example.com", glue: []string{"192.0.2.1"}, lookupErr: errors.New("SERVFAIL")},
+			severity: Warning,
+			messages: []string{"has glue 192.0.2.1 but no address of its own: SERVFAIL"},
+		},
+	}
+	for _, test := range tests {
+		report := &Report{}
+		checkGlue(report, "example.com", test.ns)
+		var messages []string
+		for _, finding := range report.Findings {
+			messages = append(messages, finding.Message)
+			if finding.Severity != test.severity {
+				t.Errorf("%s: %q is a %s, want %s", test.name, finding.Message, finding.Severity, test.severity)
+			}
+		}
+		if !slices.Equal(messages, test.messages) {
+			t.Errorf("%s: findings %q, want %q", test.name, messages, test.messages)
+		}
+	}
+}
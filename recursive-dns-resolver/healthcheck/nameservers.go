@@ -0,0 +1,86 @@
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"recursive-dns-resolver/resolver"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// nameserver is one nameserver of a delegation with the addresses we know for it
+type nameserver struct {
+	name string
+	// glue is what the parent gives, addresses what the name has in its own zone
+	glue      []string
+	addresses []string
+	lookupErr error
+}
+
+// target is one address of a nameserver to send queries to
+type target struct{ name, address string }
+
+// lookupNameservers looks up the addresses of every nameserver of a delegation. The address
+// a name has in its own zone is what resolvers end up using once the glue has expired, so it
+// is asked for even when there is glue.
+func lookupNameservers(ctx context.Context, res *resolver.Resolver, delegation *resolver.Delegation) []nameserver {
+	var nameservers []nameserver
+	for _, nsName := range delegation.NS {
+		ns := nameserver{name: strings.ToLower(nsName), glue: addressStrings(delegation.Glue[strings.ToLower(nsName)])}
+		resolved, err := res.LookupIP(ctx, "ip", ns.name+".")
+		ns.addresses, ns.lookupErr = addressStrings(resolved), err
+		nameservers = append(nameservers, ns)
+	}
+	sort.Slice(nameservers, func(i, j int) bool { return nameservers[i].name < nameservers[j].name })
+	return nameservers
+}
+
+// targets lists every known address of the nameserver that network ("ip", "ip4" or "ip6") allows
+func (ns nameserver) targets(network string) []target {
+	var targets []target
+	for _, address := range union(ns.glue, ns.addresses) {
+		if allowed(network, address) {
+			targets = append(targets, target{ns.name, address})
+		}
+	}
+	return targets
+}
+
+// inFamily returns the addresses that network allows, keeping their order
+func inFamily(addresses []string, network string) []string {
+	var allowedAddresses []string
+	for _, address := range addresses {
+		if allowed(network, address) {
+			allowedAddresses = append(allowedAddresses, address)
+		}
+	}
+	return allowedAddresses
+}
+
+func allowed(network string, address string) bool {
+	ip := net.ParseIP(address)
+	switch network {
+	case "ip4":
+		return ip.To4() != nil
+	case "ip6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// addressStrings returns ips as sorted strings without duplicates
+func addressStrings(ips []net.IP) []string {
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	sort.Strings(addresses)
+	return slices.Compact(addresses)
+}
+
+func union(a []string, b []string) []string {
+	all := append(append([]string{}, a...), b...)
+	sort.Strings(all)
+	return slices.Compact(all)
+}
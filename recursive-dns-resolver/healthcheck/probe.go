@@ -0,0 +1,101 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/socket"
+	"strings"
+	"time"
+)
+
+// probe sends one question to an authoritative server exactly as given, without recursion
+// desired and optionally with EDNS, over "udp" or "tcp", and returns the response. Each probe
+// gets timeout of its own, so one unresponsive server cannot use up the whole check.
+func probe(ctx context.Context, timeout time.Duration, network string, server string, zone string, qtype uint16, edns bool) (*query.DNSPacket, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	request := query.DNSPacket{
+		Header:    query.DNSHeader{ID: uint16(rand.Intn(65536))},
+		Questions: []query.DNSQuestion{{Name: []byte(zone), Type: qtype, Class: 1}},
+	}
+	if edns {
+		request.Additionals = []query.DNSRecord{query.NewOPT(query.DefaultUDPSize)}
+	}
+	message := query.PacketToBytes(request)
+
+	conn, err := socket.DialContext(ctx, network, net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	sent := time.Now()
+	if network == "tcp" {
+		if err := socket.WriteTCPMessage(conn, message); err != nil {
+			return nil, 0, err
+		}
+		reply, err := socket.ReadTCPMessage(conn)
+		if err != nil {
+			return nil, 0, err
+		}
+		response, err := matchProbe(request, reply)
+		return response, time.Since(sent), err
+	}
+
+	if _, err := conn.Write(message); err != nil {
+		return nil, 0, err
+	}
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, 0, err
+		}
+		// A stray datagram is skipped, we keep waiting for our answer until the deadline
+		if response, err := matchProbe(request, buffer[:n]); err == nil {
+			return response, time.Since(sent), nil
+		}
+	}
+}
+
+// matchProbe parses reply and checks that it answers request
+func matchProbe(request query.DNSPacket, reply []byte) (*query.DNSPacket, error) {
+	response, err := query.ParseDNSResponse(reply)
+	if err != nil {
+		return nil, err
+	}
+	if response.Header.ID != request.Header.ID {
+		return nil, fmt.Errorf("response ID %d does not match request ID %d", response.Header.ID, request.Header.ID)
+	}
+	question := request.Questions[0]
+	if len(response.Questions) != 1 || !strings.EqualFold(string(response.Questions[0].Name), string(question.Name)) ||
+		response.Questions[0].Type != question.Type {
+		return nil, fmt.Errorf("response question does not match %s", question.Name)
+	}
+	return response, nil
+}
+
+// answerSOA returns the SOA of zone from the answer section
+func answerSOA(response *query.DNSPacket, zone string) (query.SOAData, bool) {
+	for _, record := range response.Answers {
+		if record.Type == query.TYPE_SOA && strings.EqualFold(string(record.Name), zone) {
+			soa, err := query.DecodeSOA(record.Data)
+			return soa, err == nil
+		}
+	}
+	return query.SOAData{}, false
+}
+
+// answerNS returns the names of the NS records of zone in the answer section
+func answerNS(response *query.DNSPacket, zone string) []string {
+	var names []string
+	for _, record := range response.Answers {
+		if record.Type == query.TYPE_NS && strings.EqualFold(string(record.Name), zone) {
+			names = append(names, strings.ToLower(query.DecodeNSName(record.Data)))
+		}
+	}
+	return names
+}
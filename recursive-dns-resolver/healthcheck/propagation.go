@@ -0,0 +1,132 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Answer is what one address of one nameserver has for a name
+type Answer struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Serial is the SOA serial of the zone on the server, which says which version of the zone the answer comes from
+	Serial  uint32   `json:"serial,omitempty"`
+	Rcode   string   `json:"rcode,omitempty"`
+	Records []string `json:"records,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// key is what answers are compared by
+func (a Answer) key() string {
+	if a.Error != "" {
+		return "error"
+	}
+	return a.Rcode + "\n" + strings.Join(a.Records, "\n")
+}
+
+// Propagation is what every authoritative server of a zone answers for one name and type
+type Propagation struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Zone    string   `json:"zone"`
+	Answers []Answer `json:"answers"`
+}
+
+// Agreed reports whether every server answered, and all with the same data
+func (p *Propagation) Agreed() bool {
+	for _, answer := range p.Answers {
+		if answer.key() != p.Answers[0].key() || answer.Error != "" {
+			return false
+		}
+	}
+	return len(p.Answers) > 0
+}
+
+// Variants groups the answers that agree with each other, the most common first
+func (p *Propagation) Variants() [][]Answer {
+	groups := make(map[string][]Answer)
+	var keys []string
+	for _, answer := range p.Answers {
+		key := answer.key()
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], answer)
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return len(groups[keys[i]]) > len(groups[keys[j]]) })
+	variants := make([][]Answer, len(keys))
+	for i, key := range keys {
+		variants[i] = groups[key]
+	}
+	return variants
+}
+
+// CheckPropagation finds the zone name belongs to with the iterative logic of res and asks
+// every address of every one of its nameservers for the records of qtype directly, over IPv4
+// and IPv6 alike unless res.Network restricts it
+func CheckPropagation(ctx context.Context, res *resolver.Resolver, name string, qtype uint16) (*Propagation, error) {
+	name = strings.ToLower(strings.Trim(name, "."))
+	delegation, err := res.FindZone(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("finding the zone of %s: %w", name, err)
+	}
+	network := res.Network
+	if network == "" {
+		network = "ip"
+	}
+	var targets []target
+	for _, ns := range lookupNameservers(ctx, res, delegation) {
+		targets = append(targets, ns.targets(network)...)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no nameserver of %s has an address usable with network %s", delegation.Zone, network)
+	}
+
+	p := &Propagation{Name: name, Type: query.TypeName(qtype), Zone: delegation.Zone, Answers: make([]Answer, len(targets))}
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Answers[i] = askServer(ctx, res.Timeout, delegation.Zone, name, qtype, t)
+		}()
+	}
+	wg.Wait()
+	return p, nil
+}
+
+// askServer asks one address of a nameserver for name, and for the serial of the zone
+func askServer(ctx context.Context, timeout time.Duration, zone string, name string, qtype uint16, t target) Answer {
+	answer := Answer{Name: t.name, Address: t.address}
+	response, _, err := probe(ctx, timeout, "udp", t.address, name, qtype, true)
+	if err == nil && response.Header.Flags&query.FLAG_TC != 0 {
+		response, _, err = probe(ctx, timeout, "tcp", t.address, name, qtype, true)
+	}
+	if err != nil {
+		answer.Error = err.Error()
+		return answer
+	}
+	if response.Header.Flags&query.FLAG_AA == 0 {
+		answer.Error = "not authoritative for " + zone
+		return answer
+	}
+	answer.Rcode = query.RcodeName(query.GetRcode(*response))
+	for _, record := range response.Answers {
+		record.Name = []byte(strings.ToLower(string(record.Name)))
+		answer.Records = append(answer.Records, query.FormatRecord(record))
+	}
+	sort.Strings(answer.Records)
+
+	if response, _, err := probe(ctx, timeout, "udp", t.address, zone, query.TYPE_SOA, true); err == nil {
+		if soa, ok := answerSOA(response, zone); ok {
+			answer.Serial = soa.Serial
+		}
+	}
+	return answer
+}
@@ -0,0 +1,145 @@
+// Package dnstest runs fake nameservers on the loopback for the tests of the other packages
+package dnstest
+
+import (
+	"net"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/socket"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Handler answers a request that came in over network, "udp" or "tcp", with the messages to
+// send back. Over UDP only the first one is sent; over TCP they all are, one after the other,
+// the way a zone transfer arrives. Nil messages are left out, so returning none or only nil
+// leaves the request unanswered.
+type Handler func(network string, request []byte) [][]byte
+
+// Server is a fake nameserver listening on the same loopback port over UDP and TCP
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr     string
+	handler  Handler
+	mutex    sync.Mutex
+	networks []string
+}
+
+// Start starts a server that answers with handler. It stops when the test ends.
+func Start(tb testing.TB, handler Handler) *Server {
+	tb.Helper()
+	var udp net.PacketConn
+	var tcp net.Listener
+	// The TCP port the kernel gave UDP may be taken, so try a few
+	for attempt := 0; tcp == nil; attempt++ {
+		var err error
+		udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tcp, err = net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if attempt == 10 {
+				tb.Fatal(err)
+			}
+		}
+	}
+	s := &Server{Addr: udp.LocalAddr().String(), handler: handler}
+	tb.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, client, err := udp.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if responses := s.handle("udp", buffer[:n]); len(responses) > 0 {
+				udp.WriteTo(responses[0], client)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveTCP(conn)
+		}
+	}()
+	return s
+}
+
+// serveTCP answers the requests of one connection until the client closes it
+func (s *Server) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := socket.ReadTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		for _, response := range s.handle("tcp", request) {
+			if err := socket.WriteTCPMessage(conn, response); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handle(network string, request []byte) [][]byte {
+	s.mutex.Lock()
+	s.networks = append(s.networks, network)
+	s.mutex.Unlock()
+	var responses [][]byte
+	for _, response := range s.handler(network, request) {
+		if response != nil {
+			responses = append(responses, response)
+		}
+	}
+	return responses
+}
+
+// Networks returns the networks the requests so far came in on, in order and comma separated
+func (s *Server) Networks() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return strings.Join(s.networks, ",")
+}
+
+// Option changes every response of an Answer handler before it is sent
+type Option func(response *query.DNSPacket)
+
+// Authoritative sets the AA bit, as an authoritative server does. Without it responses only
+// have RA set, like those of a recursive resolver.
+func Authoritative(response *query.DNSPacket) {
+	response.Header.Flags |= query.FLAG_AA
+}
+
+// Answer returns a Handler that answers every question with what answer gives for its name,
+// in lower case, and type. Requests that do not parse or do not ask one question get nothing.
+func Answer(answer func(name string, qtype uint16) (rcode uint16, answers []query.DNSRecord, authorities []query.DNSRecord), options ...Option) Handler {
+	return func(network string, request []byte) [][]byte {
+		packet, err := query.ParseDNSResponse(request)
+		if err != nil || len(packet.Questions) != 1 {
+			return nil
+		}
+		question := packet.Questions[0]
+		rcode, answers, authorities := answer(strings.ToLower(string(question.Name)), question.Type)
+		response := query.BuildResponse(*packet, rcode, answers)
+		response.Authorities = authorities
+		for _, option := range options {
+			option(&response)
+		}
+		return [][]byte{query.PacketToBytes(response)}
+	}
+}
+
+// Record builds a record of class IN
+func Record(name string, qtype uint16, ttl uint32, data []byte) query.DNSRecord {
+	return query.DNSRecord{Name: []byte(name), Type: qtype, Class: query.CLASS_IN, TTL: ttl, Data: data}
+}
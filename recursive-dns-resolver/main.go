@@ -1,30 +1,54 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"math/rand"
+	"io/fs"
 	"os"
+	"recursive-dns-resolver/cache"
+	"recursive-dns-resolver/mdns"
 	"recursive-dns-resolver/query"
 	"recursive-dns-resolver/resolver"
+	"strings"
 )
 
 type RecordType uint16
 
 const (
-	TYPE_A     RecordType = 1
-	TYPE_NS    RecordType = 2
-	TYPE_CNAME RecordType = 5
-	TYPE_TXT   RecordType = 16
-	TYPE_AAAA  RecordType = 28
+	TYPE_A      RecordType = 1
+	TYPE_NS     RecordType = 2
+	TYPE_CNAME  RecordType = 5
+	TYPE_SOA    RecordType = 6
+	TYPE_PTR    RecordType = 12
+	TYPE_MX     RecordType = 15
+	TYPE_TXT    RecordType = 16
+	TYPE_AAAA   RecordType = 28
+	TYPE_SRV    RecordType = 33
+	TYPE_DS     RecordType = 43
+	TYPE_DNSKEY RecordType = 48
+	TYPE_SVCB   RecordType = 64
+	TYPE_HTTPS  RecordType = 65
+	TYPE_ANY    RecordType = 255
+	TYPE_CAA    RecordType = 257
 )
 
 var RecordTypes map[string]RecordType = map[string]RecordType{
-	"A":     TYPE_A,
-	"NS":    TYPE_NS,
-	"CNAME": TYPE_CNAME,
-	"TXT":   TYPE_TXT,
-	"AAAA":  TYPE_AAAA,
+	"A":      TYPE_A,
+	"NS":     TYPE_NS,
+	"CNAME":  TYPE_CNAME,
+	"SOA":    TYPE_SOA,
+	"PTR":    TYPE_PTR,
+	"MX":     TYPE_MX,
+	"TXT":    TYPE_TXT,
+	"AAAA":   TYPE_AAAA,
+	"SRV":    TYPE_SRV,
+	"DS":     TYPE_DS,
+	"DNSKEY": TYPE_DNSKEY,
+	"SVCB":   TYPE_SVCB,
+	"HTTPS":  TYPE_HTTPS,
+	"ANY":    TYPE_ANY,
+	"CAA":    TYPE_CAA,
 }
 
 func resolve(name string, t RecordType) string {
@@ -38,11 +62,12 @@ func resolve(name string, t RecordType) string {
 		IP, _ = resolver.ResolveQuery(name, uint16(query.TYPE_NS))
 	case 5:
 		IP, _ = resolver.ResolveQuery(name, uint16(query.TYPE_CNAME))
-	case 16:
-		IP := fmt.Sprintf("%d", rand.Intn(10000))
-		return IP
 	case 28:
 		IP, _ = resolver.ResolveQuery(name, uint16(query.TYPE_AAAA))
+	case TYPE_SOA, TYPE_PTR, TYPE_MX, TYPE_TXT, TYPE_SRV, TYPE_DS, TYPE_DNSKEY, TYPE_SVCB, TYPE_HTTPS, TYPE_ANY, TYPE_CAA:
+		// these types carry more than an address, so print every record decoded
+		records, _ := resolver.ResolveRecords(name, uint16(t))
+		IP = strings.Join(records, ",")
 	default:
 		IP = "Undefined or unsupported record type"
 
@@ -51,10 +76,49 @@ func resolve(name string, t RecordType) string {
 }
 
 func main() {
+	// a known subcommand replaces the usual list of names
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	// get all command line arguments
-	names := os.Args[1:]
 	t := flag.String("type", "A", "the record type to query for each name")
+	flag.StringVar(t, "t", "A", "shorthand for -type")
+	flag.BoolVar(&resolver.DefaultResolver.Minimise, "minimise", false, "only send each nameserver the labels it needs to see (RFC 9156)")
+	ipv4Only := flag.Bool("4", false, "only talk to nameservers over IPv4")
+	ipv6Only := flag.Bool("6", false, "only talk to nameservers over IPv6")
+	hostsFile := flag.String("hosts", "/etc/hosts", "hosts file to answer from before recursing, empty to skip it")
+	resolvConf := flag.String("resolv-conf", "/etc/resolv.conf", "file to take search domains and ndots from for short names, empty to skip it")
 	flag.Parse()
+	names := flag.Args()
+	if *ipv4Only {
+		resolver.DefaultResolver.Network = "ip4"
+	} else if *ipv6Only {
+		resolver.DefaultResolver.Network = "ip6"
+	}
+	resolver.DefaultResolver.Cache = cache.InitCache()
+	// Like a system stub resolver, names under .local go to the local link
+	resolver.DefaultResolver.MDNS = mdns.NewClient()
+	// Like a system stub resolver, carry on without the files when they do not exist
+	if *hostsFile != "" {
+		if hosts, err := resolver.LoadHosts(*hostsFile); err == nil {
+			resolver.DefaultResolver.Hosts = hosts
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Println("Error loading hosts file:", err)
+			os.Exit(1)
+		}
+	}
+	if *resolvConf != "" {
+		if search, ndots, err := resolver.ReadResolvConf(*resolvConf); err == nil {
+			resolver.DefaultResolver.Search, resolver.DefaultResolver.Ndots = search, ndots
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Println("Error reading resolv.conf:", err)
+			os.Exit(1)
+		}
+	}
 
 	// input validation
 	if len(names) == 0 {
@@ -62,7 +126,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if _, exists := RecordTypes[*t]; !exists {
+	if _, exists := RecordTypes[strings.ToUpper(*t)]; !exists {
 		keys := make([]string, 0, len(RecordTypes))
 		for k := range RecordTypes {
 			keys = append(keys, k)
@@ -73,7 +137,7 @@ func main() {
 
 	// invoke the resolve function for each of the given names
 	for _, name := range names {
-		fmt.Printf("%s,%s", name, resolve(name, RecordTypes[*t]))
+		fmt.Printf("%s,%s\n", name, resolve(name, RecordTypes[strings.ToUpper(*t)]))
 	}
 }
 
@@ -0,0 +1,219 @@
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+	"strings"
+	"time"
+)
+
+// Port is the UDP port mDNS responders listen on and answer from
+const Port = 5353
+
+// IPv4Group and IPv6Group are the link-local multicast addresses mDNS queries are sent to
+const (
+	IPv4Group = "224.0.0.251:5353"
+	IPv6Group = "[ff02::fb]:5353"
+)
+
+// IsLocal reports whether name belongs to mDNS rather than the global DNS: names under .local
+// and the reverse names of link-local addresses (RFC 6762 sections 3 and 12)
+func IsLocal(name string) bool {
+	name = strings.ToLower(strings.Trim(name, "."))
+	for _, zone := range []string{"local", "254.169.in-addr.arpa", "8.e.f.ip6.arpa", "9.e.f.ip6.arpa", "a.e.f.ip6.arpa", "b.e.f.ip6.arpa"} {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client sends one-shot mDNS queries (RFC 6762 section 5.1). They come from an ephemeral port,
+// so responders answer the querier directly, and the first response with an answer is used.
+type Client struct {
+	// Interface is the network interface queries are sent on. Nil lets the system choose.
+	Interface *net.Interface
+	// Groups are the addresses queries are sent to, IPv4Group and IPv6Group unless changed
+	Groups []string
+	// Timeout bounds how long a query waits for a response
+	Timeout time.Duration
+	// UnicastResponse sets the QU bit of the question, which asks responders that also
+	// listen on the group to answer by unicast rather than to the whole link
+	UnicastResponse bool
+}
+
+// NewClient creates a Client that queries both groups on the default interface
+func NewClient() *Client {
+	return &Client{
+		Groups:          []string{IPv4Group, IPv6Group},
+		Timeout:         time.Second,
+		UnicastResponse: true,
+	}
+}
+
+// Query asks the link for the records of type qtype of name and returns those of the first
+// response that has any, with the CNAMEs that lead to them. A name nobody on the link answers
+// for returns no records and no error once Timeout passes.
+func (c *Client) Query(ctx context.Context, name string, qtype uint16) ([]Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	message := buildQuery(strings.Trim(name, "."), qtype, c.UnicastResponse)
+
+	type reply struct {
+		records []Record
+		err     error
+	}
+	replies := make(chan reply, len(c.Groups))
+	for _, group := range c.Groups {
+		go func() {
+			records, err := c.exchange(ctx, group, message, name, qtype)
+			replies <- reply{records, err}
+		}()
+	}
+	var errs []error
+	for range c.Groups {
+		rep := <-replies
+		if rep.err != nil {
+			errs = append(errs, rep.err)
+			continue
+		}
+		if len(rep.records) > 0 {
+			return rep.records, nil
+		}
+	}
+	// Silence is the answer for a name nobody has, only a failure to send on every group is an error
+	if len(errs) == len(c.Groups) && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, nil
+}
+
+// exchange sends the query to one group and waits for a response that answers it
+func (c *Client) exchange(ctx context.Context, group string, message []byte, name string, qtype uint16) ([]Record, error) {
+	groupAddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	network, local := "udp4", &net.UDPAddr{}
+	if groupAddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	if c.Interface != nil {
+		if network == "udp6" {
+			groupAddr.Zone = c.Interface.Name
+		} else if local.IP, err = interfaceIPv4(c.Interface); err != nil {
+			return nil, err
+		}
+	}
+	// Binding to an address of the interface makes the kernel send IPv4 multicast out of it
+	conn, err := net.ListenUDP(network, local)
+	if err != nil {
+		return nil, fmt.Errorf("opening mDNS socket: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.WriteToUDP(message, groupAddr); err != nil {
+		return nil, fmt.Errorf("sending mDNS query to %s: %w", group, err)
+	}
+
+	id := binary.BigEndian.Uint16(message[0:2])
+	buffer := make([]byte, 9000) // mDNS messages may fill a jumbo frame (RFC 6762 section 17)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		response, err := ParseMessage(buffer[:n])
+		if err != nil || !acceptable(response, from, id) {
+			continue
+		}
+		if records := answers(response, name, qtype); len(records) > 0 {
+			return records, nil
+		}
+	}
+}
+
+// acceptable applies the checks of RFC 6762 section 6 and 11 to a message: it must be a
+// response with rcode 0 that comes from port 5353 on the local link. Responses to one-shot
+// queries echo our ID, multicast ones carry ID 0.
+func acceptable(response *Message, from *net.UDPAddr, id uint16) bool {
+	flags := response.Header.Flags
+	if opcode := (flags >> 11) & 0xF; flags&query.FLAG_QR == 0 || opcode != 0 || flags&0x000F != 0 {
+		return false
+	}
+	if from.Port != Port || (response.Header.ID != id && response.Header.ID != 0) {
+		return false
+	}
+	return onLink(from.IP)
+}
+
+// onLink reports whether ip is link-local or on the network of one of our interfaces, the only
+// places an mDNS response may come from
+func onLink(ip net.IP) bool {
+	if ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// answers returns the records of a response that answer name and qtype, directly or through a
+// CNAME. Responders often put the answer itself in the additional section of a response to
+// another question, so both sections count.
+func answers(response *Message, name string, qtype uint16) []Record {
+	owners := map[string]bool{strings.ToLower(strings.Trim(name, ".")): true}
+	records := append(append([]Record(nil), response.Answers...), response.Additionals...)
+	taken := make([]bool, len(records))
+	var matched []Record
+	// A CNAME may come after the records of its target, so keep going until nothing new matches
+	for found := true; found; {
+		found = false
+		for i, record := range records {
+			if taken[i] || !owners[strings.ToLower(string(record.Name))] {
+				continue
+			}
+			switch {
+			case record.Type == qtype || qtype == query.TYPE_ANY:
+			case record.Type == query.TYPE_CNAME:
+				owners[strings.ToLower(query.DecodeNSName(record.Data))] = true
+			default:
+				continue
+			}
+			matched = append(matched, record)
+			taken[i], found = true, true
+		}
+	}
+	return matched
+}
+
+// interfaceIPv4 returns the first IPv4 address of an interface
+func interfaceIPv4(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.To4() != nil {
+			return network.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", iface.Name)
+}
@@ -0,0 +1,120 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"recursive-dns-resolver/query"
+	"testing"
+	"time"
+)
+
+// responder answers the mDNS queries it receives on conn with the records answer returns for
+// the question, sent straight back to the querier from port 5353
+func responder(t *testing.T, conn *net.UDPConn, answer func(question Question) []query.DNSRecord) {
+	t.Helper()
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			request, err := ParseMessage(buffer[:n])
+			if err != nil || len(request.Questions) != 1 || !request.Questions[0].UnicastResponse {
+				continue
+			}
+			response := query.DNSPacket{
+				Header:  query.DNSHeader{ID: request.Header.ID, Flags: query.FLAG_QR | query.FLAG_AA},
+				Answers: answer(request.Questions[0]),
+			}
+			conn.WriteToUDP(query.PacketToBytes(response), from)
+		}
+	}()
+}
+
+func TestClientQueryLoopbackMulticast(t *testing.T) {
+	loopback := loopbackInterface(t)
+	group, _ := net.ResolveUDPAddr("udp4", IPv4Group)
+	conn, err := net.ListenMulticastUDP("udp4", loopback, group)
+	if err != nil {
+		t.Skipf("cannot join %s on %s: %v", IPv4Group, loopback.Name, err)
+	}
+	responder(t, conn, func(question Question) []query.DNSRecord {
+		if string(question.Name) != "printer.local" || question.Type != query.TYPE_A {
+			return nil
+		}
+		return []query.DNSRecord{{Name: []byte("printer.local"), Type: query.TYPE_A, Class: query.CLASS_IN | classCacheFlush, TTL: 120, Data: []byte{127, 0, 0, 7}}}
+	})
+
+	client := NewClient()
+	client.Interface = loopback
+	client.Groups = []string{IPv4Group}
+	client.Timeout = 2 * time.Second
+	records, err := client.Query(context.Background(), "printer.local.", query.TYPE_A)
+	if err != nil {
+		t.Skipf("multicast does not work on %s here: %v", loopback.Name, err)
+	}
+	if len(records) != 1 || net.IP(records[0].Data).String() != "127.0.0.7" || !records[0].CacheFlush || records[0].Class != query.CLASS_IN {
+		t.Fatalf("Query returned %+v", records)
+	}
+
+	// Nobody answering is not an error, the name just has no records
+	client.Timeout = 200 * time.Millisecond
+	records, err = client.Query(context.Background(), "scanner.local", query.TYPE_A)
+	if err != nil || len(records) != 0 {
+		t.Errorf("Query for a name nobody has returned %v, %v", records, err)
+	}
+}
+
+func loopbackInterface(t *testing.T) *net.Interface {
+	t.Helper()
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return &iface
+		}
+	}
+	t.Skip("no loopback interface")
+	return nil
+}
+
+func TestAnswersFollowCNAME(t *testing.T) {
+	record := func(name string, qtype uint16, data []byte) Record {
+		return Record{DNSRecord: query.DNSRecord{Name: []byte(name), Type: qtype, Class: query.CLASS_IN, TTL: 120, Data: data}}
+	}
+	response := &Message{
+		// The target's address comes before the CNAME that leads to it, and in another section
+		Answers: []Record{
+			record("other.local", query.TYPE_A, []byte{192, 168, 1, 9}),
+			record("Printer.local", query.TYPE_CNAME, query.EncodeName("office-printer.local")),
+			record("printer.local", query.TYPE_TXT, []byte{0}),
+		},
+		Additionals: []Record{
+			record("office-printer.local", query.TYPE_A, []byte{192, 168, 1, 7}),
+			record("office-printer.local", query.TYPE_AAAA, make([]byte, 16)),
+		},
+	}
+	var got []string
+	for _, r := range answers(response, "printer.local.", query.TYPE_A) {
+		got = append(got, query.FormatRecord(r.DNSRecord))
+	}
+	if len(got) != 2 || got[0] != query.FormatRecord(response.Answers[1].DNSRecord) || got[1] != query.FormatRecord(response.Additionals[0].DNSRecord) {
+		t.Errorf("answers = %q, want the CNAME and the A record of its target", got)
+	}
+
+	if records := answers(response, "scanner.local", query.TYPE_A); len(records) != 0 {
+		t.Errorf("answers for a name the response does not have = %+v", records)
+	}
+	// A CNAME loop ends once every record is taken
+	loop := &Message{Answers: []Record{
+		record("a.local", query.TYPE_CNAME, query.EncodeName("b.local")),
+		record("b.local", query.TYPE_CNAME, query.EncodeName("a.local")),
+	}}
+	if records := answers(loop, "a.local", query.TYPE_A); len(records) != 2 {
+		t.Errorf("answers for a CNAME loop = %+v", records)
+	}
+}
@@ -0,0 +1,124 @@
+package mdns
+
+import (
+	"fmt"
+	"math/rand"
+	"recursive-dns-resolver/query"
+)
+
+// mDNS reuses the top bit of the class field (RFC 6762 sections 5.4 and 10.2). In a question it
+// asks for a unicast response, in a record it tells caches to replace what they hold for the
+// name and type instead of adding to it.
+const (
+	classUnicastResponse uint16 = 0x8000
+	classCacheFlush      uint16 = 0x8000
+)
+
+// Question is a question of an mDNS message with the unicast-response bit split off its class
+type Question struct {
+	query.DNSQuestion
+	UnicastResponse bool
+}
+
+// Record is a record of an mDNS message with the cache-flush bit split off its class
+type Record struct {
+	query.DNSRecord
+	CacheFlush bool
+}
+
+// Message is a parsed mDNS message. The authority section only matters to probing hosts and
+// is not kept.
+type Message struct {
+	Header      query.DNSHeader
+	Questions   []Question
+	Answers     []Record
+	Additionals []Record
+}
+
+// ParseMessage parses an mDNS message. Names are dotted like query.ParseDNSResponse returns
+// them, and classes are returned without their top bit, so records compare equal to unicast ones.
+func ParseMessage(buffer []byte) (*Message, error) {
+	var m query.Message
+	if err := m.Reset(buffer); err != nil {
+		return nil, err
+	}
+	message := &Message{Header: m.Header}
+	for {
+		question, ok, err := m.NextQuestion()
+		if err != nil {
+			return nil, fmt.Errorf("parsing question: %w", err)
+		}
+		if !ok {
+			break
+		}
+		name, err := m.AppendName(nil, question.Name)
+		if err != nil {
+			return nil, fmt.Errorf("parsing question: %w", err)
+		}
+		message.Questions = append(message.Questions, Question{
+			DNSQuestion: query.DNSQuestion{
+				Name:  name,
+				Type:  question.Type,
+				Class: question.Class &^ classUnicastResponse,
+			},
+			UnicastResponse: question.Class&classUnicastResponse != 0,
+		})
+	}
+	for {
+		record, ok, err := m.NextRecord()
+		if err != nil {
+			return nil, fmt.Errorf("parsing record: %w", err)
+		}
+		if !ok {
+			return message, nil
+		}
+		if record.Section == query.SectionAuthority {
+			continue
+		}
+		name, err := m.AppendName(nil, record.Name)
+		if err != nil {
+			return nil, fmt.Errorf("parsing record: %w", err)
+		}
+		data, err := m.AppendRecordData(nil, record)
+		if err != nil {
+			return nil, fmt.Errorf("parsing record data: %w", err)
+		}
+		parsed := Record{
+			DNSRecord: query.DNSRecord{
+				Name:  name,
+				Type:  record.Type,
+				Class: record.Class,
+				TTL:   record.TTL,
+				Data:  data,
+			},
+		}
+		// The OPT record keeps the whole class, it holds the UDP payload size there
+		if record.Type != query.TYPE_OPT {
+			parsed.Class = record.Class &^ classCacheFlush
+			parsed.CacheFlush = record.Class&classCacheFlush != 0
+		}
+		if record.Section == query.SectionAnswer {
+			message.Answers = append(message.Answers, parsed)
+		} else {
+			message.Additionals = append(message.Additionals, parsed)
+		}
+	}
+}
+
+// buildQuery builds a one-shot query for name. Unlike a unicast query it does not ask for
+// recursion, and unicastResponse sets the QU bit. The ID is random, as a one-shot query is
+// answered like a unicast one and its response matched by ID (RFC 6762 section 6.7).
+func buildQuery(name string, qtype uint16, unicastResponse bool) []byte {
+	class := query.CLASS_IN
+	if unicastResponse {
+		class |= classUnicastResponse
+	}
+	return query.PacketToBytes(query.DNSPacket{
+		Header: query.DNSHeader{ID: uint16(rand.Intn(65536))},
+		Questions: []query.DNSQuestion{{
+			Name:  []byte(name),
+			Type:  qtype,
+			Class: class,
+		}},
+	})
+}
@@ -0,0 +1,78 @@
+package mdns
+
+import (
+	"bytes"
+	"recursive-dns-resolver/query"
+	"testing"
+)
+
+func TestParseMessageClassBits(t *testing.T) {
+	packet := query.PacketToBytes(query.DNSPacket{
+		Header: query.DNSHeader{Flags: query.FLAG_QR | query.FLAG_AA},
+		Questions: []query.DNSQuestion{
+			{Name: []byte("printer.local"), Type: query.TYPE_A, Class: query.CLASS_IN | classUnicastResponse},
+			{Name: []byte("scanner.local"), Type: query.TYPE_A, Class: query.CLASS_IN},
+		},
+		Answers: []query.DNSRecord{
+			{Name: []byte("printer.local"), Type: query.TYPE_A, Class: query.CLASS_IN | classCacheFlush, TTL: 120, Data: []byte{192, 168, 1, 7}},
+			{Name: []byte("_ipp._tcp.local"), Type: query.TYPE_PTR, Class: query.CLASS_IN, TTL: 4500, Data: query.EncodeName("printer._ipp._tcp.local")},
+		},
+		Authorities: []query.DNSRecord{
+			{Name: []byte("printer.local"), Type: query.TYPE_A, Class: query.CLASS_IN, TTL: 120, Data: []byte{192, 168, 1, 8}},
+		},
+		Additionals: []query.DNSRecord{
+			{Name: []byte("printer.local"), Type: query.TYPE_AAAA, Class: query.CLASS_IN | classCacheFlush, TTL: 120, Data: make([]byte, 16)},
+			query.NewOPT(1440),
+		},
+	})
+	message, err := ParseMessage(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(message.Questions) != 2 {
+		t.Fatalf("parsed %d questions", len(message.Questions))
+	}
+	for i, unicast := range []bool{true, false} {
+		question := message.Questions[i]
+		if question.UnicastResponse != unicast || question.Class != query.CLASS_IN {
+			t.Errorf("question %s: QU %v class %d, want QU %v class IN", question.Name, question.UnicastResponse, question.Class, unicast)
+		}
+	}
+
+	if len(message.Answers) != 2 || len(message.Additionals) != 2 {
+		t.Fatalf("parsed %d answers and %d additionals, the authority section must be left out", len(message.Answers), len(message.Additionals))
+	}
+	for i, flush := range []bool{true, false} {
+		record := message.Answers[i]
+		if record.CacheFlush != flush || record.Class != query.CLASS_IN {
+			t.Errorf("answer %s: cache-flush %v class %d, want cache-flush %v class IN", record.Name, record.CacheFlush, record.Class, flush)
+		}
+	}
+	if ptr := message.Answers[1]; query.DecodeNSName(ptr.Data) != "printer._ipp._tcp.local" {
+		t.Errorf("PTR data decodes as %q", query.DecodeNSName(ptr.Data))
+	}
+	if aaaa := message.Additionals[0]; !aaaa.CacheFlush || aaaa.Class != query.CLASS_IN {
+		t.Errorf("additional AAAA: cache-flush %v class %d", aaaa.CacheFlush, aaaa.Class)
+	}
+	// The class of an OPT record is the UDP payload size and is kept whole
+	if opt := message.Additionals[1]; opt.Type != query.TYPE_OPT || opt.Class != 1440 || opt.CacheFlush {
+		t.Errorf("OPT record parsed as %+v", opt)
+	}
+}
+
+func TestBuildQueryUnicastResponse(t *testing.T) {
+	for _, unicast := range []bool{true, false} {
+		message, err := ParseMessage(buildQuery("printer.local", query.TYPE_A, unicast))
+		if err != nil {
+			t.Fatal(err)
+		}
+		question := message.Questions[0]
+		if question.UnicastResponse != unicast || question.Class != query.CLASS_IN || !bytes.Equal(question.Name, []byte("printer.local")) {
+			t.Errorf("query with QU %v parsed as %+v", unicast, question)
+		}
+		if message.Header.Flags&query.FLAG_RD != 0 {
+			t.Error("mDNS query asks for recursion")
+		}
+	}
+}
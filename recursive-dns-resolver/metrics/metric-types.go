@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// CounterVec is a counter with one series per combination of label values
+type CounterVec struct {
+	desc
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates a counter and registers it with the DefaultRegistry
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name, help, labelNames}, values: make(map[string]float64)}
+	DefaultRegistry.Register(c)
+	return c
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.labelKey(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.formatLabels(key), formatValue(c.values[key]))
+	}
+}
+
+// GaugeVec is a value that can go up and down, with one series per combination of label values
+type GaugeVec struct {
+	desc
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewGaugeVec creates a gauge and registers it with the DefaultRegistry
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{desc: desc{name, help, labelNames}, values: make(map[string]float64)}
+	DefaultRegistry.Register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	key := g.labelKey(labelValues)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[key] = v
+}
+
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	key := g.labelKey(labelValues)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[key] += v
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *GaugeVec) Write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.writeHeader(w, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.formatLabels(key), formatValue(g.values[key]))
+	}
+}
+
+// FuncMetric reads its single value from a function every time it is scraped, which suits
+// numbers that are already tracked elsewhere such as the size of the cache
+type FuncMetric struct {
+	desc
+	kind  string
+	value func() float64
+}
+
+// NewGaugeFunc creates a gauge backed by a function and registers it with the DefaultRegistry
+func NewGaugeFunc(name, help string, value func() float64) *FuncMetric {
+	f := &FuncMetric{desc: desc{name: name, help: help}, kind: "gauge", value: value}
+	DefaultRegistry.Register(f)
+	return f
+}
+
+// NewCounterFunc creates a counter backed by a function and registers it with the DefaultRegistry
+func NewCounterFunc(name, help string, value func() float64) *FuncMetric {
+	f := &FuncMetric{desc: desc{name: name, help: help}, kind: "counter", value: value}
+	DefaultRegistry.Register(f)
+	return f
+}
+
+func (f *FuncMetric) Write(w io.Writer) {
+	f.writeHeader(w, f.kind)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatValue(f.value()))
+}
+
+// DefaultBuckets suit DNS latencies, from a cache hit to a slow upstream
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// HistogramVec counts observations into cumulative buckets, with one series per combination of label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, plus +Inf at the end
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates a histogram and registers it with the DefaultRegistry.
+// Nil buckets means DefaultBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{desc: desc{name, help, labelNames}, buckets: buckets, series: make(map[string]*histogram)}
+	DefaultRegistry.Register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.labelKey(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			series.counts[i]++
+		}
+	}
+	series.counts[len(h.buckets)]++
+	series.sum += v
+	series.count++
+}
+
+func (h *HistogramVec) Write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		for i := range series.counts {
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", formatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(key), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(key), series.count)
+	}
+}
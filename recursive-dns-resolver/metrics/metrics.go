@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Collector is anything that can write itself in the Prometheus text exposition format
+type Collector interface {
+	Name() string
+	Write(w io.Writer)
+}
+
+// Registry holds the collectors exposed on /metrics
+type Registry struct {
+	mutex      sync.Mutex
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+// DefaultRegistry is the registry the New* constructors below register with
+var DefaultRegistry = NewRegistry()
+
+// Register adds a collector, replacing any earlier one with the same name
+func (registry *Registry) Register(c Collector) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.collectors[c.Name()] = c
+}
+
+// WriteText writes every collector sorted by name
+func (registry *Registry) WriteText(w io.Writer) {
+	// Take the collectors out under the lock, a concurrent Register writes to the map
+	registry.mutex.Lock()
+	collectors := make([]Collector, 0, len(registry.collectors))
+	for _, c := range registry.collectors {
+		collectors = append(collectors, c)
+	}
+	registry.mutex.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].Name() < collectors[j].Name() })
+	for _, c := range collectors {
+		c.Write(w)
+	}
+}
+
+// Handler serves the registry in the text exposition format
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.WriteText(w)
+	})
+}
+
+// Handler serves the DefaultRegistry
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// desc is the part every metric shares: its name, help text and label names
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+// labelKey joins label values into a map key. The values must match the label names.
+func (d *desc) labelKey(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", d.name, len(d.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// formatLabels renders {a="x",b="y"}, with extra appended after the metric's own labels
+func (d *desc) formatLabels(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labelNames) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", d.labelNames[i], strconv.Quote(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a map of series in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
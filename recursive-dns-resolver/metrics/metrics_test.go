@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriteTextSorted(t *testing.T) {
+	registry := NewRegistry()
+	for _, name := range []string{"b_total", "a_total", "c_total"} {
+		registry.Register(&CounterVec{desc: desc{name: name, help: name}, values: map[string]float64{"": 1}})
+	}
+	var out strings.Builder
+	registry.WriteText(&out)
+	a, b, c := strings.Index(out.String(), "a_total 1"), strings.Index(out.String(), "b_total 1"), strings.Index(out.String(), "c_total 1")
+	if a < 0 || !(a < b && b < c) {
+		t.Errorf("collectors are not written in name order:\n%s", out.String())
+	}
+}
+
+// Run with -race: a scrape must not read the collectors while another goroutine registers one
+func TestWriteTextConcurrentRegister(t *testing.T) {
+	registry := NewRegistry()
+	for i := 0; i < 100; i++ {
+		registry.Register(&CounterVec{desc: desc{name: fmt.Sprintf("m%d_total", i)}, values: map[string]float64{"": 1}})
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 100; i < 200; i++ {
+			registry.Register(&CounterVec{desc: desc{name: fmt.Sprintf("m%d_total", i)}, values: map[string]float64{}})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		registry.WriteText(io.Discard)
+	}
+	<-done
+}
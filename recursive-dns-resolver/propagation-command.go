@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"recursive-dns-resolver/healthcheck"
+	"recursive-dns-resolver/resolver"
+	"slices"
+	"strings"
+	"time"
+)
+
+// propagationCommand asks every authoritative server of a name for its records and shows
+// where they differ, optionally asking again until they all agree
+func propagationCommand(args []string) {
+	flags := flag.NewFlagSet("propagation", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: propagation [flags] <name> [type]")
+		flags.PrintDefaults()
+	}
+	watch := flags.Bool("watch", false, "keep asking until every server has the same answer or -timeout passes")
+	interval := flags.Duration("interval", 10*time.Second, "how long to wait between rounds with -watch")
+	timeout := flags.Duration("timeout", 10*time.Minute, "how long to keep watching")
+	asJSON := flags.Bool("json", false, "print the answers as JSON")
+	network := flags.String("network", "ip", "nameserver address families to ask: ip, ip4 or ip6")
+	roots := flags.String("roots", "", "comma separated root servers to start from instead of the built in ones")
+
+	positional := parseInterspersed(flags, args)
+	if len(positional) == 0 || len(positional) > 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	qtype := TYPE_A
+	if len(positional) == 2 {
+		var ok bool
+		if qtype, ok = RecordTypes[strings.ToUpper(positional[1])]; !ok {
+			fmt.Printf("Unknown record type %s\n", positional[1])
+			os.Exit(1)
+		}
+	}
+
+	r := resolver.New(resolver.WithNetwork(*network))
+	if *roots != "" {
+		r.Roots = strings.Split(*roots, ",")
+	}
+	deadline := time.Now().Add(*timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), r.ResolutionTimeout+r.Timeout)
+		p, err := healthcheck.CheckPropagation(ctx, r, positional[0], uint16(qtype))
+		cancel()
+		if err != nil {
+			fmt.Println("Error checking propagation:", err)
+			os.Exit(1)
+		}
+
+		last := !*watch || p.Agreed() || time.Now().Add(*interval).After(deadline)
+		if !last {
+			fmt.Printf("%s  %d of %d servers have the most common answer\n",
+				time.Now().Format(time.TimeOnly), len(p.Variants()[0]), len(p.Answers))
+			time.Sleep(*interval)
+			continue
+		}
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(p)
+		} else {
+			printPropagation(p)
+		}
+		if !p.Agreed() {
+			os.Exit(1)
+		}
+		return
+	}
+}
+
+// printPropagation prints each distinct answer with the servers that gave it. Answers after
+// the first are shown as a diff against the first, which is the most common one.
+func printPropagation(p *healthcheck.Propagation) {
+	variants := p.Variants()
+	fmt.Printf("%s %s in zone %s, asked %d server addresses\n", p.Name, p.Type, p.Zone, len(p.Answers))
+	if p.Agreed() {
+		fmt.Println("All servers agree")
+	} else {
+		fmt.Printf("Servers disagree, %d different answers\n", len(variants))
+	}
+
+	common := variants[0][0]
+	for i, variant := range variants {
+		fmt.Println()
+		for _, answer := range variant {
+			serial := ""
+			if answer.Serial != 0 {
+				serial = fmt.Sprintf(" serial %d", answer.Serial)
+			}
+			fmt.Printf("; %s %s%s\n", answer.Name, answer.Address, serial)
+		}
+		answer := variant[0]
+		switch {
+		case answer.Error != "":
+			for _, failed := range variant {
+				fmt.Printf("error from %s: %s\n", failed.Address, failed.Error)
+			}
+		case i == 0 || common.Error != "":
+			printAnswer(answer)
+		default:
+			if answer.Rcode != common.Rcode {
+				fmt.Printf("- rcode %s\n+ rcode %s\n", common.Rcode, answer.Rcode)
+			}
+			for _, record := range common.Records {
+				if !slices.Contains(answer.Records, record) {
+					fmt.Println("-", record)
+				}
+			}
+			for _, record := range answer.Records {
+				if !slices.Contains(common.Records, record) {
+					fmt.Println("+", record)
+				}
+			}
+		}
+	}
+}
+
+func printAnswer(answer healthcheck.Answer) {
+	fmt.Printf("  rcode %s\n", answer.Rcode)
+	for _, record := range answer.Records {
+		fmt.Println(" ", record)
+	}
+}
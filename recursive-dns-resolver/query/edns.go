@@ -0,0 +1,187 @@
+package query
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// EDNS(0) from RFC 6891. The OPT pseudo-record lives in the additional section, its class
+// holds the largest UDP payload the sender can receive and its TTL the extended flags.
+
+// DefaultUDPSize is the payload size we advertise and accept over UDP
+const DefaultUDPSize uint16 = 1232
+
+// GetOPT returns the OPT record of a packet, or nil if the sender did not use EDNS
+func GetOPT(packet DNSPacket) *DNSRecord {
+	for i, record := range packet.Additionals {
+		if record.Type == TYPE_OPT {
+			return &packet.Additionals[i]
+		}
+	}
+	return nil
+}
+
+// NewOPT creates an OPT record advertising udpSize and carrying options
+func NewOPT(udpSize uint16, options ...EDNSOption) DNSRecord {
+	var data []byte
+	for _, option := range options {
+		data = binary.BigEndian.AppendUint16(data, option.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(option.Data)))
+		data = append(data, option.Data...)
+	}
+	return DNSRecord{
+		Name:  []byte(""),
+		Type:  TYPE_OPT,
+		Class: udpSize,
+		Data:  data,
+	}
+}
+
+// AppendOPT adds an OPT record to the additional section of an encoded message, e.g. one
+// built by BuildQuery
+func AppendOPT(message []byte, opt DNSRecord) []byte {
+	message = append(message, recordToBytes(opt)...)
+	binary.BigEndian.PutUint16(message[10:12], binary.BigEndian.Uint16(message[10:12])+1)
+	return message
+}
+
+// MaxUDPSize returns how large a UDP response to packet may be: what its OPT record
+// advertises, or the classic 512 bytes without EDNS
+func MaxUDPSize(packet DNSPacket) int {
+	opt := GetOPT(packet)
+	if opt == nil || opt.Class < 512 {
+		return 512
+	}
+	return int(opt.Class)
+}
+
+// EDNS option codes
+const (
+	OPTION_ECS    uint16 = 8  // client subnet, RFC 7871
+	OPTION_COOKIE uint16 = 10 // DNS cookies, RFC 7873
+)
+
+// RCODE_BADCOOKIE is an extended response code, so it only fits in a header together with an OPT record
+const RCODE_BADCOOKIE uint16 = 23
+
+// EDNSOption is one option of an OPT record
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// Options decodes the options carried in the data of an OPT record
+func Options(opt DNSRecord) ([]EDNSOption, error) {
+	var options []EDNSOption
+	for data := opt.Data; len(data) > 0; {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("EDNS option header runs past the end of the OPT record")
+		}
+		code, length := binary.BigEndian.Uint16(data[0:2]), int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			return nil, fmt.Errorf("EDNS option %d runs past the end of the OPT record", code)
+		}
+		options = append(options, EDNSOption{Code: code, Data: data[4 : 4+length]})
+		data = data[4+length:]
+	}
+	return options, nil
+}
+
+// GetOption returns the data of the first option with code in the OPT record of packet
+func GetOption(packet DNSPacket, code uint16) ([]byte, bool) {
+	opt := GetOPT(packet)
+	if opt == nil {
+		return nil, false
+	}
+	options, err := Options(*opt)
+	if err != nil {
+		return nil, false
+	}
+	for _, option := range options {
+		if option.Code == code {
+			return option.Data, true
+		}
+	}
+	return nil, false
+}
+
+// ExtendedRcode returns the whole response code of packet: the four bits in the header
+// extended by the eight bits at the top of the OPT record's TTL
+func ExtendedRcode(packet DNSPacket) uint16 {
+	rcode := GetRcode(packet)
+	if opt := GetOPT(packet); opt != nil {
+		rcode |= uint16(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// ClientSubnet is the data of an ECS option: the network a query is asked on behalf of, and
+// in a response the part of it the answer is valid for
+type ClientSubnet struct {
+	IP           net.IP
+	SourcePrefix uint8
+	ScopePrefix  uint8
+}
+
+// NewClientSubnet returns the ECS data for the prefix bits long network of ip
+func NewClientSubnet(ip net.IP, prefix int) ClientSubnet {
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	prefix = min(prefix, bits)
+	return ClientSubnet{IP: ip.Mask(net.CIDRMask(prefix, bits)), SourcePrefix: uint8(prefix)}
+}
+
+// Network returns the network the prefix of the given length covers, e.g. the scope of an answer
+func (cs ClientSubnet) Network(prefix uint8) *net.IPNet {
+	bits := 8 * len(cs.IP)
+	mask := net.CIDRMask(min(int(prefix), bits), bits)
+	return &net.IPNet{IP: cs.IP.Mask(mask), Mask: mask}
+}
+
+// EncodeClientSubnet builds ECS option data. Only the bytes the source prefix covers are sent.
+func EncodeClientSubnet(cs ClientSubnet) []byte {
+	family := uint16(2)
+	ip := cs.IP.To16()
+	if ip4 := cs.IP.To4(); ip4 != nil {
+		family, ip = 1, ip4
+	}
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, cs.SourcePrefix, cs.ScopePrefix)
+	return append(data, ip[:(int(cs.SourcePrefix)+7)/8]...)
+}
+
+// DecodeClientSubnet decodes ECS option data
+func DecodeClientSubnet(data []byte) (ClientSubnet, error) {
+	if len(data) < 4 {
+		return ClientSubnet{}, fmt.Errorf("ECS data too short")
+	}
+	var size int
+	switch family := binary.BigEndian.Uint16(data[0:2]); family {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return ClientSubnet{}, fmt.Errorf("unknown ECS address family %d", family)
+	}
+	cs := ClientSubnet{SourcePrefix: data[2], ScopePrefix: data[3]}
+	address := data[4:]
+	if int(cs.SourcePrefix) > 8*size || int(cs.ScopePrefix) > 8*size || len(address) != (int(cs.SourcePrefix)+7)/8 {
+		return ClientSubnet{}, fmt.Errorf("ECS prefix lengths do not match the address")
+	}
+	cs.IP = make(net.IP, size)
+	copy(cs.IP, address)
+	return cs, nil
+}
+
+// DecodeCookie splits COOKIE option data into the eight byte client cookie and the server
+// cookie, which is empty until the server has sent one and 8 to 32 bytes after that
+func DecodeCookie(data []byte) (client []byte, server []byte, err error) {
+	if len(data) != 8 && (len(data) < 16 || len(data) > 40) {
+		return nil, nil, fmt.Errorf("cookie of %d bytes has an invalid length", len(data))
+	}
+	return data[:8], data[8:], nil
+}
@@ -0,0 +1,66 @@
+package query
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestClientSubnetRoundTrip(t *testing.T) {
+	tests := []struct {
+		ip     string
+		prefix int
+		data   []byte
+	}{
+		{"192.0.2.77", 24, []byte{0, 1, 24, 0, 192, 0, 2}},
+		{"192.0.2.77", 20, []byte{0, 1, 20, 0, 192, 0, 0}},
+		{"192.0.2.77", 32, []byte{0, 1, 32, 0, 192, 0, 2, 77}},
+		{"192.0.2.77", 0, []byte{0, 1, 0, 0}},
+		{"2001:db8:abcd:12ff::1", 56, []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0xab, 0xcd, 0x12}},
+		// Longer prefixes than the family allows are cut to it
+		{"192.0.2.77", 40, []byte{0, 1, 32, 0, 192, 0, 2, 77}},
+	}
+	for _, test := range tests {
+		cs := NewClientSubnet(net.ParseIP(test.ip), test.prefix)
+		data := EncodeClientSubnet(cs)
+		if !bytes.Equal(data, test.data) {
+			t.Errorf("%s/%d encodes as %v, want %v", test.ip, test.prefix, data, test.data)
+			continue
+		}
+		decoded, err := DecodeClientSubnet(data)
+		if err != nil {
+			t.Errorf("%s/%d: decoding %v: %v", test.ip, test.prefix, data, err)
+			continue
+		}
+		if !decoded.IP.Equal(cs.IP) || decoded.SourcePrefix != cs.SourcePrefix || decoded.ScopePrefix != 0 {
+			t.Errorf("%s/%d decodes as %+v, want %+v", test.ip, test.prefix, decoded, cs)
+		}
+	}
+}
+
+func TestDecodeClientSubnetScope(t *testing.T) {
+	cs, err := DecodeClientSubnet([]byte{0, 1, 24, 16, 192, 0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network := cs.Network(cs.ScopePrefix); network.String() != "192.0.0.0/16" {
+		t.Errorf("scope network = %s, want 192.0.0.0/16", network)
+	}
+}
+
+func TestDecodeClientSubnetInvalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"too short":              {0, 1, 24},
+		"unknown family":         {0, 3, 8, 0, 10},
+		"source prefix too long": {0, 1, 33, 0, 192, 0, 2, 1, 0},
+		"scope prefix too long":  {0, 1, 24, 33, 192, 0, 2},
+		"address too short":      {0, 1, 24, 0, 192, 0},
+		"address too long":       {0, 1, 24, 0, 192, 0, 2, 1},
+		"ipv6 prefix past 128":   append([]byte{0, 2, 129, 0}, make([]byte, 17)...),
+		"address without prefix": {0, 2, 0, 0, 0x20},
+	} {
+		if cs, err := DecodeClientSubnet(data); err == nil {
+			t.Errorf("%s: decoded %+v", name, cs)
+		}
+	}
+}
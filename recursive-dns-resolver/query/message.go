@@ -0,0 +1,324 @@
+package query
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// headerSize is the size of the fixed DNS header
+const headerSize = 12
+
+// Section identifies the part of a message an entry was read from
+type Section int
+
+const (
+	SectionQuestion Section = iota
+	SectionAnswer
+	SectionAuthority
+	SectionAdditional
+	sectionDone
+)
+
+// Question is a question read from a Message. Name is the offset of its name in the message.
+type Question struct {
+	Name  int
+	Type  uint16
+	Class uint16
+}
+
+// Record is a record read from a Message. Name is the offset of its owner name and Data
+// aliases the message buffer, so neither is valid after the Message is Reset.
+type Record struct {
+	Section Section
+	Name    int
+	Type    uint16
+	Class   uint16
+	TTL     uint32
+	// DataOffset is where Data starts in the message, for names compressed inside it
+	DataOffset int
+	Data       []byte
+}
+
+// Message reads a wire format message in place, without copying it or allocating. Entries are
+// read one at a time and names are only decoded when asked for, so a server can look at the
+// question of a query without paying for the rest. A Message can be reused with Reset.
+type Message struct {
+	Header DNSHeader
+
+	buf     []byte
+	off     int     // where the next entry starts
+	section Section // the section the next entry is in
+	left    int     // entries left in that section
+}
+
+// Reset starts reading buf. It checks the header and that the counts could fit in buf.
+func (m *Message) Reset(buf []byte) error {
+	m.buf = buf
+	m.section = sectionDone
+	if len(buf) < headerSize {
+		return fmt.Errorf("message of %d bytes is shorter than a header", len(buf))
+	}
+	m.Header = DNSHeader{
+		ID:             binary.BigEndian.Uint16(buf[0:2]),
+		Flags:          binary.BigEndian.Uint16(buf[2:4]),
+		NumQuestions:   binary.BigEndian.Uint16(buf[4:6]),
+		NumAnswers:     binary.BigEndian.Uint16(buf[6:8]),
+		NumAuthorities: binary.BigEndian.Uint16(buf[8:10]),
+		NumAdditionals: binary.BigEndian.Uint16(buf[10:12]),
+	}
+	rest := len(buf) - headerSize
+	if int(m.Header.NumQuestions)*minQuestionSize > rest {
+		return fmt.Errorf("header claims %d questions in %d bytes", m.Header.NumQuestions, rest)
+	}
+	records := int(m.Header.NumAnswers) + int(m.Header.NumAuthorities) + int(m.Header.NumAdditionals)
+	// A truncated response may claim more records than it still carries
+	if int(m.Header.NumQuestions)*minQuestionSize+records*minRecordSize > rest && m.Header.Flags&FLAG_TC == 0 {
+		return fmt.Errorf("header claims %d records in %d bytes", records, rest)
+	}
+	m.off = headerSize
+	m.section = SectionQuestion
+	m.left = int(m.Header.NumQuestions)
+	return nil
+}
+
+// Bytes returns the message being read
+func (m *Message) Bytes() []byte {
+	return m.buf
+}
+
+// count returns how many entries the header announces for a section
+func (m *Message) count(section Section) int {
+	switch section {
+	case SectionQuestion:
+		return int(m.Header.NumQuestions)
+	case SectionAnswer:
+		return int(m.Header.NumAnswers)
+	case SectionAuthority:
+		return int(m.Header.NumAuthorities)
+	case SectionAdditional:
+		return int(m.Header.NumAdditionals)
+	}
+	return 0
+}
+
+// advance moves past sections that have been read completely
+func (m *Message) advance() {
+	for m.left == 0 && m.section < sectionDone {
+		m.section++
+		m.left = m.count(m.section)
+	}
+}
+
+// fail stops the iteration, so a malformed message is never read past the first error
+func (m *Message) fail(err error) error {
+	m.section = sectionDone
+	return err
+}
+
+// NextQuestion returns the next question, or false once all questions have been read
+func (m *Message) NextQuestion() (Question, bool, error) {
+	if m.section != SectionQuestion || m.left == 0 {
+		return Question{}, false, nil
+	}
+	end, err := m.skipName(m.off)
+	if err != nil {
+		return Question{}, false, m.fail(err)
+	}
+	if end+4 > len(m.buf) {
+		return Question{}, false, m.fail(fmt.Errorf("question runs past the end of the message"))
+	}
+	question := Question{
+		Name:  m.off,
+		Type:  binary.BigEndian.Uint16(m.buf[end : end+2]),
+		Class: binary.BigEndian.Uint16(m.buf[end+2 : end+4]),
+	}
+	m.off = end + 4
+	m.left--
+	return question, true, nil
+}
+
+// NextRecord returns the next record of the answer, authority or additional section, skipping
+// any questions not read yet. It returns false once every record has been read.
+func (m *Message) NextRecord() (Record, bool, error) {
+	for m.section == SectionQuestion && m.left > 0 {
+		if _, _, err := m.NextQuestion(); err != nil {
+			return Record{}, false, err
+		}
+	}
+	m.advance()
+	if m.section == sectionDone {
+		return Record{}, false, nil
+	}
+
+	end, err := m.skipName(m.off)
+	if err != nil {
+		return Record{}, false, m.fail(err)
+	}
+	if end+10 > len(m.buf) {
+		return Record{}, false, m.fail(fmt.Errorf("record runs past the end of the message"))
+	}
+	dataLength := int(binary.BigEndian.Uint16(m.buf[end+8 : end+10]))
+	dataStart := end + 10
+	if dataStart+dataLength > len(m.buf) {
+		return Record{}, false, m.fail(fmt.Errorf("record data runs past the end of the message"))
+	}
+	record := Record{
+		Section:    m.section,
+		Name:       m.off,
+		Type:       binary.BigEndian.Uint16(m.buf[end : end+2]),
+		Class:      binary.BigEndian.Uint16(m.buf[end+2 : end+4]),
+		TTL:        binary.BigEndian.Uint32(m.buf[end+4 : end+8]),
+		DataOffset: dataStart,
+		Data:       m.buf[dataStart : dataStart+dataLength : dataStart+dataLength],
+	}
+	m.off = dataStart + dataLength
+	m.left--
+	return record, true, nil
+}
+
+// skipName returns the offset just past the name at off without following pointers
+func (m *Message) skipName(off int) (int, error) {
+	for {
+		if off >= len(m.buf) {
+			return 0, fmt.Errorf("premature end of data in name")
+		}
+		length := int(m.buf[off])
+		switch length & 0xC0 {
+		case 0xC0:
+			if off+2 > len(m.buf) {
+				return 0, fmt.Errorf("premature end of data in pointer")
+			}
+			return off + 2, nil
+		case 0x00:
+			if length == 0 {
+				return off + 1, nil
+			}
+			off += 1 + length
+		default:
+			return 0, fmt.Errorf("unsupported label type 0x%02x", length&0xC0)
+		}
+	}
+}
+
+// AppendName appends the dotted form of the name at off to dst, without a trailing dot. It
+// allocates nothing when dst has room for the name.
+func (m *Message) AppendName(dst []byte, off int) ([]byte, error) {
+	dst, _, err := m.appendName(dst, off, false)
+	return dst, err
+}
+
+// appendName decodes the name at off and appends it to dst in dotted or in uncompressed wire
+// format. Every compression pointer must point before the label it appears in and before the
+// target of the pointer followed last, which rules out pointer loops, and the name may not be
+// longer than MaxNameLength in wire format. It also returns the offset just past the name
+// where it appears in the message.
+func (m *Message) appendName(dst []byte, off int, wire bool) ([]byte, int, error) {
+	end := -1       // where the name ends in place, known once the first pointer is seen
+	var limit int   // every pointer must point before the previous one
+	wireLength := 1 // the terminating zero byte
+	first := true
+	for {
+		if off >= len(m.buf) {
+			return dst, 0, fmt.Errorf("premature end of data in name")
+		}
+		length := int(m.buf[off])
+		switch length & 0xC0 {
+		case 0xC0:
+			if off+2 > len(m.buf) {
+				return dst, 0, fmt.Errorf("premature end of data in pointer")
+			}
+			pointer := int(m.buf[off]&0x3F)<<8 | int(m.buf[off+1])
+			if end < 0 {
+				end = off + 2
+				limit = off
+			}
+			if pointer >= limit {
+				return dst, 0, fmt.Errorf("compression pointer at %d does not point backwards", off)
+			}
+			limit = pointer
+			off = pointer
+		case 0x00:
+			if length == 0 {
+				if wire {
+					dst = append(dst, 0)
+				}
+				if end < 0 {
+					end = off + 1
+				}
+				return dst, end, nil
+			}
+			wireLength += 1 + length
+			if wireLength > MaxNameLength {
+				return dst, 0, fmt.Errorf("name is longer than %d bytes", MaxNameLength)
+			}
+			if off+1+length > len(m.buf) {
+				return dst, 0, fmt.Errorf("premature end of data in label")
+			}
+			if wire {
+				dst = append(dst, byte(length))
+			} else if !first {
+				dst = append(dst, '.')
+			}
+			dst = append(dst, m.buf[off+1:off+1+length]...)
+			first = false
+			off += 1 + length
+		default:
+			return dst, 0, fmt.Errorf("unsupported label type 0x%02x", length&0xC0)
+		}
+	}
+}
+
+// AppendRecordData appends the data of a record to dst, with the names inside NS, CNAME,
+// PTR, MX, SRV and SOA data uncompressed, so the record can be decoded without the message
+func (m *Message) AppendRecordData(dst []byte, record Record) ([]byte, error) {
+	var prefix, names int // fixed bytes before the first name, and how many names follow
+	switch record.Type {
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR:
+		prefix, names = 0, 1
+	case TYPE_MX:
+		prefix, names = 2, 1
+	case TYPE_SRV:
+		prefix, names = 6, 1
+	case TYPE_SOA:
+		prefix, names = 0, 2
+	default:
+		return append(dst, record.Data...), nil
+	}
+	if len(record.Data) < prefix {
+		return dst, fmt.Errorf("record data too short")
+	}
+
+	dst = append(dst, record.Data[:prefix]...)
+	off := record.DataOffset + prefix
+	dataEnd := record.DataOffset + len(record.Data)
+	for i := 0; i < names; i++ {
+		var err error
+		if dst, off, err = m.appendName(dst, off, true); err != nil {
+			return dst, err
+		}
+		if off > dataEnd {
+			return dst, fmt.Errorf("name runs past the end of the record data")
+		}
+	}
+	return append(dst, m.buf[off:dataEnd]...), nil
+}
+
+// messageBuffers holds buffers big enough for most messages, so the UDP paths of the server
+// and resolver do not allocate a new one for every datagram
+var messageBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, 4096)
+		return &buffer
+	},
+}
+
+// GetMessageBuffer returns a 4096 byte buffer from the pool. Give it back with PutMessageBuffer
+// once nothing refers to its contents any more.
+func GetMessageBuffer() *[]byte {
+	return messageBuffers.Get().(*[]byte)
+}
+
+func PutMessageBuffer(buffer *[]byte) {
+	messageBuffers.Put(buffer)
+}
@@ -0,0 +1,68 @@
+package query
+
+import "testing"
+
+// BenchmarkMessageIterate reads every entry of a message and decodes all of its names into a
+// reused buffer, which should not allocate at all
+func BenchmarkMessageIterate(b *testing.B) {
+	for name, packet := range recordedPackets(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(packet)))
+			var m Message
+			scratch := make([]byte, 0, 512)
+			for i := 0; i < b.N; i++ {
+				if err := m.Reset(packet); err != nil {
+					b.Fatal(err)
+				}
+				for {
+					question, ok, err := m.NextQuestion()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if !ok {
+						break
+					}
+					if scratch, err = m.AppendName(scratch[:0], question.Name); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for {
+					record, ok, err := m.NextRecord()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if !ok {
+						break
+					}
+					if scratch, err = m.AppendName(scratch[:0], record.Name); err != nil {
+						b.Fatal(err)
+					}
+					if scratch, err = m.AppendRecordData(scratch[:0], record); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMessageIterateAllocs keeps the in-place reader from starting to allocate unnoticed
+func TestMessageIterateAllocs(t *testing.T) {
+	packet := recordedPackets(t)["root-referral"]
+	var m Message
+	scratch := make([]byte, 0, 512)
+	allocs := testing.AllocsPerRun(100, func() {
+		m.Reset(packet)
+		for {
+			record, ok, err := m.NextRecord()
+			if err != nil || !ok {
+				break
+			}
+			scratch, _ = m.AppendName(scratch[:0], record.Name)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("iterating a message allocates %v times", allocs)
+	}
+}
@@ -40,9 +40,61 @@ type DNSPacket struct {
 }
 
 const (
-	TYPE_A     uint16 = 1
-	TYPE_NS    uint16 = 2
-	TYPE_CNAME uint16 = 5
-	TYPE_TXT   uint16 = 16
-	TYPE_AAAA  uint16 = 28
+	TYPE_A      uint16 = 1
+	TYPE_NS     uint16 = 2
+	TYPE_CNAME  uint16 = 5
+	TYPE_SOA    uint16 = 6
+	TYPE_PTR    uint16 = 12
+	TYPE_MX     uint16 = 15
+	TYPE_TXT    uint16 = 16
+	TYPE_AAAA   uint16 = 28
+	TYPE_SRV    uint16 = 33
+	TYPE_OPT    uint16 = 41
+	TYPE_DS     uint16 = 43
+	TYPE_DNSKEY uint16 = 48
+	TYPE_SVCB   uint16 = 64
+	TYPE_HTTPS  uint16 = 65
+	TYPE_TSIG   uint16 = 250
+	TYPE_IXFR   uint16 = 251
+	TYPE_AXFR   uint16 = 252
+	TYPE_ANY    uint16 = 255
+	TYPE_CAA    uint16 = 257
+)
+
+// Bits of the header flags
+const (
+	FLAG_QR uint16 = 1 << 15 // message is a response
+	FLAG_AA uint16 = 1 << 10 // authoritative answer
+	FLAG_TC uint16 = 1 << 9  // truncated
+	FLAG_RD uint16 = 1 << 8  // recursion desired
+	FLAG_RA uint16 = 1 << 7  // recursion available
+)
+
+// Response codes carried in the low four bits of the header flags
+const (
+	RCODE_NOERROR  uint16 = 0
+	RCODE_FORMERR  uint16 = 1
+	RCODE_SERVFAIL uint16 = 2
+	RCODE_NXDOMAIN uint16 = 3
+	RCODE_NOTIMP   uint16 = 4
+	RCODE_REFUSED  uint16 = 5
+	// Dynamic update (RFC 2136) and TSIG (RFC 8945) response codes
+	RCODE_YXDOMAIN uint16 = 6
+	RCODE_YXRRSET  uint16 = 7
+	RCODE_NXRRSET  uint16 = 8
+	RCODE_NOTAUTH  uint16 = 9
+	RCODE_NOTZONE  uint16 = 10
+)
+
+// Opcodes carried in bits 11 to 14 of the header flags
+const (
+	OPCODE_QUERY  uint16 = 0
+	OPCODE_UPDATE uint16 = 5
+)
+
+// Classes other than IN have special meanings in dynamic updates and TSIG records
+const (
+	CLASS_IN   uint16 = 1
+	CLASS_NONE uint16 = 254
+	CLASS_ANY  uint16 = 255
 )
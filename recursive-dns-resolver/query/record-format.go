@@ -0,0 +1,375 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TypeNames maps the record types we understand to their mnemonic
+var TypeNames = map[uint16]string{
+	TYPE_A:      "A",
+	TYPE_NS:     "NS",
+	TYPE_CNAME:  "CNAME",
+	TYPE_SOA:    "SOA",
+	TYPE_PTR:    "PTR",
+	TYPE_MX:     "MX",
+	TYPE_TXT:    "TXT",
+	TYPE_AAAA:   "AAAA",
+	TYPE_SRV:    "SRV",
+	TYPE_DS:     "DS",
+	TYPE_DNSKEY: "DNSKEY",
+	TYPE_SVCB:   "SVCB",
+	TYPE_HTTPS:  "HTTPS",
+	TYPE_TSIG:   "TSIG",
+	TYPE_IXFR:   "IXFR",
+	TYPE_AXFR:   "AXFR",
+	TYPE_ANY:    "ANY",
+	TYPE_CAA:    "CAA",
+}
+
+// TypeName returns the mnemonic of a record type, or the RFC 3597 TYPEnnn form for unknown ones
+func TypeName(recordType uint16) string {
+	if name, ok := TypeNames[recordType]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", recordType)
+}
+
+// rcodeNames are the mnemonics of the response codes
+var rcodeNames = map[uint16]string{
+	RCODE_NOERROR:  "NOERROR",
+	RCODE_FORMERR:  "FORMERR",
+	RCODE_SERVFAIL: "SERVFAIL",
+	RCODE_NXDOMAIN: "NXDOMAIN",
+	RCODE_NOTIMP:   "NOTIMP",
+	RCODE_REFUSED:  "REFUSED",
+	RCODE_YXDOMAIN: "YXDOMAIN",
+	RCODE_YXRRSET:  "YXRRSET",
+	RCODE_NXRRSET:  "NXRRSET",
+	RCODE_NOTAUTH:  "NOTAUTH",
+	RCODE_NOTZONE:  "NOTZONE",
+}
+
+// RcodeName returns the mnemonic of a response code, or RCODEnn for ones we do not know
+func RcodeName(rcode uint16) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// MXData is the decoded data of an MX record
+type MXData struct {
+	Preference uint16
+	Exchange   string
+}
+
+// SRVData is the decoded data of an SRV record
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// SOAData is the decoded data of an SOA record
+type SOAData struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// SerialNewer reports whether SOA serial a is newer than b, with the wrap around arithmetic of
+// RFC 1982
+func SerialNewer(a uint32, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// CAAData is the decoded data of a CAA record
+type CAAData struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+// nameLength returns how many bytes the uncompressed wire format name at the start of data takes
+func nameLength(data []byte) (int, error) {
+	pos := 0
+	for pos < len(data) {
+		length := int(data[pos])
+		pos++
+		if length == 0 {
+			return pos, nil
+		}
+		pos += length
+	}
+	return 0, fmt.Errorf("name runs past the end of the record data")
+}
+
+// DecodeMX decodes MX record data. Like all the decoders below it expects names to be
+// uncompressed, which ParseDNSResponse takes care of.
+func DecodeMX(data []byte) (MXData, error) {
+	if len(data) < 3 {
+		return MXData{}, fmt.Errorf("MX data too short")
+	}
+	return MXData{
+		Preference: binary.BigEndian.Uint16(data[0:2]),
+		Exchange:   DecodeNSName(data[2:]),
+	}, nil
+}
+
+func DecodeSRV(data []byte) (SRVData, error) {
+	if len(data) < 7 {
+		return SRVData{}, fmt.Errorf("SRV data too short")
+	}
+	return SRVData{
+		Priority: binary.BigEndian.Uint16(data[0:2]),
+		Weight:   binary.BigEndian.Uint16(data[2:4]),
+		Port:     binary.BigEndian.Uint16(data[4:6]),
+		Target:   DecodeNSName(data[6:]),
+	}, nil
+}
+
+func DecodeSOA(data []byte) (SOAData, error) {
+	mnameLen, err := nameLength(data)
+	if err != nil {
+		return SOAData{}, err
+	}
+	rnameLen, err := nameLength(data[mnameLen:])
+	if err != nil {
+		return SOAData{}, err
+	}
+	numbers := data[mnameLen+rnameLen:]
+	if len(numbers) < 20 {
+		return SOAData{}, fmt.Errorf("SOA data too short")
+	}
+	return SOAData{
+		MName:   DecodeNSName(data[:mnameLen]),
+		RName:   DecodeNSName(data[mnameLen:]),
+		Serial:  binary.BigEndian.Uint32(numbers[0:4]),
+		Refresh: binary.BigEndian.Uint32(numbers[4:8]),
+		Retry:   binary.BigEndian.Uint32(numbers[8:12]),
+		Expire:  binary.BigEndian.Uint32(numbers[12:16]),
+		Minimum: binary.BigEndian.Uint32(numbers[16:20]),
+	}, nil
+}
+
+// EncodeSOA builds SOA record data, with the names uncompressed
+func EncodeSOA(soa SOAData) []byte {
+	data := append(encodeDNSName(soa.MName), encodeDNSName(soa.RName)...)
+	for _, value := range []uint32{soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum} {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return data
+}
+
+func DecodeCAA(data []byte) (CAAData, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return CAAData{}, fmt.Errorf("CAA data too short")
+	}
+	tagEnd := 2 + int(data[1])
+	return CAAData{
+		Flags: data[0],
+		Tag:   string(data[2:tagEnd]),
+		Value: string(data[tagEnd:]),
+	}, nil
+}
+
+// DecodeTXT splits TXT record data into its character strings
+func DecodeTXT(data []byte) ([]string, error) {
+	var texts []string
+	for pos := 0; pos < len(data); {
+		length := int(data[pos])
+		if pos+1+length > len(data) {
+			return nil, fmt.Errorf("TXT string runs past the end of the record data")
+		}
+		texts = append(texts, string(data[pos+1:pos+1+length]))
+		pos += 1 + length
+	}
+	return texts, nil
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name used to look up the PTR record of ip
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	digits := hex.EncodeToString(ip.To16())
+	var parts []string
+	for i := len(digits) - 1; i >= 0; i-- {
+		parts = append(parts, digits[i:i+1])
+	}
+	return strings.Join(parts, ".") + ".ip6.arpa"
+}
+
+// ParseReverseName is the inverse of ReverseName. It returns nil for names that are not a
+// complete in-addr.arpa or ip6.arpa name of one address.
+func ParseReverseName(name string) net.IP {
+	name = strings.ToLower(strings.Trim(name, "."))
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		parts := strings.Split(labels, ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		slices.Reverse(parts)
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	}
+	labels, ok := strings.CutSuffix(name, ".ip6.arpa")
+	if !ok {
+		return nil
+	}
+	parts := strings.Split(labels, ".")
+	if len(parts) != 32 {
+		return nil
+	}
+	digits := make([]byte, 0, 32)
+	for i := len(parts) - 1; i >= 0; i-- {
+		if len(parts[i]) != 1 {
+			return nil
+		}
+		digits = append(digits, parts[i][0])
+	}
+	ip, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return nil
+	}
+	return net.IP(ip)
+}
+
+// FormatRecordData renders the data of a record in master file presentation format
+func FormatRecordData(record DNSRecord) string {
+	data := record.Data
+	switch record.Type {
+	case TYPE_A, TYPE_AAAA:
+		return net.IP(data).String()
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR:
+		return DecodeNSName(data) + "."
+	case TYPE_MX:
+		if mx, err := DecodeMX(data); err == nil {
+			return fmt.Sprintf("%d %s.", mx.Preference, mx.Exchange)
+		}
+	case TYPE_SRV:
+		if srv, err := DecodeSRV(data); err == nil {
+			return fmt.Sprintf("%d %d %d %s.", srv.Priority, srv.Weight, srv.Port, srv.Target)
+		}
+	case TYPE_SOA:
+		if soa, err := DecodeSOA(data); err == nil {
+			return fmt.Sprintf("%s. %s. %d %d %d %d %d", soa.MName, soa.RName, soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+		}
+	case TYPE_TXT:
+		if texts, err := DecodeTXT(data); err == nil {
+			quoted := make([]string, len(texts))
+			for i, text := range texts {
+				quoted[i] = strconv.Quote(text)
+			}
+			return strings.Join(quoted, " ")
+		}
+	case TYPE_CAA:
+		if caa, err := DecodeCAA(data); err == nil {
+			return fmt.Sprintf("%d %s %s", caa.Flags, caa.Tag, strconv.Quote(caa.Value))
+		}
+	case TYPE_DS:
+		if len(data) >= 4 {
+			return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(data[0:2]), data[2], data[3], strings.ToUpper(hex.EncodeToString(data[4:])))
+		}
+	case TYPE_DNSKEY:
+		if len(data) >= 4 {
+			return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(data[0:2]), data[2], data[3], base64.StdEncoding.EncodeToString(data[4:]))
+		}
+	case TYPE_SVCB, TYPE_HTTPS:
+		if svcb, err := formatSVCB(data); err == nil {
+			return svcb
+		}
+	}
+	// Unknown types and data we could not decode use the generic RFC 3597 form
+	return fmt.Sprintf("\\# %d %s", len(data), hex.EncodeToString(data))
+}
+
+// svcParamKeys are the SvcParamKey mnemonics from RFC 9460
+var svcParamKeys = map[uint16]string{
+	0: "mandatory",
+	1: "alpn",
+	2: "no-default-alpn",
+	3: "port",
+	4: "ipv4hint",
+	5: "ech",
+	6: "ipv6hint",
+}
+
+// formatSVCB renders SVCB and HTTPS record data: priority, target and the SvcParams
+func formatSVCB(data []byte) (string, error) {
+	if len(data) < 3 {
+		return "", fmt.Errorf("SVCB data too short")
+	}
+	priority := binary.BigEndian.Uint16(data[0:2])
+	targetLen, err := nameLength(data[2:])
+	if err != nil {
+		return "", err
+	}
+	target := DecodeNSName(data[2:]) + "."
+	fields := []string{strconv.Itoa(int(priority)), target}
+
+	for pos := 2 + targetLen; pos < len(data); {
+		if pos+4 > len(data) {
+			return "", fmt.Errorf("SvcParam header runs past the end of the record data")
+		}
+		key := binary.BigEndian.Uint16(data[pos : pos+2])
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		pos += 4
+		if pos+length > len(data) {
+			return "", fmt.Errorf("SvcParam value runs past the end of the record data")
+		}
+		value := data[pos : pos+length]
+		pos += length
+
+		name, ok := svcParamKeys[key]
+		if !ok {
+			name = fmt.Sprintf("key%d", key)
+		}
+		switch key {
+		case 1: // alpn is a list of length prefixed protocol ids
+			ids, err := DecodeTXT(value)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, name+"="+strings.Join(ids, ","))
+		case 2:
+			fields = append(fields, name)
+		case 3:
+			if len(value) != 2 {
+				return "", fmt.Errorf("bad port SvcParam")
+			}
+			fields = append(fields, fmt.Sprintf("%s=%d", name, binary.BigEndian.Uint16(value)))
+		case 4, 6:
+			size := net.IPv4len
+			if key == 6 {
+				size = net.IPv6len
+			}
+			var ips []string
+			for i := 0; i+size <= len(value); i += size {
+				ips = append(ips, net.IP(value[i:i+size]).String())
+			}
+			fields = append(fields, name+"="+strings.Join(ips, ","))
+		case 5:
+			fields = append(fields, name+"="+base64.StdEncoding.EncodeToString(value))
+		default:
+			fields = append(fields, name+"="+hex.EncodeToString(value))
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// FormatRecord renders a whole record as one master file line
+func FormatRecord(record DNSRecord) string {
+	return fmt.Sprintf("%s.\t%d\tIN\t%s\t%s", record.Name, record.TTL, TypeName(record.Type), FormatRecordData(record))
+}
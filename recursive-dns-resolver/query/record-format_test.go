@@ -0,0 +1,23 @@
+package query
+
+import "testing"
+
+func TestSerialNewer(t *testing.T) {
+	tests := []struct {
+		a, b  uint32
+		newer bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{5, 5, false},
+		// Serials wrap around, so a small serial can follow a large one
+		{3, 0xFFFFFFF0, true},
+		{0xFFFFFFF0, 3, false},
+		{1 << 31, 0, false},
+	}
+	for _, test := range tests {
+		if got := SerialNewer(test.a, test.b); got != test.newer {
+			t.Errorf("SerialNewer(%d, %d) = %v, want %v", test.a, test.b, got, test.newer)
+		}
+	}
+}
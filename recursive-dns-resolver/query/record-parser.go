@@ -0,0 +1,115 @@
+package query
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseRecordData is the reverse of FormatRecordData: it encodes the presentation format
+// fields of a record's data, with any quotes already removed. Names are taken as absolute,
+// with or without the trailing dot. Types we cannot parse are accepted in the generic
+// RFC 3597 form, \# length hex.
+func ParseRecordData(recordType uint16, fields []string) ([]byte, error) {
+	if len(fields) > 0 && fields[0] == `\#` {
+		return parseGenericData(fields[1:])
+	}
+	need := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("%s data needs %d fields, got %d", TypeName(recordType), n, len(fields))
+		}
+		return nil
+	}
+
+	switch recordType {
+	case TYPE_A, TYPE_AAAA:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if recordType == TYPE_A {
+			ip = ip.To4()
+		} else if ip.To4() != nil {
+			ip = nil // an IPv4 address is not AAAA data
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not a valid %s address", fields[0], TypeName(recordType))
+		}
+		return ip, nil
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		return encodeDNSName(fields[0]), nil
+	case TYPE_MX:
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("MX preference %q: %w", fields[0], err)
+		}
+		return append(binary.BigEndian.AppendUint16(nil, uint16(preference)), encodeDNSName(fields[1])...), nil
+	case TYPE_SRV:
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		var data []byte
+		for _, field := range fields[:3] {
+			n, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("SRV field %q: %w", field, err)
+			}
+			data = binary.BigEndian.AppendUint16(data, uint16(n))
+		}
+		return append(data, encodeDNSName(fields[3])...), nil
+	case TYPE_TXT:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("TXT data needs at least one string")
+		}
+		var data []byte
+		for _, text := range fields {
+			if len(text) > 255 {
+				return nil, fmt.Errorf("TXT string of %d bytes is longer than 255", len(text))
+			}
+			data = append(append(data, byte(len(text))), text...)
+		}
+		return data, nil
+	case TYPE_CAA:
+		if err := need(3); err != nil {
+			return nil, err
+		}
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("CAA flags %q: %w", fields[0], err)
+		}
+		if len(fields[1]) == 0 || len(fields[1]) > 255 {
+			return nil, fmt.Errorf("CAA tag %q has an invalid length", fields[1])
+		}
+		data := append([]byte{byte(flags), byte(len(fields[1]))}, fields[1]...)
+		return append(data, fields[2]...), nil
+	}
+	return nil, fmt.Errorf("cannot parse %s data, use the \\# length hex form", TypeName(recordType))
+}
+
+// parseGenericData decodes the length and hex fields of the RFC 3597 form
+func parseGenericData(fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf(`\# needs a length`)
+	}
+	length, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf(`\# length %q: %w`, fields[0], err)
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf(`\# data: %w`, err)
+	}
+	if len(data) != length {
+		return nil, fmt.Errorf(`\# length %d does not match %d bytes of data`, length, len(data))
+	}
+	return data, nil
+}
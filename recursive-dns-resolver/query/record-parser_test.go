@@ -0,0 +1,76 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseRecordData(t *testing.T) {
+	tests := []struct {
+		recordType uint16
+		fields     []string
+		data       []byte // nil when parsing must fail
+	}{
+		{TYPE_A, []string{"192.0.2.1"}, []byte{192, 0, 2, 1}},
+		{TYPE_A, []string{"2001:db8::1"}, nil},
+		{TYPE_A, []string{"192.0.2.256"}, nil},
+		{TYPE_A, []string{"192.0.2.1", "192.0.2.2"}, nil},
+		{TYPE_AAAA, []string{"2001:db8::1"}, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{TYPE_AAAA, []string{"192.0.2.1"}, nil},
+		{TYPE_NS, []string{"ns1.example.com."}, EncodeName("ns1.example.com")},
+		{TYPE_CNAME, []string{"web.example.com"}, EncodeName("web.example.com")},
+		{TYPE_PTR, []string{}, nil},
+		{TYPE_MX, []string{"10", "mail.example.com"}, append([]byte{0, 10}, EncodeName("mail.example.com")...)},
+		{TYPE_MX, []string{"65536", "mail.example.com"}, nil},
+		{TYPE_SRV, []string{"1", "2", "443", "host.example.com"}, append([]byte{0, 1, 0, 2, 1, 187}, EncodeName("host.example.com")...)},
+		{TYPE_SRV, []string{"1", "2", "port", "host.example.com"}, nil},
+		{TYPE_TXT, []string{"v=spf1 -all", ""}, append(append([]byte{11}, "v=spf1 -all"...), 0)},
+		{TYPE_TXT, []string{}, nil},
+		{TYPE_TXT, []string{string(bytes.Repeat([]byte{'a'}, 256))}, nil},
+		{TYPE_CAA, []string{"0", "issue", "letsencrypt.org"}, append(append([]byte{0, 5}, "issue"...), "letsencrypt.org"...)},
+		{TYPE_CAA, []string{"256", "issue", "letsencrypt.org"}, nil},
+		{TYPE_CAA, []string{"0", "", "letsencrypt.org"}, nil},
+		{TYPE_SOA, []string{"ns1.example.com", "hostmaster.example.com", "1", "2", "3", "4", "5"}, nil},
+		// The generic form works for every type
+		{TYPE_SOA, []string{`\#`, "3", "abcd", "ef"}, []byte{0xab, 0xcd, 0xef}},
+		{TYPE_A, []string{`\#`, "4", "c0000201"}, []byte{192, 0, 2, 1}},
+		{TYPE_A, []string{`\#`, "3", "c0000201"}, nil},
+		{TYPE_A, []string{`\#`, "4", "c00002zz"}, nil},
+		{TYPE_A, []string{`\#`}, nil},
+	}
+	for _, test := range tests {
+		data, err := ParseRecordData(test.recordType, test.fields)
+		switch {
+		case test.data == nil && err == nil:
+			t.Errorf("%s %q parsed to %x, want an error", TypeName(test.recordType), test.fields, data)
+		case test.data != nil && err != nil:
+			t.Errorf("%s %q: %v", TypeName(test.recordType), test.fields, err)
+		case !bytes.Equal(data, test.data):
+			t.Errorf("%s %q parsed to %x, want %x", TypeName(test.recordType), test.fields, data, test.data)
+		}
+	}
+}
+
+// What ParseRecordData encodes, FormatRecordData prints back the same way
+func TestParseRecordDataFormatsBack(t *testing.T) {
+	tests := []struct {
+		recordType uint16
+		text       string
+	}{
+		{TYPE_A, "192.0.2.1"},
+		{TYPE_AAAA, "2001:db8::1"},
+		{TYPE_NS, "ns1.example.com."},
+		{TYPE_MX, "10 mail.example.com."},
+		{TYPE_SRV, "1 2 443 host.example.com."},
+	}
+	for _, test := range tests {
+		data, err := ParseRecordData(test.recordType, strings.Fields(test.text))
+		if err != nil {
+			t.Fatalf("%s %s: %v", TypeName(test.recordType), test.text, err)
+		}
+		if got := FormatRecordData(DNSRecord{Type: test.recordType, Data: data}); got != test.text {
+			t.Errorf("%s %s formats back as %q", TypeName(test.recordType), test.text, got)
+		}
+	}
+}
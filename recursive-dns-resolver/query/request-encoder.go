@@ -36,6 +36,11 @@ func encodeDNSName(domainName string) []byte {
 	return buffer.Bytes()
 }
 
+// EncodeName returns a dotted name in uncompressed wire format, the way names are kept in record data
+func EncodeName(domainName string) []byte {
+	return encodeDNSName(domainName)
+}
+
 // buildQuery constructs the DNS query byte sequence
 func BuildQuery(domainName string, recordType uint16) []byte {
 	name := encodeDNSName(domainName)
@@ -0,0 +1,54 @@
+package query
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// recordToBytes serialises a resource record. The name is the dotted form ParseDNSResponse
+// produces and is written without compression, as is the data.
+func recordToBytes(record DNSRecord) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeDNSName(string(record.Name)))
+	binary.Write(buf, binary.BigEndian, RecordReader{
+		Type:    record.Type,
+		Class:   record.Class,
+		TTL:     record.TTL,
+		DataLen: uint16(len(record.Data)),
+	})
+	buf.Write(record.Data)
+	return buf.Bytes()
+}
+
+// PacketToBytes serialises a whole packet, e.g. one returned by ParseDNSResponse. The counts
+// in the header are taken from the sections, and names are written without compression.
+func PacketToBytes(packet DNSPacket) []byte {
+	header := packet.Header
+	header.NumQuestions = uint16(len(packet.Questions))
+	header.NumAnswers = uint16(len(packet.Answers))
+	header.NumAuthorities = uint16(len(packet.Authorities))
+	header.NumAdditionals = uint16(len(packet.Additionals))
+
+	buf := bytes.NewBuffer(headerToBytes(header))
+	for _, question := range packet.Questions {
+		question.Name = encodeDNSName(string(question.Name))
+		buf.Write(questionToBytes(question))
+	}
+	for _, section := range [][]DNSRecord{packet.Answers, packet.Authorities, packet.Additionals} {
+		for _, record := range section {
+			buf.Write(recordToBytes(record))
+		}
+	}
+	return buf.Bytes()
+}
+
+// BuildResponse creates the reply to request carrying answers. The ID, question and RD bit
+// are copied from the request.
+func BuildResponse(request DNSPacket, rcode uint16, answers []DNSRecord) DNSPacket {
+	flags := FLAG_QR | FLAG_RA | request.Header.Flags&FLAG_RD | rcode&0x000F
+	return DNSPacket{
+		Header:    DNSHeader{ID: request.Header.ID, Flags: flags},
+		Questions: request.Questions,
+		Answers:   answers,
+	}
+}
@@ -1,65 +1,102 @@
 package query
 
 import (
-	"bytes"
 	"fmt"
-	"log"
 	"net"
+	"strings"
 )
 
-func ParseDNSResponse(buffer []byte) (*DNSPacket, error) {
-	reader := bytes.NewReader(buffer)
+// minQuestionSize and minRecordSize are the smallest a question and a record can be on the
+// wire: a root name followed by the fixed fields
+const (
+	minQuestionSize = 1 + 4
+	minRecordSize   = 1 + 10
+)
 
-	header := ParseHeader(reader)
-	// fmt.Println("Parsed Header: ", header)
+// ParseDNSResponse parses a whole message. Malformed input is reported as an error, except
+// that a truncated (TC) response may end early, in which case the records parsed so far are kept.
+// The names and data of all entries share one allocation.
+func ParseDNSResponse(buffer []byte) (*DNSPacket, error) {
+	var m Message
+	if err := m.Reset(buffer); err != nil {
+		return nil, err
+	}
+	packet := &DNSPacket{Header: m.Header}
+	// Names can only grow through decompression, so twice the message size is rarely exceeded
+	arena := make([]byte, 0, 2*len(buffer))
 
-	questions := make([]DNSQuestion, header.NumQuestions)
-	for i := 0; i < int(header.NumQuestions); i++ {
-		question, err := ParseQuestion(reader)
-		if err != nil {
-			log.Printf("Error parsing question: %v", err)
-			continue
-		}
-		questions[i] = *question
-		// fmt.Printf("Question %d: %+v\n", i+1, question)
+	if m.Header.NumQuestions > 0 {
+		packet.Questions = make([]DNSQuestion, 0, m.Header.NumQuestions)
 	}
-	answers := make([]DNSRecord, header.NumAnswers)
-	for i := 0; i < int(header.NumAnswers); i++ {
-		answer, err := ParseRecord(reader)
+	for {
+		question, ok, err := m.NextQuestion()
 		if err != nil {
-			log.Printf("Error parsing answer: %v", err)
-			continue
+			return nil, fmt.Errorf("parsing question: %w", err)
 		}
-		answers[i] = *answer
-		// fmt.Printf("Answer %d: %+v\n", i+1, answer)
-	}
-	authorities := make([]DNSRecord, header.NumAuthorities)
-	for i := 0; i < int(header.NumAuthorities); i++ {
-		authority, err := ParseRecord(reader)
-		if err != nil {
-			log.Printf("Error parsing authority record: %v", err)
-			continue
+		if !ok {
+			break
 		}
-		authorities[i] = *authority
-		// fmt.Printf("Authority %d: %+v\n", i+1, authority)
+		start := len(arena)
+		if arena, err = m.AppendName(arena, question.Name); err != nil {
+			return nil, fmt.Errorf("parsing question: %w", err)
+		}
+		packet.Questions = append(packet.Questions, DNSQuestion{
+			Name:  arena[start:len(arena):len(arena)],
+			Type:  question.Type,
+			Class: question.Class,
+		})
+	}
+
+	// Only size the record slices from the header when the records can all be there
+	if m.Header.Flags&FLAG_TC == 0 {
+		packet.Answers = make([]DNSRecord, 0, m.Header.NumAnswers)
+		packet.Authorities = make([]DNSRecord, 0, m.Header.NumAuthorities)
+		packet.Additionals = make([]DNSRecord, 0, m.Header.NumAdditionals)
 	}
-	additionals := make([]DNSRecord, header.NumAdditionals)
-	for i := 0; i < int(header.NumAdditionals); i++ {
-		additional, err := ParseRecord(reader)
+	sections := map[Section]*[]DNSRecord{
+		SectionAnswer:     &packet.Answers,
+		SectionAuthority:  &packet.Authorities,
+		SectionAdditional: &packet.Additionals,
+	}
+	for {
+		record, ok, err := m.NextRecord()
+		if err == nil && ok {
+			var parsed DNSRecord
+			parsed, arena, err = m.toDNSRecord(arena, record)
+			if err == nil {
+				*sections[record.Section] = append(*sections[record.Section], parsed)
+				continue
+			}
+		}
 		if err != nil {
-			log.Printf("Error parsing additional record: %v", err)
-			continue
+			if m.Header.Flags&FLAG_TC != 0 {
+				return packet, nil
+			}
+			return nil, fmt.Errorf("parsing record: %w", err)
 		}
-		additionals[i] = *additional
-		// fmt.Printf("Additional %d: %+v\n", i+1, additional)
-	}
-	return &DNSPacket{
-		Header:      header,
-		Questions:   questions,
-		Answers:     answers,
-		Authorities: authorities,
-		Additionals: additionals,
-	}, nil
+		return packet, nil
+	}
+}
+
+// toDNSRecord copies a record out of the message into arena
+func (m *Message) toDNSRecord(arena []byte, record Record) (DNSRecord, []byte, error) {
+	nameStart := len(arena)
+	arena, err := m.AppendName(arena, record.Name)
+	if err != nil {
+		return DNSRecord{}, arena, err
+	}
+	name := arena[nameStart:len(arena):len(arena)]
+	dataStart := len(arena)
+	if arena, err = m.AppendRecordData(arena, record); err != nil {
+		return DNSRecord{}, arena, fmt.Errorf("failed to decode name in data: %w", err)
+	}
+	return DNSRecord{
+		Name:  name,
+		Type:  record.Type,
+		Class: record.Class,
+		TTL:   record.TTL,
+		Data:  arena[dataStart:len(arena):len(arena)],
+	}, arena, nil
 }
 
 // func GetHeaderTTL(records DNSPacket) {
@@ -71,6 +108,10 @@ func GetAnswerIP(records DNSPacket) (string, uint32) {
 	var ips []string
 	var ttl uint32
 	for _, record := range records.Answers {
+		// Only address records carry an IP, anything else would decode as garbage
+		if record.Type != TYPE_A && record.Type != TYPE_AAAA {
+			continue
+		}
 		ip := net.IP(record.Data).String()
 		ttl = record.TTL
 		if ip != "<nil>" {
@@ -83,6 +124,17 @@ func GetAnswerIP(records DNSPacket) (string, uint32) {
 	return "", 0
 }
 
+// GetAnswerCNAME returns the canonical name at the end of the CNAME chain in the answer section
+func GetAnswerCNAME(records DNSPacket) string {
+	var target string
+	for _, record := range records.Answers {
+		if record.Type == TYPE_CNAME {
+			target = DecodeNSName(record.Data)
+		}
+	}
+	return target
+}
+
 func GetAdditionalsIP(records DNSPacket, recordType uint16) (string, string, error) {
 	for _, record := range records.Additionals {
 		if record.Type == recordType {
@@ -97,6 +149,33 @@ func GetAdditionalsIP(records DNSPacket, recordType uint16) (string, string, err
 	return "", "", fmt.Errorf("no record found of type %d", recordType)
 }
 
+// GetNameServerNames returns every nameserver named by NS records in the authority section
+func GetNameServerNames(packet DNSPacket) []string {
+	var nsDomains []string
+	for _, record := range packet.Authorities {
+		if record.Type == TYPE_NS {
+			if nsName := DecodeNSName(record.Data); nsName != "" {
+				nsDomains = append(nsDomains, nsName)
+			}
+		}
+	}
+	return nsDomains
+}
+
+// GetGlueIPs returns the IPv4 and IPv6 glue addresses given for nsName in the additional section
+func GetGlueIPs(packet DNSPacket, nsName string) []net.IP {
+	var ips []net.IP
+	for _, record := range packet.Additionals {
+		if !strings.EqualFold(string(record.Name), nsName) {
+			continue
+		}
+		if (record.Type == TYPE_A && len(record.Data) == net.IPv4len) || (record.Type == TYPE_AAAA && len(record.Data) == net.IPv6len) {
+			ips = append(ips, net.IP(record.Data))
+		}
+	}
+	return ips
+}
+
 func GetNameServers(packet DNSPacket) string {
 	var nsDomains []string
 	for _, record := range packet.Authorities {
@@ -114,3 +193,22 @@ func GetNameServers(packet DNSPacket) string {
 	}
 	return ""
 }
+
+// GetRcode returns the response code from the low four bits of the header flags
+func GetRcode(packet DNSPacket) uint16 {
+	return packet.Header.Flags & 0x000F
+}
+
+// GetReferralZone returns the zone a referral delegates to, which is the owner name
+// of the NS records in the authority section. An empty string means the packet is not a referral.
+func GetReferralZone(packet DNSPacket) string {
+	if len(packet.Answers) > 0 {
+		return ""
+	}
+	for _, record := range packet.Authorities {
+		if record.Type == TYPE_NS {
+			return string(record.Name)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,234 @@
+package query
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordedPackets returns the referrals in testdata: the root servers and the com servers
+// referring a query for www.example.com on, with the compression and glue they send.
+func recordedPackets(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	files, err := filepath.Glob("testdata/*.bin")
+	if err != nil || len(files) == 0 {
+		tb.Fatalf("no recorded packets in testdata: %v", err)
+	}
+	packets := make(map[string][]byte)
+	for _, file := range files {
+		packet, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		packets[strings.TrimSuffix(filepath.Base(file), ".bin")] = packet
+	}
+	return packets
+}
+
+// malformedPackets are messages every parser has to reject
+func malformedPackets(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	root := recordedPackets(tb)["root-referral"]
+	header := func(questions, answers uint16) []byte {
+		h := make([]byte, 12)
+		binary.BigEndian.PutUint16(h[2:], FLAG_QR)
+		binary.BigEndian.PutUint16(h[4:], questions)
+		binary.BigEndian.PutUint16(h[6:], answers)
+		return h
+	}
+	question := func(name []byte) []byte {
+		return append(append(header(1, 0), name...), 0, 1, 0, 1)
+	}
+	longName := bytes.Repeat(append([]byte{63}, bytes.Repeat([]byte{'a'}, 63)...), 4)
+
+	return map[string][]byte{
+		"short header": root[:11],
+		// Cut inside the additional section without the TC bit
+		"truncated": root[:len(root)-40],
+		// The answer owner points at itself
+		"pointer to itself": func() []byte {
+			p := append(header(1, 1), 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+			return append(p, 0xC0, 0x15, 0, 1, 0, 1, 0, 0, 0, 60, 0, 0)
+		}(),
+		// Two pointers that point at each other
+		"pointer loop": func() []byte {
+			p := append(header(0, 1), 0xC0, 0x0E, 0xC0, 0x0C)
+			return append(p, 0, 1, 0, 1, 0, 0, 0, 60, 0, 0)
+		}(),
+		"pointer forwards":   append(question([]byte{0xC0, 0x20}), make([]byte, 32)...),
+		"label of 64 bytes":  question(append(append([]byte{64}, bytes.Repeat([]byte{'a'}, 64)...), 0)),
+		"name of 257 bytes":  question(append(longName, 0)),
+		"label past the end": question([]byte{10, 'a', 'b'}),
+		"record data past the end": func() []byte {
+			p := append(header(0, 1), 0, 0, 1, 0, 1, 0, 0, 0, 60, 0, 8)
+			return append(p, 1, 2, 3, 4)
+		}(),
+		"counts larger than the packet": header(2000, 0),
+	}
+}
+
+func TestParseDNSResponseRecorded(t *testing.T) {
+	packets := recordedPackets(t)
+	root, err := ParseDNSResponse(packets["root-referral"])
+	if err != nil {
+		t.Fatalf("parsing root referral: %v", err)
+	}
+	if zone := GetReferralZone(*root); zone != "com" {
+		t.Errorf("root referral zone = %q, want com", zone)
+	}
+	if got := len(GetNameServerNames(*root)); got != 13 {
+		t.Errorf("root referral has %d nameservers, want 13", got)
+	}
+	if glue := GetGlueIPs(*root, "m.gtld-servers.net"); len(glue) != 2 || glue[0].String() != "192.55.83.30" {
+		t.Errorf("glue for m.gtld-servers.net = %v", glue)
+	}
+
+	com, err := ParseDNSResponse(packets["com-referral"])
+	if err != nil {
+		t.Fatalf("parsing com referral: %v", err)
+	}
+	if zone := GetReferralZone(*com); zone != "example.com" {
+		t.Errorf("com referral zone = %q, want example.com", zone)
+	}
+}
+
+func TestParseDNSResponseMalformed(t *testing.T) {
+	for name, packet := range malformedPackets(t) {
+		if _, err := ParseDNSResponse(packet); err == nil {
+			t.Errorf("%s: parsed without an error", name)
+		}
+	}
+}
+
+func TestParseDNSResponseTruncatedWithTC(t *testing.T) {
+	packet := append([]byte(nil), recordedPackets(t)["root-referral"]...)
+	binary.BigEndian.PutUint16(packet[2:], FLAG_QR|FLAG_TC)
+	parsed, err := ParseDNSResponse(packet[:len(packet)-40])
+	if err != nil {
+		t.Fatalf("a truncated response with TC set failed: %v", err)
+	}
+	if len(parsed.Authorities) != 13 || len(parsed.Additionals) == 0 {
+		t.Errorf("kept %d authorities and %d additionals", len(parsed.Authorities), len(parsed.Additionals))
+	}
+}
+
+func FuzzParseDNSResponse(f *testing.F) {
+	for _, packet := range recordedPackets(f) {
+		f.Add(packet)
+	}
+	for _, packet := range malformedPackets(f) {
+		f.Add(packet)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := ParseDNSResponse(data)
+		if err != nil {
+			return
+		}
+		// Whatever parses has to be a message the limits allow, anything else is invalid input
+		// that should have been an error
+		if packet.Header.Flags&FLAG_TC == 0 {
+			if len(packet.Questions) != int(packet.Header.NumQuestions) || len(packet.Answers) != int(packet.Header.NumAnswers) ||
+				len(packet.Authorities) != int(packet.Header.NumAuthorities) || len(packet.Additionals) != int(packet.Header.NumAdditionals) {
+				t.Fatalf("section lengths do not match the header counts %+v", packet.Header)
+			}
+		}
+		names := make([][]byte, 0, len(packet.Questions))
+		for _, question := range packet.Questions {
+			names = append(names, question.Name)
+		}
+		for _, section := range [][]DNSRecord{packet.Answers, packet.Authorities, packet.Additionals} {
+			for _, record := range section {
+				names = append(names, record.Name)
+			}
+		}
+		for _, name := range names {
+			if len(name) > MaxNameLength {
+				t.Fatalf("parsed a name of %d bytes", len(name))
+			}
+			for _, label := range strings.Split(string(name), ".") {
+				if len(label) > MaxLabelLength {
+					t.Fatalf("parsed a label of %d bytes", len(label))
+				}
+			}
+		}
+	})
+}
+
+// validWireName is an independent check of an uncompressed wire format name: labels of at most
+// 63 bytes, 255 bytes in all, ending in the root label
+func validWireName(data []byte) bool {
+	for off := 0; off < len(data); {
+		length := int(data[off])
+		if length == 0 {
+			return off+1 <= MaxNameLength
+		}
+		if length > MaxLabelLength || off+1+length > len(data) {
+			return false
+		}
+		off += 1 + length
+	}
+	return false
+}
+
+func FuzzDecodeNSName(f *testing.F) {
+	for _, name := range []string{"", "com", "a.gtld-servers.net", "a.iana-servers.net"} {
+		f.Add(EncodeName(name))
+	}
+	for _, record := range mustParse(f, recordedPackets(f)["root-referral"]).Authorities {
+		f.Add(record.Data)
+	}
+	f.Add([]byte{0xC0, 0x0C})
+	f.Add(append([]byte{64}, bytes.Repeat([]byte{'a'}, 64)...))
+	f.Add(append(bytes.Repeat(append([]byte{63}, bytes.Repeat([]byte{'a'}, 63)...), 4), 0))
+	f.Add([]byte{5, 'a', 'b'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := DecodeNSName(data)
+		if len(decoded) > len(data) {
+			t.Fatalf("decoded %d bytes from %d", len(decoded), len(data))
+		}
+
+		// Read the same bytes as a name inside a message. Its header is all 0xFF, so any
+		// pointer ends in one that does not point backwards, and only plain names can succeed.
+		message := append(bytes.Repeat([]byte{0xFF}, headerSize), data...)
+		m := Message{buf: message}
+		appended, err := m.AppendName(nil, headerSize)
+		if !validWireName(data) {
+			if err == nil {
+				t.Fatalf("AppendName accepted the invalid name %x", data)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("AppendName rejected the valid name %x: %v", data, err)
+		}
+		if decoded != string(appended) {
+			t.Fatalf("DecodeNSName = %q, AppendName = %q", decoded, appended)
+		}
+	})
+}
+
+func mustParse(tb testing.TB, packet []byte) *DNSPacket {
+	tb.Helper()
+	parsed, err := ParseDNSResponse(packet)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return parsed
+}
+
+func BenchmarkParseDNSResponse(b *testing.B) {
+	for name, packet := range recordedPackets(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(packet)))
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseDNSResponse(packet); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package query
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TSIG from RFC 8945 authenticates a message with a secret shared between client and server.
+// The signature is a TSIG record appended to the additional section, and covers the message
+// without it along with the record's own fields. A response is signed over the MAC of the
+// request as well, which ties the two together.
+
+// HMACSHA256 is the only TSIG algorithm we implement
+const HMACSHA256 = "hmac-sha256"
+
+// DefaultFudge is how many seconds the clocks of signer and verifier may differ by
+const DefaultFudge uint16 = 300
+
+// TSIG error codes, sent in the TSIG record of a NOTAUTH response
+const (
+	TSIG_BADSIG  uint16 = 16
+	TSIG_BADKEY  uint16 = 17
+	TSIG_BADTIME uint16 = 18
+)
+
+// TSIGKey is a shared secret and the name both sides know it by
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+// ParseTSIGKey reads a key given as [algorithm:]name:secret with the secret in base64, the
+// form nsupdate -y takes
+func ParseTSIGKey(spec string) (TSIGKey, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 2 {
+		parts = append([]string{HMACSHA256}, parts...)
+	}
+	if len(parts) != 3 || parts[1] == "" {
+		return TSIGKey{}, fmt.Errorf("TSIG key %q is not [algorithm:]name:secret", spec)
+	}
+	algorithm := strings.ToLower(strings.TrimSuffix(parts[0], "."))
+	if algorithm != HMACSHA256 {
+		return TSIGKey{}, fmt.Errorf("unsupported TSIG algorithm %s", parts[0])
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return TSIGKey{}, fmt.Errorf("TSIG key %s: decoding secret: %w", parts[1], err)
+	}
+	return TSIGKey{Name: canonicalName(parts[1]), Algorithm: algorithm, Secret: secret}, nil
+}
+
+// TSIG is the decoded data of a TSIG record
+type TSIG struct {
+	KeyName    string
+	Algorithm  string
+	TimeSigned uint64 // seconds since the epoch, 48 bits on the wire
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	Other      []byte
+}
+
+// TSIGError is a failed TSIG check. Code is the TSIG error the server reports for it.
+type TSIGError struct {
+	Code   uint16
+	Detail string
+}
+
+func (e *TSIGError) Error() string {
+	return fmt.Sprintf("TSIG %s: %s", e.CodeName(), e.Detail)
+}
+
+// CodeName returns the mnemonic of the TSIG error code
+func (e *TSIGError) CodeName() string {
+	switch e.Code {
+	case TSIG_BADSIG:
+		return "BADSIG"
+	case TSIG_BADKEY:
+		return "BADKEY"
+	case TSIG_BADTIME:
+		return "BADTIME"
+	}
+	return RcodeName(e.Code)
+}
+
+// SignTSIG appends a TSIG record signed with key to message and returns the signed message
+// and its MAC. requestMAC is the MAC of the request when message is a response to a signed
+// request, nil otherwise.
+func SignTSIG(message []byte, key TSIGKey, requestMAC []byte, now time.Time) ([]byte, []byte, error) {
+	if len(message) < headerSize {
+		return nil, nil, fmt.Errorf("message of %d bytes is shorter than a header", len(message))
+	}
+	tsig := TSIG{
+		KeyName:    canonicalName(key.Name),
+		Algorithm:  HMACSHA256,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      DefaultFudge,
+		OriginalID: binary.BigEndian.Uint16(message[0:2]),
+	}
+	tsig.MAC = tsigMAC(key, requestMAC, message, tsig)
+	return appendTSIG(message, tsig), tsig.MAC, nil
+}
+
+// TSIGErrorResponse appends the TSIG record that tells a client why its request failed
+// verification to response, which should carry RCODE_NOTAUTH. Only BADTIME responses are
+// signed, as for the others the server does not know or cannot trust the key.
+func TSIGErrorResponse(response []byte, request *TSIG, key TSIGKey, tsigErr *TSIGError, now time.Time) []byte {
+	tsig := TSIG{
+		KeyName:    request.KeyName,
+		Algorithm:  request.Algorithm,
+		TimeSigned: request.TimeSigned,
+		Fudge:      request.Fudge,
+		OriginalID: binary.BigEndian.Uint16(response[0:2]),
+		Error:      tsigErr.Code,
+	}
+	if tsigErr.Code == TSIG_BADTIME {
+		// The client learns our clock from the other data
+		tsig.TimeSigned = uint64(now.Unix())
+		tsig.Other = appendTime48(nil, tsig.TimeSigned)
+		tsig.MAC = tsigMAC(key, request.MAC, response, tsig)
+	}
+	return appendTSIG(response, tsig)
+}
+
+// VerifyTSIG checks the TSIG record of message against the key of the same name in keys. An
+// unsigned message returns nil without an error. A message that fails verification returns
+// its TSIG, so a server can answer with TSIGErrorResponse, and a *TSIGError.
+func VerifyTSIG(message []byte, keys map[string]TSIGKey, requestMAC []byte, now time.Time) (*TSIG, error) {
+	unsigned, tsig, err := splitTSIG(message)
+	if err != nil || tsig == nil {
+		return nil, err
+	}
+	key, ok := keys[tsig.KeyName]
+	if !ok || tsig.Algorithm != key.Algorithm {
+		return tsig, &TSIGError{Code: TSIG_BADKEY, Detail: fmt.Sprintf("unknown key %s with algorithm %s", tsig.KeyName, tsig.Algorithm)}
+	}
+	// A server that could not check our request answers with an error and no MAC
+	if tsig.Error != 0 && len(tsig.MAC) == 0 {
+		return tsig, &TSIGError{Code: tsig.Error, Detail: "the other side rejected the signature"}
+	}
+	expected := tsigMAC(key, requestMAC, unsigned, *tsig)
+	if !hmac.Equal(tsig.MAC, expected) {
+		return tsig, &TSIGError{Code: TSIG_BADSIG, Detail: fmt.Sprintf("MAC does not match key %s", tsig.KeyName)}
+	}
+	// The time is only checked once the MAC shows it was not tampered with
+	if skew := now.Unix() - int64(tsig.TimeSigned); skew > int64(tsig.Fudge) || -skew > int64(tsig.Fudge) {
+		return tsig, &TSIGError{Code: TSIG_BADTIME, Detail: fmt.Sprintf("signed %d seconds away from our clock, fudge is %d", skew, tsig.Fudge)}
+	}
+	if tsig.Error != 0 {
+		return tsig, &TSIGError{Code: tsig.Error, Detail: "the other side rejected the signature"}
+	}
+	return tsig, nil
+}
+
+// splitTSIG finds the TSIG record, which must be the last record of message, and returns the
+// message as it was before signing: without the record, with one fewer additional record and
+// with the original ID
+func splitTSIG(message []byte) ([]byte, *TSIG, error) {
+	var m Message
+	if err := m.Reset(message); err != nil {
+		return nil, nil, err
+	}
+	var last Record
+	found := false
+	for {
+		record, ok, err := m.NextRecord()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		if found {
+			return nil, nil, fmt.Errorf("TSIG record is not the last record of the message")
+		}
+		if record.Type == TYPE_TSIG {
+			if record.Section != SectionAdditional {
+				return nil, nil, fmt.Errorf("TSIG record outside the additional section")
+			}
+			last, found = record, true
+		}
+	}
+	if !found {
+		return nil, nil, nil
+	}
+
+	keyName, err := m.AppendName(nil, last.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	tsig, err := decodeTSIG(last.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	tsig.KeyName = canonicalName(string(keyName))
+
+	unsigned := append([]byte{}, message[:last.Name]...)
+	binary.BigEndian.PutUint16(unsigned[0:2], tsig.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:12], m.Header.NumAdditionals-1)
+	return unsigned, tsig, nil
+}
+
+// decodeTSIG decodes TSIG record data, whose algorithm name is never compressed
+func decodeTSIG(data []byte) (*TSIG, error) {
+	nameLen, err := nameLength(data)
+	if err != nil {
+		return nil, err
+	}
+	tsig := &TSIG{Algorithm: canonicalName(DecodeNSName(data[:nameLen]))}
+	rest := data[nameLen:]
+	if len(rest) < 10 {
+		return nil, fmt.Errorf("TSIG data too short")
+	}
+	tsig.TimeSigned = uint64(binary.BigEndian.Uint16(rest[0:2]))<<32 | uint64(binary.BigEndian.Uint32(rest[2:6]))
+	tsig.Fudge = binary.BigEndian.Uint16(rest[6:8])
+	macLen := int(binary.BigEndian.Uint16(rest[8:10]))
+	rest = rest[10:]
+	if len(rest) < macLen+6 {
+		return nil, fmt.Errorf("TSIG MAC runs past the end of the record data")
+	}
+	tsig.MAC = rest[:macLen]
+	rest = rest[macLen:]
+	tsig.OriginalID = binary.BigEndian.Uint16(rest[0:2])
+	tsig.Error = binary.BigEndian.Uint16(rest[2:4])
+	otherLen := int(binary.BigEndian.Uint16(rest[4:6]))
+	if len(rest) != 6+otherLen {
+		return nil, fmt.Errorf("TSIG other data does not match its length")
+	}
+	tsig.Other = rest[6:]
+	return tsig, nil
+}
+
+// tsigMAC computes the MAC of an unsigned message and the fields of its TSIG record
+func tsigMAC(key TSIGKey, requestMAC []byte, unsigned []byte, tsig TSIG) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	if requestMAC != nil {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(unsigned)
+	// The TSIG variables: the record's name, class and TTL, then its data without the MAC and original ID
+	variables := encodeDNSName(tsig.KeyName)
+	variables = binary.BigEndian.AppendUint16(variables, CLASS_ANY)
+	variables = binary.BigEndian.AppendUint32(variables, 0)
+	variables = append(variables, encodeDNSName(tsig.Algorithm)...)
+	variables = appendTime48(variables, tsig.TimeSigned)
+	variables = binary.BigEndian.AppendUint16(variables, tsig.Fudge)
+	variables = binary.BigEndian.AppendUint16(variables, tsig.Error)
+	variables = binary.BigEndian.AppendUint16(variables, uint16(len(tsig.Other)))
+	variables = append(variables, tsig.Other...)
+	mac.Write(variables)
+	return mac.Sum(nil)
+}
+
+// appendTSIG adds tsig to message as the last additional record
+func appendTSIG(message []byte, tsig TSIG) []byte {
+	data := encodeDNSName(tsig.Algorithm)
+	data = appendTime48(data, tsig.TimeSigned)
+	data = binary.BigEndian.AppendUint16(data, tsig.Fudge)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(tsig.MAC)))
+	data = append(data, tsig.MAC...)
+	data = binary.BigEndian.AppendUint16(data, tsig.OriginalID)
+	data = binary.BigEndian.AppendUint16(data, tsig.Error)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(tsig.Other)))
+	data = append(data, tsig.Other...)
+
+	signed := append([]byte{}, message...)
+	binary.BigEndian.PutUint16(signed[10:12], binary.BigEndian.Uint16(signed[10:12])+1)
+	return append(signed, recordToBytes(DNSRecord{Name: []byte(tsig.KeyName), Type: TYPE_TSIG, Class: CLASS_ANY, Data: data})...)
+}
+
+func appendTime48(b []byte, t uint64) []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(b, uint16(t>>32)), uint32(t))
+}
+
+// canonicalName lowercases a name and drops the trailing dot, as TSIG compares key and
+// algorithm names case insensitively
+func canonicalName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
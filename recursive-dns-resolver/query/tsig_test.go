@@ -0,0 +1,156 @@
+package query
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testKey = TSIGKey{Name: "update-key.example.com", Algorithm: HMACSHA256, Secret: []byte("0123456789abcdef0123456789abcdef")}
+
+func testKeys() map[string]TSIGKey {
+	return map[string]TSIGKey{testKey.Name: testKey}
+}
+
+// signedRequest returns a signed query for example.com and the MAC of its signature
+func signedRequest(t *testing.T, now time.Time) ([]byte, []byte) {
+	t.Helper()
+	request := PacketToBytes(DNSPacket{
+		Header:    DNSHeader{ID: 0x1234, NumQuestions: 1},
+		Questions: []DNSQuestion{{Name: []byte("example.com"), Type: TYPE_SOA, Class: CLASS_IN}},
+	})
+	signed, mac, err := SignTSIG(request, testKey, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed, mac
+}
+
+// tsigCode returns the TSIG error code of err, or -1 if err is not a *TSIGError
+func tsigCode(err error) int {
+	var tsigErr *TSIGError
+	if !errors.As(err, &tsigErr) {
+		return -1
+	}
+	return int(tsigErr.Code)
+}
+
+func TestTSIGRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signed, mac := signedRequest(t, now)
+	tsig, err := VerifyTSIG(signed, testKeys(), nil, now)
+	if err != nil {
+		t.Fatalf("verifying a signed request: %v", err)
+	}
+	if tsig == nil || tsig.KeyName != testKey.Name || !bytes.Equal(tsig.MAC, mac) || tsig.OriginalID != 0x1234 {
+		t.Fatalf("verified TSIG = %+v", tsig)
+	}
+
+	// The response is signed over the request MAC, and only verifies against it
+	response := PacketToBytes(DNSPacket{
+		Header:    DNSHeader{ID: 0x1234, Flags: FLAG_QR | FLAG_AA, NumQuestions: 1},
+		Questions: []DNSQuestion{{Name: []byte("example.com"), Type: TYPE_SOA, Class: CLASS_IN}},
+	})
+	signedResponse, _, err := SignTSIG(response, testKey, mac, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyTSIG(signedResponse, testKeys(), mac, now); err != nil {
+		t.Errorf("verifying the response over the request MAC: %v", err)
+	}
+	if _, err := VerifyTSIG(signedResponse, testKeys(), nil, now); tsigCode(err) != int(TSIG_BADSIG) {
+		t.Errorf("verifying the response without the request MAC gave %v, want BADSIG", err)
+	}
+	otherMAC := append([]byte{}, mac...)
+	otherMAC[0] ^= 1
+	if _, err := VerifyTSIG(signedResponse, testKeys(), otherMAC, now); tsigCode(err) != int(TSIG_BADSIG) {
+		t.Errorf("verifying the response over another request MAC gave %v, want BADSIG", err)
+	}
+}
+
+func TestVerifyTSIGErrors(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signed, _ := signedRequest(t, now)
+	tampered := append([]byte{}, signed...)
+	tampered[13] = 'E' // the first letter of example.com
+
+	tests := []struct {
+		name    string
+		message []byte
+		keys    map[string]TSIGKey
+		now     time.Time
+		code    uint16
+	}{
+		{"tampered message", tampered, testKeys(), now, TSIG_BADSIG},
+		{"wrong secret", signed, map[string]TSIGKey{testKey.Name: {Name: testKey.Name, Algorithm: HMACSHA256, Secret: []byte("another secret")}}, now, TSIG_BADSIG},
+		{"unknown key", signed, map[string]TSIGKey{"other-key": testKey}, now, TSIG_BADKEY},
+		{"other algorithm", signed, map[string]TSIGKey{testKey.Name: {Name: testKey.Name, Algorithm: "hmac-sha512", Secret: testKey.Secret}}, now, TSIG_BADKEY},
+		{"signed too long ago", signed, testKeys(), now.Add(time.Duration(DefaultFudge+1) * time.Second), TSIG_BADTIME},
+		{"signed in the future", signed, testKeys(), now.Add(-time.Duration(DefaultFudge+1) * time.Second), TSIG_BADTIME},
+	}
+	for _, test := range tests {
+		tsig, err := VerifyTSIG(test.message, test.keys, nil, test.now)
+		if tsigCode(err) != int(test.code) {
+			t.Errorf("%s: got %v, want TSIG error %d", test.name, err, test.code)
+		}
+		if tsig == nil {
+			t.Errorf("%s: no TSIG returned to answer the error with", test.name)
+		}
+	}
+
+	if _, err := VerifyTSIG(signed, testKeys(), nil, now.Add(time.Duration(DefaultFudge)*time.Second)); err != nil {
+		t.Errorf("a signature exactly fudge seconds old failed: %v", err)
+	}
+}
+
+func TestVerifyTSIGUnsigned(t *testing.T) {
+	tsig, err := VerifyTSIG(BuildQuery("example.com", TYPE_A), testKeys(), nil, time.Now())
+	if tsig != nil || err != nil {
+		t.Errorf("unsigned message gave %+v, %v", tsig, err)
+	}
+}
+
+// A BADTIME error response is signed, so the client can trust the time it carries
+func TestTSIGErrorResponseBadTime(t *testing.T) {
+	signedAt := time.Unix(1700000000, 0)
+	serverNow := signedAt.Add(time.Hour)
+	signed, mac := signedRequest(t, signedAt)
+	request, verifyErr := VerifyTSIG(signed, testKeys(), nil, serverNow)
+	var tsigErr *TSIGError
+	if !errors.As(verifyErr, &tsigErr) || tsigErr.Code != TSIG_BADTIME {
+		t.Fatalf("verifying a stale request gave %v", verifyErr)
+	}
+
+	response := PacketToBytes(DNSPacket{Header: DNSHeader{ID: 0x1234, Flags: FLAG_QR | RCODE_NOTAUTH}})
+	response = TSIGErrorResponse(response, request, testKey, tsigErr, serverNow)
+	tsig, err := VerifyTSIG(response, testKeys(), mac, serverNow)
+	if tsigCode(err) != int(TSIG_BADTIME) {
+		t.Fatalf("client verification gave %v, want BADTIME", err)
+	}
+	if !bytes.Equal(tsig.Other, appendTime48(nil, uint64(serverNow.Unix()))) {
+		t.Errorf("other data %x does not carry the server time %d", tsig.Other, serverNow.Unix())
+	}
+
+	// BADSIG and BADKEY responses carry no MAC
+	response = PacketToBytes(DNSPacket{Header: DNSHeader{ID: 0x1234, Flags: FLAG_QR | RCODE_NOTAUTH}})
+	response = TSIGErrorResponse(response, request, testKey, &TSIGError{Code: TSIG_BADSIG}, serverNow)
+	if _, err := VerifyTSIG(response, testKeys(), mac, serverNow); tsigCode(err) != int(TSIG_BADSIG) {
+		t.Errorf("unsigned BADSIG response gave %v", err)
+	}
+}
+
+func TestParseTSIGKey(t *testing.T) {
+	key, err := ParseTSIGKey("hmac-sha256:Update-Key.Example.com.:MDEyMzQ1Njc4OWFiY2RlZg==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Name != "update-key.example.com" || string(key.Secret) != "0123456789abcdef" {
+		t.Errorf("parsed %+v", key)
+	}
+	for _, spec := range []string{"name", "hmac-md5:name:MDEy", "name:not base64!", ":MDEy"} {
+		if _, err := ParseTSIGKey(spec); err == nil {
+			t.Errorf("ParseTSIGKey(%q) succeeded", spec)
+		}
+	}
+}
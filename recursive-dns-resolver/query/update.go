@@ -0,0 +1,89 @@
+package query
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// Update builds a dynamic update message (RFC 2136). The zone section takes the place of the
+// question, the prerequisites that of the answers and the updates that of the authority
+// section. The server applies the updates only if every prerequisite holds.
+type Update struct {
+	Zone          string
+	Prerequisites []DNSRecord
+	Updates       []DNSRecord
+}
+
+// NewUpdate starts an empty update of zone
+func NewUpdate(zone string) *Update {
+	return &Update{Zone: strings.Trim(zone, ".")}
+}
+
+// NameInUse requires that name has at least one record of any type
+func (u *Update) NameInUse(name string) {
+	u.Prerequisites = append(u.Prerequisites, emptyRecord(name, TYPE_ANY, CLASS_ANY))
+}
+
+// NameNotInUse requires that name has no records at all
+func (u *Update) NameNotInUse(name string) {
+	u.Prerequisites = append(u.Prerequisites, emptyRecord(name, TYPE_ANY, CLASS_NONE))
+}
+
+// RRsetExists requires that name has records of recordType, whatever their data
+func (u *Update) RRsetExists(name string, recordType uint16) {
+	u.Prerequisites = append(u.Prerequisites, emptyRecord(name, recordType, CLASS_ANY))
+}
+
+// RRsetExistsWith requires that the records of that name and type are exactly those given
+// with this call, so it is called once for every record of the set
+func (u *Update) RRsetExistsWith(record DNSRecord) {
+	record.Class, record.TTL = CLASS_IN, 0
+	u.Prerequisites = append(u.Prerequisites, record)
+}
+
+// RRsetNotExists requires that name has no records of recordType
+func (u *Update) RRsetNotExists(name string, recordType uint16) {
+	u.Prerequisites = append(u.Prerequisites, emptyRecord(name, recordType, CLASS_NONE))
+}
+
+// Add adds record to the zone. A record that is already there is left alone.
+func (u *Update) Add(record DNSRecord) {
+	record.Class = CLASS_IN
+	u.Updates = append(u.Updates, record)
+}
+
+// Delete removes the one record with the name, type and data of record
+func (u *Update) Delete(record DNSRecord) {
+	record.Class, record.TTL = CLASS_NONE, 0
+	u.Updates = append(u.Updates, record)
+}
+
+// DeleteRRset removes every record of recordType from name
+func (u *Update) DeleteRRset(name string, recordType uint16) {
+	u.Updates = append(u.Updates, emptyRecord(name, recordType, CLASS_ANY))
+}
+
+// DeleteName removes every record of name
+func (u *Update) DeleteName(name string) {
+	u.Updates = append(u.Updates, emptyRecord(name, TYPE_ANY, CLASS_ANY))
+}
+
+// Packet returns the update as a message with a random ID
+func (u *Update) Packet() DNSPacket {
+	return DNSPacket{
+		Header:      DNSHeader{ID: uint16(rand.Intn(65536)), Flags: OPCODE_UPDATE << 11},
+		Questions:   []DNSQuestion{{Name: []byte(u.Zone), Type: TYPE_SOA, Class: CLASS_IN}},
+		Answers:     u.Prerequisites,
+		Authorities: u.Updates,
+	}
+}
+
+// Bytes returns the update in wire format, ready to be signed and sent
+func (u *Update) Bytes() []byte {
+	return PacketToBytes(u.Packet())
+}
+
+// emptyRecord is the form of prerequisite and deletion that carries no data
+func emptyRecord(name string, recordType uint16, class uint16) DNSRecord {
+	return DNSRecord{Name: []byte(strings.Trim(name, ".")), Type: recordType, Class: class}
+}
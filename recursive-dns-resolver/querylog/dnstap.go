@@ -0,0 +1,225 @@
+package querylog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// dnstap (https://dnstap.info) messages are protocol buffers carried in a Frame Streams
+// stream. Both are simple enough to write by hand, which keeps us on the standard library.
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types
+const (
+	controlAccept uint32 = 0x01
+	controlStart  uint32 = 0x02
+	controlStop   uint32 = 0x03
+	controlReady  uint32 = 0x04
+	controlFinish uint32 = 0x05
+
+	controlFieldContentType uint32 = 0x01
+)
+
+// FrameWriter writes a Frame Streams data stream to a file or a unix socket
+type FrameWriter struct {
+	w             io.WriteCloser
+	bidirectional bool
+}
+
+// OpenFrameWriter opens a dnstap output. "unix:/path" connects to a unix socket and does the
+// bidirectional handshake with the collector, anything else is a file that is created.
+func OpenFrameWriter(target string) (*FrameWriter, error) {
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		conn, err := net.DialTimeout("unix", path, 5*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to dnstap socket: %w", err)
+		}
+		frames := &FrameWriter{w: conn, bidirectional: true}
+		if err := frames.handshake(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return frames, nil
+	}
+
+	file, err := os.Create(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dnstap file: %w", err)
+	}
+	frames := &FrameWriter{w: file}
+	if err := frames.writeControl(controlStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return frames, nil
+}
+
+// handshake sends READY, waits for the collector to ACCEPT our content type, then sends START
+func (f *FrameWriter) handshake(conn net.Conn) error {
+	if err := f.writeControl(controlReady); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	if controlType, err := readControl(conn); err != nil {
+		return fmt.Errorf("reading dnstap ACCEPT: %w", err)
+	} else if controlType != controlAccept {
+		return fmt.Errorf("dnstap collector answered control frame %d instead of ACCEPT", controlType)
+	}
+	return f.writeControl(controlStart)
+}
+
+// writeControl writes a control frame carrying our content type
+func (f *FrameWriter) writeControl(controlType uint32) error {
+	var frame []byte
+	frame = binary.BigEndian.AppendUint32(frame, controlType)
+	if controlType != controlStop && controlType != controlFinish {
+		frame = binary.BigEndian.AppendUint32(frame, controlFieldContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(dnstapContentType)))
+		frame = append(frame, dnstapContentType...)
+	}
+	// An escape (zero length) tells the reader a control frame follows
+	header := binary.BigEndian.AppendUint32(nil, 0)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(frame)))
+	_, err := f.w.Write(append(header, frame...))
+	return err
+}
+
+// readControl reads one control frame and returns its type
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != 0 {
+		return 0, fmt.Errorf("expected a control frame")
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if len(frame) < 4 {
+		return 0, fmt.Errorf("control frame too short")
+	}
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(frame[0:4]), nil
+}
+
+// WriteFrame writes one data frame
+func (f *FrameWriter) WriteFrame(data []byte) error {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	_, err := f.w.Write(append(frame, data...))
+	return err
+}
+
+// Close ends the stream with STOP (and waits for FINISH on a socket) and closes the output
+func (f *FrameWriter) Close() error {
+	err := f.writeControl(controlStop)
+	if err == nil && f.bidirectional {
+		if conn, ok := f.w.(net.Conn); ok {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			readControl(conn)
+		}
+	}
+	if closeErr := f.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// dnstap message types and enums used below
+const (
+	dnstapTypeMessage       = 1
+	messageResolverResponse = 4
+	messageClientResponse   = 6
+	socketFamilyINET        = 1
+	socketFamilyINET6       = 2
+	socketProtocolUDP       = 1
+	socketProtocolTCP       = 2
+)
+
+// protobuf wire helpers: fields are written as tag varint followed by the value
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3|0)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendVarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+// encodeDnstap builds a dnstap.Dnstap protobuf message for an event
+func encodeDnstap(event Event) []byte {
+	var message []byte
+	messageType := messageResolverResponse
+	peer := event.Server
+	if event.Kind == ClientResponse {
+		messageType = messageClientResponse
+		peer = event.Client
+	}
+	message = appendVarintField(message, 1, uint64(messageType))
+
+	ip, port := splitAddr(peer)
+	family := socketFamilyINET
+	if ip != nil && ip.To4() == nil {
+		family = socketFamilyINET6
+	}
+	protocol := socketProtocolUDP
+	if event.Protocol == "tcp" {
+		protocol = socketProtocolTCP
+	}
+	message = appendVarintField(message, 2, uint64(family))
+	message = appendVarintField(message, 3, uint64(protocol))
+	if ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		// Clients send queries to us, for upstream queries the server is the responder
+		if messageType == messageClientResponse {
+			message = appendBytesField(message, 4, ip)
+			message = appendVarintField(message, 6, uint64(port))
+		} else {
+			message = appendBytesField(message, 5, ip)
+			message = appendVarintField(message, 7, uint64(port))
+		}
+	}
+
+	queryTime := event.Time
+	responseTime := event.Time.Add(time.Duration(event.RTT * float64(time.Millisecond)))
+	message = appendVarintField(message, 8, uint64(queryTime.Unix()))
+	message = appendFixed32Field(message, 9, uint32(queryTime.Nanosecond()))
+	if len(event.Query) > 0 {
+		message = appendBytesField(message, 10, event.Query)
+	}
+	message = appendVarintField(message, 12, uint64(responseTime.Unix()))
+	message = appendFixed32Field(message, 13, uint32(responseTime.Nanosecond()))
+	if len(event.Response) > 0 {
+		message = appendBytesField(message, 14, event.Response)
+	}
+
+	var dnstap []byte
+	dnstap = appendBytesField(dnstap, 1, []byte("recursive-dns-resolver"))
+	dnstap = appendBytesField(dnstap, 14, message)
+	dnstap = appendVarintField(dnstap, 15, dnstapTypeMessage)
+	return dnstap
+}
@@ -0,0 +1,114 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Kinds of events. They follow the dnstap message types of the same name.
+const (
+	ClientResponse   = "CLIENT_RESPONSE"   // a client's query and what we answered
+	ResolverResponse = "RESOLVER_RESPONSE" // one query we sent to an authoritative server and its answer
+)
+
+// Event describes one query and its response
+type Event struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	QName    string    `json:"qname"`
+	QType    string    `json:"qtype"`
+	Client   string    `json:"client,omitempty"`
+	Server   string    `json:"server,omitempty"`
+	Protocol string    `json:"protocol"`
+	RTT      float64   `json:"rtt_ms"`
+	Rcode    string    `json:"rcode,omitempty"`
+	Cache    string    `json:"cache,omitempty"` // "hit" or "miss" for client queries
+	Error    string    `json:"error,omitempty"`
+	Policy   string    `json:"policy,omitempty"` // the blocklist decision for a client query, if any
+	// Sizes of the wire format messages, and the messages themselves for dnstap
+	QueryBytes    int    `json:"query_bytes"`
+	ResponseBytes int    `json:"response_bytes"`
+	Query         []byte `json:"-"`
+	Response      []byte `json:"-"`
+}
+
+// Logger writes events as JSON lines and, optionally, as dnstap frames. A nil *Logger
+// discards everything, so callers do not need to check whether logging is on.
+type Logger struct {
+	mutex  sync.Mutex
+	json   io.Writer
+	dnstap *FrameWriter
+	// SampleRate is the fraction of events that are logged, between 0 and 1
+	SampleRate float64
+	// ErrorLog receives the errors writing the dnstap output
+	ErrorLog *log.Logger
+}
+
+// New creates a Logger writing JSON lines to w. w may be nil when only dnstap output is wanted.
+func New(w io.Writer, sampleRate float64) *Logger {
+	return &Logger{json: w, SampleRate: sampleRate, ErrorLog: log.Default()}
+}
+
+// SetDnstap sends every sampled event to a dnstap frame stream as well
+func (l *Logger) SetDnstap(frames *FrameWriter) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.dnstap = frames
+}
+
+// Log records an event, subject to sampling
+func (l *Logger) Log(event Event) {
+	if l == nil || (l.SampleRate < 1 && rand.Float64() >= l.SampleRate) {
+		return
+	}
+	if event.QueryBytes == 0 {
+		event.QueryBytes = len(event.Query)
+	}
+	if event.ResponseBytes == 0 {
+		event.ResponseBytes = len(event.Response)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.json != nil {
+		line, err := json.Marshal(event)
+		if err == nil {
+			l.json.Write(append(line, '\n'))
+		}
+	}
+	if l.dnstap != nil {
+		if err := l.dnstap.WriteFrame(encodeDnstap(event)); err != nil {
+			l.ErrorLog.Printf("Error writing dnstap frame: %v", err)
+		}
+	}
+}
+
+// Close flushes and closes the dnstap output, if any
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.dnstap == nil {
+		return nil
+	}
+	return l.dnstap.Close()
+}
+
+// splitAddr breaks "host:port" into an IP and port, as dnstap wants them
+func splitAddr(addr string) (net.IP, uint32) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.ParseIP(addr), 53
+	}
+	var p uint32
+	fmt.Sscanf(port, "%d", &p)
+	return net.ParseIP(host), p
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// reloadCommand asks a running server to read its blocklists again
+func reloadCommand(args []string) {
+	flags := flag.NewFlagSet("reload", flag.ExitOnError)
+	addr := flags.String("metrics", "127.0.0.1:9153", "HTTP address the server was started with")
+	flags.Parse(args)
+
+	response, err := http.Post("http://"+*addr+"/blocklist/reload", "", nil)
+	if err != nil {
+		fmt.Println("Error reloading blocklists:", err)
+		os.Exit(1)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		fmt.Println("Error reloading blocklists:", strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+	fmt.Print(string(body))
+}
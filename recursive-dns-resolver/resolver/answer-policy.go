@@ -0,0 +1,168 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+	"strconv"
+	"strings"
+)
+
+// defaultOverrideTTL is the TTL of an override that does not give one
+const defaultOverrideTTL = 300
+
+// AnswerPolicy rewrites the answers authoritative servers give before they are cached and
+// returned. Answers from the hosts file and mDNS are local and left alone.
+type AnswerPolicy struct {
+	// MinTTL and MaxTTL clamp the TTL of every answer record. 0 leaves that side unbounded.
+	MinTTL uint32
+	MaxTTL uint32
+	// StripPrivate removes A and AAAA records with private, loopback, link-local or
+	// unspecified addresses, so a public name cannot be pointed into the local network (DNS
+	// rebinding). Names at or below PrivateDomains may still resolve to them.
+	StripPrivate   bool
+	PrivateDomains []string
+	// overrides replace the answer for a name and type, by lower-case name|type
+	overrides map[string][]query.DNSRecord
+}
+
+// ParseOverride parses an override written like a zone file record without its class:
+// name [ttl] type data, e.g. "intranet.example.com A 10.1.2.3"
+func ParseOverride(spec string) (query.DNSRecord, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 3 {
+		return query.DNSRecord{}, fmt.Errorf("override %q is not name [ttl] type data", spec)
+	}
+	record := query.DNSRecord{Name: []byte(strings.ToLower(strings.Trim(fields[0], "."))), Class: query.CLASS_IN, TTL: defaultOverrideTTL}
+	rest := fields[1:]
+	if ttl, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+		record.TTL, rest = uint32(ttl), rest[1:]
+	}
+	if len(rest) < 2 {
+		return query.DNSRecord{}, fmt.Errorf("override %q is not name [ttl] type data", spec)
+	}
+	for recordType, name := range query.TypeNames {
+		if strings.EqualFold(rest[0], name) {
+			record.Type = recordType
+		}
+	}
+	if record.Type == 0 {
+		return query.DNSRecord{}, fmt.Errorf("override %q has unknown record type %s", spec, rest[0])
+	}
+	data, err := query.ParseRecordData(record.Type, rest[1:])
+	if err != nil {
+		return query.DNSRecord{}, fmt.Errorf("override %q: %w", spec, err)
+	}
+	record.Data = data
+	return record, nil
+}
+
+// AddOverride makes record part of the answer for its name and type in place of whatever the
+// authoritative servers say. Several records for the same name and type form one answer.
+func (p *AnswerPolicy) AddOverride(record query.DNSRecord) {
+	if p.overrides == nil {
+		p.overrides = make(map[string][]query.DNSRecord)
+	}
+	key := overrideKey(string(record.Name), record.Type)
+	p.overrides[key] = append(p.overrides[key], record)
+}
+
+func overrideKey(name string, recordType uint16) string {
+	return strings.ToLower(strings.Trim(name, ".")) + "|" + strconv.Itoa(int(recordType))
+}
+
+// apply rewrites a result in place. TTLs are clamped and private addresses stripped first, so
+// an override may still answer with a private address on purpose.
+func (p *AnswerPolicy) apply(result *Result) {
+	if p == nil {
+		return
+	}
+	records := make([]query.DNSRecord, 0, len(result.Records))
+	for _, record := range result.Records {
+		if p.StripPrivate && p.isRebinding(record) {
+			policyRewrites.Inc("strip_private")
+			continue
+		}
+		if p.MinTTL > 0 && record.TTL < p.MinTTL {
+			record.TTL = p.MinTTL
+			policyRewrites.Inc("min_ttl")
+		}
+		if p.MaxTTL > 0 && record.TTL > p.MaxTTL {
+			record.TTL = p.MaxTTL
+			policyRewrites.Inc("max_ttl")
+		}
+		records = append(records, record)
+	}
+	result.Records = p.override(result.Name, result.Type, records, &result.Rcode)
+}
+
+// isRebinding reports whether record is an address record pointing into a private network
+// for a name that is not allowed to
+func (p *AnswerPolicy) isRebinding(record query.DNSRecord) bool {
+	if record.Type != query.TYPE_A && record.Type != query.TYPE_AAAA {
+		return false
+	}
+	ip := net.IP(record.Data)
+	if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() {
+		return false
+	}
+	for _, domain := range p.PrivateDomains {
+		if inBailiwick(string(record.Name), domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the override for name and type, so Lookup answers it without recursing
+func (p *AnswerPolicy) lookup(name string, recordType uint16) ([]query.DNSRecord, bool) {
+	if p == nil {
+		return nil, false
+	}
+	return p.overrideFor(strings.ToLower(strings.Trim(name, ".")), recordType)
+}
+
+// overrideFor returns copies of the override records for owner and type, named owner
+func (p *AnswerPolicy) overrideFor(owner string, recordType uint16) ([]query.DNSRecord, bool) {
+	replacement, ok := p.overrides[overrideKey(owner, recordType)]
+	if !ok {
+		return nil, false
+	}
+	policyRewrites.Inc("override")
+	records := make([]query.DNSRecord, 0, len(replacement))
+	for _, record := range replacement {
+		record.Name = []byte(owner)
+		records = append(records, record)
+	}
+	return records, true
+}
+
+// override follows the CNAME chain of an answer from name and replaces the rest of it with
+// the override for the first name on the way that has one. The CNAMEs leading there stay.
+func (p *AnswerPolicy) override(name string, recordType uint16, records []query.DNSRecord, rcode *uint16) []query.DNSRecord {
+	if len(p.overrides) == 0 {
+		return records
+	}
+	owner := strings.ToLower(strings.Trim(name, "."))
+	var chain []query.DNSRecord
+	// Every step uses up one CNAME, so a looping chain ends too
+	for range len(records) + 1 {
+		if replacement, ok := p.overrideFor(owner, recordType); ok {
+			*rcode = query.RCODE_NOERROR
+			return append(chain, replacement...)
+		}
+		next := ""
+		for _, record := range records {
+			if record.Type == query.TYPE_CNAME && strings.EqualFold(string(record.Name), owner) {
+				chain = append(chain, record)
+				next = strings.ToLower(query.DecodeNSName(record.Data))
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		owner = next
+	}
+	return records
+}
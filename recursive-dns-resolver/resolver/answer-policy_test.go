@@ -0,0 +1,181 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"recursive-dns-resolver/internal/dnstest"
+	"recursive-dns-resolver/query"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// policyRecords builds records from specs written like overrides: name [ttl] type data
+func policyRecords(t *testing.T, specs ...string) []query.DNSRecord {
+	t.Helper()
+	records := make([]query.DNSRecord, 0, len(specs))
+	for _, spec := range specs {
+		record, err := ParseOverride(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func formatRecords(records []query.DNSRecord) []string {
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		lines = append(lines, fmt.Sprintf("%s %d %s %s", record.Name, record.TTL, query.TypeName(record.Type), query.FormatRecordData(record)))
+	}
+	return lines
+}
+
+func TestAnswerPolicyApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    AnswerPolicy
+		overrides []string
+		qname     string
+		qtype     uint16
+		rcode     uint16
+		records   []string
+		wantRcode uint16
+		want      []string
+	}{
+		{
+			name:    "ttl clamps",
+			policy:  AnswerPolicy{MinTTL: 60, MaxTTL: 3600},
+			qname:   "www.example",
+			qtype:   query.TYPE_A,
+			records: []string{"www.example 10 A 192.0.2.1", "www.example 300 A 192.0.2.2", "www.example 86400 A 192.0.2.3"},
+			want:    []string{"www.example 60 A 192.0.2.1", "www.example 300 A 192.0.2.2", "www.example 3600 A 192.0.2.3"},
+		},
+		{
+			name:   "private A stripped",
+			policy: AnswerPolicy{StripPrivate: true},
+			qname:  "www.example",
+			qtype:  query.TYPE_A,
+			records: []string{
+				"www.example 300 A 10.0.0.1", "www.example 300 A 192.168.1.1", "www.example 300 A 127.0.0.1",
+				"www.example 300 A 169.254.1.1", "www.example 300 A 0.0.0.0", "www.example 300 A 192.0.2.1",
+			},
+			want: []string{"www.example 300 A 192.0.2.1"},
+		},
+		{
+			name:    "private AAAA stripped",
+			policy:  AnswerPolicy{StripPrivate: true},
+			qname:   "www.example",
+			qtype:   query.TYPE_AAAA,
+			records: []string{"www.example 300 AAAA fd00::1", "www.example 300 AAAA ::1", "www.example 300 AAAA fe80::1", "www.example 300 AAAA 2001:db8::1"},
+			want:    []string{"www.example 300 AAAA 2001:db8::1"},
+		},
+		{
+			name:    "private domains exempt",
+			policy:  AnswerPolicy{StripPrivate: true, PrivateDomains: []string{"corp.example"}},
+			qname:   "www.example",
+			qtype:   query.TYPE_A,
+			records: []string{"www.example 300 CNAME intranet.corp.example", "intranet.corp.example 300 A 10.0.0.1"},
+			want:    []string{"www.example 300 CNAME intranet.corp.example.", "intranet.corp.example 300 A 10.0.0.1"},
+		},
+		{
+			name:      "override of the queried name",
+			overrides: []string{"www.example 60 A 10.1.2.3"},
+			qname:     "WWW.example.",
+			qtype:     query.TYPE_A,
+			records:   []string{"www.example 300 A 192.0.2.1"},
+			want:      []string{"www.example 60 A 10.1.2.3"},
+		},
+		{
+			name:      "override at the end of a cname chain",
+			policy:    AnswerPolicy{StripPrivate: true},
+			overrides: []string{"cdn.example 60 A 10.1.2.3"},
+			qname:     "www.example",
+			qtype:     query.TYPE_A,
+			rcode:     query.RCODE_NXDOMAIN,
+			records:   []string{"www.example 300 CNAME edge.example", "edge.example 300 CNAME cdn.example"},
+			wantRcode: query.RCODE_NOERROR,
+			want:      []string{"www.example 300 CNAME edge.example.", "edge.example 300 CNAME cdn.example.", "cdn.example 60 A 10.1.2.3"},
+		},
+		{
+			name:      "override for another type",
+			overrides: []string{"www.example AAAA 2001:db8::1"},
+			qname:     "www.example",
+			qtype:     query.TYPE_A,
+			records:   []string{"www.example 300 A 192.0.2.1"},
+			want:      []string{"www.example 300 A 192.0.2.1"},
+		},
+		{
+			name:      "looping cname chain",
+			overrides: []string{"other.example A 10.1.2.3"},
+			qname:     "a.example",
+			qtype:     query.TYPE_A,
+			rcode:     query.RCODE_SERVFAIL,
+			records:   []string{"a.example 300 CNAME b.example", "b.example 300 CNAME a.example"},
+			wantRcode: query.RCODE_SERVFAIL,
+			want:      []string{"a.example 300 CNAME b.example.", "b.example 300 CNAME a.example."},
+		},
+	}
+	for _, test := range tests {
+		policy := test.policy
+		for _, record := range policyRecords(t, test.overrides...) {
+			policy.AddOverride(record)
+		}
+		result := &Result{Name: test.qname, Type: test.qtype, Rcode: test.rcode, Records: policyRecords(t, test.records...)}
+		policy.apply(result)
+		if got := formatRecords(result.Records); !slices.Equal(got, test.want) {
+			t.Errorf("%s: records\n%q\nwant\n%q", test.name, got, test.want)
+		}
+		if result.Rcode != test.wantRcode {
+			t.Errorf("%s: rcode %s, want %s", test.name, query.RcodeName(result.Rcode), query.RcodeName(test.wantRcode))
+		}
+	}
+}
+
+func TestAnswerPolicyNil(t *testing.T) {
+	var policy *AnswerPolicy
+	result := &Result{Name: "www.example", Type: query.TYPE_A, Records: policyRecords(t, "www.example 1 A 10.0.0.1")}
+	policy.apply(result)
+	if got := formatRecords(result.Records); !slices.Equal(got, []string{"www.example 1 A 10.0.0.1"}) {
+		t.Errorf("a nil policy changed the records to %q", got)
+	}
+	if _, ok := policy.lookup("www.example", query.TYPE_A); ok {
+		t.Error("a nil policy has an override")
+	}
+}
+
+// An overridden name is answered before any recursion, so it resolves while upstream is down
+func TestLookupOverrideWithoutRecursion(t *testing.T) {
+	var rootQueries atomic.Int32
+	root := dnstest.Start(t, dnstest.Answer(func(string, uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+		rootQueries.Add(1)
+		return query.RCODE_SERVFAIL, nil, nil
+	}))
+	policy := &AnswerPolicy{}
+	for _, record := range policyRecords(t, "intranet.example 60 A 10.1.2.3") {
+		policy.AddOverride(record)
+	}
+	r := New(WithRoots(root.Addr), WithTimeouts(time.Second, 2*time.Second))
+	r.Policy = policy
+
+	result, err := r.Lookup(context.Background(), "Intranet.Example.", query.TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatRecords(result.Records); !result.FromPolicy || result.Rcode != query.RCODE_NOERROR || !slices.Equal(got, []string{"intranet.example 60 A 10.1.2.3"}) {
+		t.Errorf("got %q, rcode %s, from policy %v", got, query.RcodeName(result.Rcode), result.FromPolicy)
+	}
+	if n := rootQueries.Load(); n != 0 {
+		t.Errorf("the roots were asked %d times", n)
+	}
+
+	// Other names and types still recurse
+	if _, err := r.Lookup(context.Background(), "intranet.example", query.TYPE_AAAA); err == nil {
+		t.Error("a type without an override did not recurse to the failing root")
+	}
+	if rootQueries.Load() == 0 {
+		t.Error("the roots were never asked")
+	}
+}
@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+)
+
+// EDNS Client Subnet (RFC 7871). When it is enabled, queries to authoritative servers carry
+// the network of the client a lookup is done for, so CDNs can answer with servers close to
+// that client. Answers are then cached per network, as they may differ between clients.
+
+type clientIPKey struct{}
+
+// ContextWithClientIP returns a context that tells Lookup which client it resolves for, e.g.
+// the address a server received the query from
+func ContextWithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// clientSubnet returns the network to send upstream for the client in ctx, or nil when
+// client subnet is disabled for its address family or there is no client worth revealing.
+// Private and loopback clients are not, their address tells a CDN nothing.
+func (r *Resolver) clientSubnet(ctx context.Context) *query.ClientSubnet {
+	ip, _ := ctx.Value(clientIPKey{}).(net.IP)
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+	prefix := r.ClientSubnetIPv6
+	if ip.To4() != nil {
+		prefix = r.ClientSubnetIPv4
+	}
+	if prefix == 0 {
+		return nil
+	}
+	subnet := query.NewClientSubnet(ip, prefix)
+	return &subnet
+}
+
+// answerScope returns the network an answer to a query sent with subnet is valid for, or nil
+// when it is valid for every client. A server that ignores client subnet leaves the option
+// out or answers with scope 0. A scope longer than what we sent only covers our network.
+func answerScope(response *query.DNSPacket, subnet *query.ClientSubnet) *net.IPNet {
+	if subnet == nil {
+		return nil
+	}
+	data, ok := query.GetOption(*response, query.OPTION_ECS)
+	if !ok {
+		return nil
+	}
+	echoed, err := query.DecodeClientSubnet(data)
+	if err != nil || echoed.ScopePrefix == 0 {
+		return nil
+	}
+	return subnet.Network(min(echoed.ScopePrefix, subnet.SourcePrefix))
+}
+
+// matchClientSubnet checks that a response echoes the client subnet we sent, if it echoes one
+// at all. RFC 7871 has responses that echo another network dropped like forgeries.
+func matchClientSubnet(response *query.DNSPacket, subnet *query.ClientSubnet) error {
+	data, ok := query.GetOption(*response, query.OPTION_ECS)
+	if !ok || subnet == nil {
+		return nil
+	}
+	echoed, err := query.DecodeClientSubnet(data)
+	if err != nil {
+		return err
+	}
+	if echoed.SourcePrefix != subnet.SourcePrefix || !echoed.IP.Equal(subnet.IP) {
+		return fmt.Errorf("response client subnet %s/%d does not match %s/%d", echoed.IP, echoed.SourcePrefix, subnet.IP, subnet.SourcePrefix)
+	}
+	return nil
+}
+
+// prefixLength returns the length of the mask of network
+func prefixLength(network *net.IPNet) int {
+	ones, _ := network.Mask.Size()
+	return ones
+}
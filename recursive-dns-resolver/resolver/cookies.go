@@ -0,0 +1,61 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"recursive-dns-resolver/query"
+	"sync"
+)
+
+// cookieJar keeps the DNS cookies (RFC 7873) the Resolver sends upstream. The client cookie
+// for a server is derived from a secret and the server's address, so every server sees a
+// different one and cannot track us across servers. Server cookies are learned from responses.
+type cookieJar struct {
+	secret  [16]byte
+	mutex   sync.Mutex
+	servers map[string][]byte // server cookie by server address
+}
+
+func newCookieJar() *cookieJar {
+	jar := &cookieJar{servers: make(map[string][]byte)}
+	rand.Read(jar.secret[:])
+	return jar
+}
+
+// clientCookie returns the eight byte client cookie we send to server
+func (j *cookieJar) clientCookie(server string) []byte {
+	mac := hmac.New(sha256.New, j.secret[:])
+	mac.Write([]byte(serverAddress(server)))
+	return mac.Sum(nil)[:8]
+}
+
+// option returns the COOKIE option for a query to server, with its server cookie if we know one
+func (j *cookieJar) option(server string) query.EDNSOption {
+	data := j.clientCookie(server)
+	j.mutex.Lock()
+	data = append(data, j.servers[serverAddress(server)]...)
+	j.mutex.Unlock()
+	return query.EDNSOption{Code: query.OPTION_COOKIE, Data: data}
+}
+
+// check reports whether a response from server may be accepted: when it carries a cookie, the
+// client cookie must be the one we sent. The server cookie it carries is kept for the next query.
+func (j *cookieJar) check(server string, response query.DNSPacket) bool {
+	data, ok := query.GetOption(response, query.OPTION_COOKIE)
+	if !ok {
+		// Servers that do not implement cookies just leave the option out
+		return true
+	}
+	client, serverCookie, err := query.DecodeCookie(data)
+	if err != nil || !bytes.Equal(client, j.clientCookie(server)) {
+		return false
+	}
+	if len(serverCookie) > 0 {
+		j.mutex.Lock()
+		j.servers[serverAddress(server)] = append([]byte(nil), serverCookie...)
+		j.mutex.Unlock()
+	}
+	return true
+}
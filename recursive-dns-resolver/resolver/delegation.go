@@ -0,0 +1,131 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+	"strings"
+)
+
+// Delegation is what the parent zone says about a child zone: the nameservers it delegates
+// to and the glue addresses it gives for them
+type Delegation struct {
+	Zone string
+	// Parent is the zone the delegation was found in, "" for the root, and ParentServer the
+	// address of the server that sent it
+	Parent       string
+	ParentServer string
+	NS           []string
+	Glue         map[string][]net.IP
+}
+
+// FindDelegation walks down from the roots the way Lookup does, but stops at the referral
+// for zone and returns it instead of following it
+func (r *Resolver) FindDelegation(ctx context.Context, zone string) (*Delegation, error) {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	last, response, answered, err := r.walkDelegations(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil && last.Zone == zone {
+		return last, nil
+	}
+	if rcode := query.GetRcode(*response); rcode != query.RCODE_NOERROR {
+		return nil, fmt.Errorf("%s answered %s for %s", answered, query.RcodeName(rcode), zone)
+	}
+
+	// The parent also serves the child, so its answer is the only NS set it has
+	delegation := &Delegation{Zone: zone, ParentServer: answered, Glue: make(map[string][]net.IP)}
+	if last != nil {
+		delegation.Parent = last.Zone
+	}
+	for _, record := range response.Answers {
+		if record.Type == query.TYPE_NS {
+			delegation.NS = append(delegation.NS, query.DecodeNSName(record.Data))
+		}
+	}
+	if len(delegation.NS) == 0 {
+		return nil, fmt.Errorf("%s is not a zone, %s has no delegation for it", zone, answered)
+	}
+	addGlue(delegation, response)
+	return delegation, nil
+}
+
+// FindZone walks down from the roots towards name and returns the delegation of the zone name
+// belongs to, whose nameservers are the ones authoritative for it
+func (r *Resolver) FindZone(ctx context.Context, name string) (*Delegation, error) {
+	name = strings.ToLower(strings.Trim(name, "."))
+	last, response, answered, err := r.walkDelegations(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, fmt.Errorf("%s is answered by the root servers", name)
+	}
+	if last.Zone != name {
+		switch rcode := query.GetRcode(*response); rcode {
+		case query.RCODE_NOERROR, query.RCODE_NXDOMAIN:
+		default:
+			return nil, fmt.Errorf("%s answered %s for %s", answered, query.RcodeName(rcode), name)
+		}
+	}
+	return last, nil
+}
+
+// walkDelegations follows referrals from the roots towards name until a server answers
+// instead of referring, or refers to name itself. It returns the last delegation followed
+// or reached, nil if the roots answered, along with the final response and who sent it.
+func (r *Resolver) walkDelegations(ctx context.Context, name string) (*Delegation, *query.DNSPacket, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.ResolutionTimeout)
+	defer cancel()
+	state := r.newResolution(ctx, name)
+
+	servers := r.roots()
+	var last *Delegation
+	for {
+		if err := state.beforeQuery(name, serverKey(servers), name, query.TYPE_NS); err != nil {
+			return nil, nil, "", err
+		}
+		response, answered, err := state.exchangeAny(name, query.TYPE_NS, servers, nil)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		parent := ""
+		if last != nil {
+			parent = last.Zone
+		}
+		sanitiseResponse(response, name, parent)
+		if query.GetRcode(*response) != query.RCODE_NOERROR {
+			return last, response, answered.addr, nil
+		}
+		referral := strings.ToLower(query.GetReferralZone(*response))
+		if referral == "" {
+			return last, response, answered.addr, nil
+		}
+
+		last = &Delegation{
+			Zone:         referral,
+			Parent:       parent,
+			ParentServer: answered.addr,
+			NS:           query.GetNameServerNames(*response),
+			Glue:         make(map[string][]net.IP),
+		}
+		addGlue(last, response)
+		if referral == name {
+			return last, response, answered.addr, nil
+		}
+		if servers, err = state.nextServers(response); err != nil {
+			return nil, nil, "", err
+		}
+	}
+}
+
+// addGlue copies the glue for the nameservers of a delegation from the additional section
+func addGlue(delegation *Delegation, response *query.DNSPacket) {
+	for _, nsName := range delegation.NS {
+		if ips := query.GetGlueIPs(*response, nsName); len(ips) > 0 {
+			delegation.Glue[strings.ToLower(nsName)] = ips
+		}
+	}
+}
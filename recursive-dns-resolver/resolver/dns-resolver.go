@@ -1,100 +1,433 @@
 package resolver
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
-	"recursive-dns-resolver/cache"
 	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/querylog"
 	"recursive-dns-resolver/socket"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// rootServer and rootServerIPv6 (both F-root) are where every iterative lookup starts
+// unless the Resolver is given other roots
+const (
+	rootServer     = "192.5.5.241"
+	rootServerIPv6 = "2001:500:2f::f"
+)
+
+// SendQuery sends a single query to root using the DefaultResolver
 func SendQuery(domainName string, recordType uint16, root string) (*query.DNSPacket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultResolver.Timeout)
+	defer cancel()
+	return DefaultResolver.exchange(ctx, domainName, recordType, root, nil)
+}
 
-	dnsquery := query.BuildQuery(domainName, recordType)
-	// fmt.Printf("DNS Query: %x\n", dnsquery)
+// ResolveQuery resolves domainName with the DefaultResolver and returns one line of output for
+// the CLI: the address for A and AAAA, the address of the canonical name for CNAME, and the
+// name and address of one nameserver for NS. Short names are completed with the search domains.
+func ResolveQuery(domainName string, recordType uint16) (string, error) {
+	ctx := context.Background()
+	switch recordType {
+	case query.TYPE_NS:
+		names, err := DefaultResolver.LookupNS(ctx, domainName)
+		if err != nil || len(names) == 0 {
+			return "", err
+		}
+		ip, err := ResolveQuery(names[0], query.TYPE_A)
+		if err != nil {
+			return "", err
+		}
+		return names[0] + " " + ip, nil
+	case query.TYPE_CNAME:
+		recordType = query.TYPE_A
+	}
 
-	if recordType == uint16(query.TYPE_AAAA) {
+	result, err := DefaultResolver.LookupSearch(ctx, domainName, recordType)
+	if err != nil {
+		return "", err
+	}
+	ip, _ := query.GetAnswerIP(query.DNSPacket{Answers: result.Records})
+	return ip, nil
+}
 
-		root = "[" + root + "]"
+// ResolveRecords resolves domainName with the DefaultResolver and returns every record of
+// recordType in presentation format, for the types that have more to them than an address
+func ResolveRecords(domainName string, recordType uint16) ([]string, error) {
+	if ip := net.ParseIP(domainName); ip != nil && recordType == query.TYPE_PTR {
+		domainName = query.ReverseName(ip)
+	}
+	result, err := DefaultResolver.LookupSearch(context.Background(), domainName, recordType)
+	if err != nil {
+		return nil, err
+	}
+	var records []string
+	for _, record := range result.Records {
+		if record.Type == recordType || recordType == query.TYPE_ANY {
+			records = append(records, query.FormatRecordData(record))
+		}
+	}
+	return records, nil
+}
 
+// serverAddress adds the DNS port to a server unless it already has one
+func serverAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
 	}
+	return net.JoinHostPort(server, "53")
+}
 
-	// Send the DNS query
-	conn, err := socket.OpenUDPConnection(root)
+// exchange sends one query to server, on behalf of subnet unless it is nil. An identical
+// query to the same server that is already in flight is joined rather than sent again.
+func (r *Resolver) exchange(ctx context.Context, domainName string, recordType uint16, server string, subnet *query.ClientSubnet) (*query.DNSPacket, error) {
+	key := server + "|" + strings.ToLower(domainName) + "|" + strconv.Itoa(int(recordType))
+	if subnet != nil {
+		key += "|" + subnet.Network(subnet.SourcePrefix).String()
+	}
+	packet, coalesced, err := r.exchanges.do(ctx, key, func() (*query.DNSPacket, error) {
+		return r.sendQuery(context.Background(), domainName, recordType, server, subnet)
+	})
 	if err != nil {
-		log.Fatalf("Error opening socket: %v", err)
 		return nil, err
 	}
+	if coalesced {
+		coalescedQueries.Inc()
+	}
+	// Callers filter the sections of the packet they get, so each needs its own copy
+	shared := *packet
+	return &shared, nil
+}
+
+// sendQuery sends one query to server and waits for the response that matches it. Queries
+// carry an OPT record when they send cookies or a client subnet; a server that does not
+// understand EDNS and answers FORMERR is asked again without.
+func (r *Resolver) sendQuery(ctx context.Context, domainName string, recordType uint16, server string, subnet *query.ClientSubnet) (*query.DNSPacket, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	edns := r.Cookies || subnet != nil
+	for retried := false; ; retried = true {
+		// Mix the case of the name so forged responses also have to guess it
+		qname := randomiseCase(domainName)
+		dnsquery := query.BuildQuery(qname, recordType)
+		if edns {
+			var options []query.EDNSOption
+			if r.Cookies {
+				options = append(options, r.cookies.option(server))
+			}
+			if subnet != nil {
+				options = append(options, query.EDNSOption{Code: query.OPTION_ECS, Data: query.EncodeClientSubnet(*subnet)})
+			}
+			dnsquery = query.AppendOPT(dnsquery, query.NewOPT(query.DefaultUDPSize, options...))
+		}
+
+		response, err := r.sendUDP(ctx, dnsquery, qname, recordType, server, subnet)
+		if err != nil || retried {
+			return response, err
+		}
+		switch {
+		case edns && query.GetOPT(*response) == nil && query.GetRcode(*response) == query.RCODE_FORMERR:
+			edns, subnet = false, nil
+		case query.ExtendedRcode(*response) == query.RCODE_BADCOOKIE:
+			// The response taught us the server cookie to send this time
+		default:
+			return response, nil
+		}
+	}
+}
+
+// sendUDP sends an already built query over UDP, falling back to TCP when the answer is truncated
+func (r *Resolver) sendUDP(ctx context.Context, dnsquery []byte, qname string, recordType uint16, server string, subnet *query.ClientSubnet) (*query.DNSPacket, error) {
+	// Send the DNS query. The socket is connected, so the kernel already drops
+	// datagrams that do not come from the server's address and port.
+	conn, err := r.Dial(ctx, "udp", serverAddress(server))
+	if err != nil {
+		return nil, fmt.Errorf("error opening socket: %w", err)
+	}
 	defer socket.CloseUDPConnection(conn)
 
+	sent := time.Now()
 	_, err = conn.Write(dnsquery)
 	if err != nil {
-		log.Fatalf("Error sending query: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("error sending query: %w", err)
 	}
-	// fmt.Printf("DNS Request sent to %s for %s\n", root, domainName)
-	// Buffer to receive the response
-	buffer := make([]byte, 2048) // Sufficient size to handle typical DNS responses
-	_, err = conn.Read(buffer)
-	if err != nil {
-		log.Fatalf("Error reading response: %v", err)
+	// Buffer to receive the response. Parsing copies everything out of it, so it can go back
+	// to the pool once we return.
+	pooled := query.GetMessageBuffer()
+	defer query.PutMessageBuffer(pooled)
+	buffer := *pooled
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				upstreamTimeouts.Inc(server)
+			}
+			r.logUpstream(sent, qname, recordType, server, "udp", dnsquery, nil, nil, err)
+			return nil, fmt.Errorf("error reading response from %s: %w", server, err)
+		}
+		if n < 12 {
+			continue // too short to even hold a header
+		}
+
+		dnspacket, err := query.ParseDNSResponse(buffer[:n])
+		if err != nil {
+			continue
+		}
+		// Anything that does not match the query is ignored, and we keep waiting for
+		// the real answer until the connection deadline passes
+		if err := matchResponse(dnsquery, dnspacket, qname, recordType); err != nil {
+			r.Logger.Printf("Ignoring unmatched response from %s: %v", server, err)
+			continue
+		}
+		if err := matchClientSubnet(dnspacket, subnet); err != nil {
+			r.Logger.Printf("Ignoring unmatched response from %s: %v", server, err)
+			continue
+		}
+		if r.Cookies && !r.cookies.check(server, *dnspacket) {
+			r.Logger.Printf("Ignoring response from %s with the wrong client cookie", server)
+			continue
+		}
+		upstreamRTT.Observe(time.Since(sent).Seconds(), server)
+		r.logUpstream(sent, qname, recordType, server, "udp", dnsquery, buffer[:n], dnspacket, nil)
+		if dnspacket.Header.Flags&query.FLAG_TC != 0 {
+			// The answer did not fit in a datagram, so ask again over TCP
+			tcpFallbacks.Inc()
+			return r.exchangeTCP(ctx, dnsquery, qname, recordType, server)
+		}
+		return dnspacket, nil
 	}
-	// fmt.Printf("Received DNS response (%d bytes): %x\n", n, buffer[:n])
+}
 
-	dnspacket, err := query.ParseDNSResponse(buffer)
+// exchangeTCP sends an already built query over TCP, used when the UDP answer was truncated
+func (r *Resolver) exchangeTCP(ctx context.Context, dnsquery []byte, qname string, recordType uint16, server string) (*query.DNSPacket, error) {
+	conn, err := r.Dial(ctx, "tcp", serverAddress(server))
 	if err != nil {
-		log.Fatalf("Error parsing response: %v", err)
+		return nil, fmt.Errorf("error opening TCP connection: %w", err)
 	}
-	return dnspacket, err
+	defer conn.Close()
 
+	sent := time.Now()
+	if err := socket.WriteTCPMessage(conn, dnsquery); err != nil {
+		return nil, fmt.Errorf("error sending query over TCP: %w", err)
+	}
+	message, err := socket.ReadTCPMessage(conn)
+	if err != nil {
+		r.logUpstream(sent, qname, recordType, server, "tcp", dnsquery, nil, nil, err)
+		return nil, fmt.Errorf("error reading TCP response from %s: %w", server, err)
+	}
+	if len(message) < 12 {
+		return nil, fmt.Errorf("TCP response from %s is too short", server)
+	}
+	dnspacket, err := query.ParseDNSResponse(message)
+	if err != nil {
+		return nil, err
+	}
+	if err := matchResponse(dnsquery, dnspacket, qname, recordType); err != nil {
+		return nil, fmt.Errorf("unmatched TCP response from %s: %w", server, err)
+	}
+	r.logUpstream(sent, qname, recordType, server, "tcp", dnsquery, message, dnspacket, nil)
+	return dnspacket, nil
 }
 
-func ResolveQuery(domainName string, recordType uint16) (string, error) {
+// logUpstream records one query to an authoritative server in the query log
+func (r *Resolver) logUpstream(sent time.Time, qname string, recordType uint16, server string, protocol string, dnsquery []byte, response []byte, packet *query.DNSPacket, err error) {
+	if r.QueryLog == nil {
+		return
+	}
+	event := querylog.Event{
+		Time:     sent,
+		Kind:     querylog.ResolverResponse,
+		QName:    qname,
+		QType:    query.TypeName(recordType),
+		Server:   serverAddress(server),
+		Protocol: protocol,
+		RTT:      float64(time.Since(sent).Microseconds()) / 1000,
+		Query:    dnsquery,
+		Response: append([]byte(nil), response...),
+	}
+	if packet != nil {
+		event.Rcode = query.RcodeName(query.GetRcode(*packet))
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	r.QueryLog.Log(event)
+}
 
-	// rootservers := []string{"198.41.0.4", "199.9.14.201", "192.33.4.12", "199.7.91.13", "192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53", "192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42", "202.12.27.33"}
-	// index := rand.Intn(13)
-	root := "192.5.5.241"
-	var original_record uint16
-	var nsName string
-	var nsIP string
-	if recordType == uint16(query.TYPE_NS) || recordType == uint16(query.TYPE_CNAME) {
-		original_record = recordType
-		recordType = uint16(query.TYPE_A)
+// roots returns the configured root servers in random order to spread the load
+func (r *Resolver) roots() []nameserver {
+	servers := make([]nameserver, len(r.Roots))
+	for i, j := range rand.Perm(len(r.Roots)) {
+		servers[i] = nameserver{addr: r.Roots[j]}
 	}
-	if original_record == uint16(query.TYPE_A) {
-		cachedIP := cache.GetFromCache(domainName)
-		if cachedIP != nil {
-			return cachedIP.String(), nil
-		}
+	return servers
+}
+
+// resolve walks the delegation tree from a root server for domainName
+func (r *resolution) resolve(domainName string, recordType uint16) (*Result, error) {
+	if err := r.enter(domainName, recordType); err != nil {
+		return nil, err
 	}
+	defer r.leave(domainName, recordType)
 
+	result := &Result{Name: domainName, Type: recordType}
+	servers := r.roots()
+	cnameDepth := 0
+
+	// knownLabels counts how many trailing labels of domainName the server we are
+	// talking to is known to be authoritative for; the root knows none of them
+	knownLabels := 0
+	minimise := r.Minimise
 	for {
-		response, err := SendQuery(domainName, recordType, root)
+		qname, qtype := domainName, recordType
+		if minimise && knownLabels+1 < len(splitLabels(domainName)) {
+			qname, qtype = ancestorName(domainName, knownLabels+1), query.TYPE_A
+		}
+		if err := r.beforeQuery(domainName, serverKey(servers), qname, qtype); err != nil {
+			return nil, err
+		}
+		// Only the questions for the name itself carry the client subnet, not minimised ones
+		// or those for the addresses of nameservers
+		var subnet *query.ClientSubnet
+		if qname == domainName && r.nameserverDepth == 0 {
+			subnet = r.subnet
+		}
+		response, answered, err := r.exchangeAny(qname, qtype, servers, subnet)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if ip, ttl := query.GetAnswerIP(*response); ip != "" {
-			if original_record == uint16(query.TYPE_NS) {
-				return nsName + " " + nsIP, nil
+		// The OPT record does not survive sanitising, so take the scope of the answer first
+		scope := answerScope(response, subnet)
+		sanitiseResponse(response, qname, ancestorName(domainName, knownLabels))
+		if qname != domainName {
+			// A minimised query only tells us whether qname is the next zone cut
+			if isMinimisationFailure(response, knownLabels) {
+				minimise = false
+				continue
 			}
-			// if original_record == uint16(query.TYPE_CNAME) {
-			// 	return query.GetAnswerCNAME(*response, uint16(query.TYPE_CNAME)), nil
-			// }
-			if original_record == uint16(query.TYPE_A) {
-				cache.InsertInCache(domainName, net.ParseIP(ip), ttl)
+			zone := query.GetReferralZone(*response)
+			if zone == "" {
+				// Not a zone cut on this server, so ask the same server for one more label
+				knownLabels++
+				continue
 			}
-			return ip, nil
-		} else if nsIP, nsName, _ = query.GetAdditionalsIP(*response, recordType); nsIP != "" {
-			root = nsIP
-		} else if nsDomain := query.GetNameServers(*response); nsDomain != "" {
-			ip, err := ResolveQuery(nsDomain, recordType)
-			if err != nil {
-				return "", err
+			knownLabels = len(splitLabels(zone))
+			if servers, err = r.nextServers(response); err != nil {
+				return nil, err
 			}
-			root = ip
-		} else {
-			return "", fmt.Errorf("something went wrong")
+			continue
+		}
+
+		result.Server, result.ServerName = answered.addr, answered.name
+		result.Rcode = query.GetRcode(*response)
+		// An answer that follows CNAMEs is only valid where every step of the chain is
+		if scope != nil && (result.ClientSubnet == nil || prefixLength(scope) > prefixLength(result.ClientSubnet)) {
+			result.ClientSubnet = scope
+		}
+		switch result.Rcode {
+		case query.RCODE_NOERROR:
+		case query.RCODE_NXDOMAIN:
+			result.Records = append(result.Records, response.Answers...)
+			result.SOA = authoritySOA(response)
+			return result, nil
+		default:
+			return nil, fmt.Errorf("%s answered rcode %d for %s", answered.addr, result.Rcode, qname)
+		}
+
+		if hasAnswer(response, recordType) {
+			result.Records = append(result.Records, response.Answers...)
+			return result, nil
+		}
+		if target := query.GetAnswerCNAME(*response); target != "" {
+			// The name is an alias without the data in the same zone, so start over
+			// from the root for the canonical name
+			result.Records = append(result.Records, response.Answers...)
+			cnameDepth++
+			if cnameDepth > r.MaxCNAMEDepth {
+				return nil, &LimitError{Name: r.name, Limit: "CNAMEs in chain", Max: r.MaxCNAMEDepth}
+			}
+			if err := r.enter(target, recordType); err != nil {
+				return nil, err
+			}
+			defer r.leave(target, recordType)
+			domainName = target
+			servers = r.roots()
+			knownLabels = 0
+			minimise = r.Minimise
+			continue
+		}
+		zone := query.GetReferralZone(*response)
+		if zone == "" {
+			// The name exists but has no records of this type
+			result.SOA = authoritySOA(response)
+			return result, nil
+		}
+		knownLabels = len(splitLabels(zone))
+		if servers, err = r.nextServers(response); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authoritySOA returns the SOA record of a negative response, or nil if it has none
+func authoritySOA(response *query.DNSPacket) *query.DNSRecord {
+	for _, record := range response.Authorities {
+		if record.Type == query.TYPE_SOA {
+			return &record
+		}
+	}
+	return nil
+}
+
+// hasAnswer reports whether the answer section holds the data that was asked for
+func hasAnswer(response *query.DNSPacket, recordType uint16) bool {
+	for _, record := range response.Answers {
+		if record.Type == recordType || recordType == query.TYPE_ANY {
+			return true
+		}
+	}
+	return false
+}
+
+// nextServers collects the addresses of the nameservers a referral points to. Glue from the
+// additional section is used when present, both IPv4 and IPv6, otherwise the NS names are
+// resolved from the root until one of them has an address.
+func (r *resolution) nextServers(response *query.DNSPacket) ([]nameserver, error) {
+	if err := r.followReferral(); err != nil {
+		return nil, err
+	}
+	nsNames := query.GetNameServerNames(*response)
+	var servers []nameserver
+	for _, nsName := range nsNames {
+		for _, ip := range query.GetGlueIPs(*response, nsName) {
+			if r.allowed(ip.String()) {
+				servers = append(servers, nameserver{addr: ip.String(), name: nsName})
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	var lastErr error = fmt.Errorf("no nameserver to follow in referral")
+	for _, nsName := range nsNames {
+		servers, err := r.nameserverAddresses(nsName)
+		if err == nil {
+			return servers, nil
+		}
+		lastErr = err
+		// Running out of budget or time will not get better with the next name
+		var limitErr *LimitError
+		var deadlineErr *DeadlineError
+		if errors.As(err, &limitErr) || errors.As(err, &deadlineErr) || r.ctx.Err() != nil {
+			return nil, err
 		}
 	}
+	return nil, lastErr
 }
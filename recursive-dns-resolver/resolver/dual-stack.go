@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+	"strings"
+	"time"
+)
+
+// nameserver is one address we can send a query to, together with the name it was learned under
+type nameserver struct {
+	addr string
+	name string
+}
+
+// allowed reports whether addr belongs to an address family the Resolver may use.
+// Addresses that are not literal IPs, such as test roots with a port, are always allowed.
+func (r *Resolver) allowed(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	switch r.Network {
+	case "ip4":
+		return ip.To4() != nil
+	case "ip6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// isIPv6 reports whether a server address is an IPv6 one
+func isIPv6(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// happyEyeballs drops the servers of families we may not use and orders the rest the way
+// RFC 8305 does, alternating between IPv6 and IPv4 and starting with IPv6
+func (r *Resolver) happyEyeballs(servers []nameserver) []nameserver {
+	var v6, v4 []nameserver
+	for _, ns := range servers {
+		if !r.allowed(ns.addr) {
+			continue
+		}
+		if isIPv6(ns.addr) {
+			v6 = append(v6, ns)
+		} else {
+			v4 = append(v4, ns)
+		}
+	}
+	ordered := make([]nameserver, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
+
+// serverKey identifies a set of servers for loop detection
+func serverKey(servers []nameserver) string {
+	addrs := make([]string, len(servers))
+	for i, ns := range servers {
+		addrs[i] = ns.addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// exchangeAny sends the query to the servers one after another, starting the next attempt
+// when the previous one fails or has been outstanding for AttemptDelay, and returns the
+// first good response. A broken IPv6 path therefore only costs AttemptDelay, not a timeout.
+// subnet is sent as EDNS Client Subnet unless it is nil.
+func (r *resolution) exchangeAny(qname string, recordType uint16, servers []nameserver, subnet *query.ClientSubnet) (*query.DNSPacket, nameserver, error) {
+	servers = r.happyEyeballs(servers)
+	if len(servers) == 0 {
+		return nil, nameserver{}, fmt.Errorf("no usable nameserver address for %s with network %q", qname, r.Network)
+	}
+
+	type reply struct {
+		packet *query.DNSPacket
+		server nameserver
+		err    error
+	}
+	replies := make(chan reply, len(servers))
+	next, pending := 0, 0
+	var lastErr error
+	start := time.After(0)
+	for {
+		select {
+		case <-r.ctx.Done():
+			return nil, nameserver{}, r.ctx.Err()
+		case <-start:
+			ns := servers[next]
+			next++
+			pending++
+			go func() {
+				packet, err := r.exchange(r.ctx, qname, recordType, ns.addr, subnet)
+				replies <- reply{packet, ns, err}
+			}()
+			start = nil
+			if next < len(servers) {
+				start = time.After(r.AttemptDelay)
+			}
+		case rep := <-replies:
+			pending--
+			if rep.err == nil {
+				return rep.packet, rep.server, nil
+			}
+			lastErr = rep.err
+			if next < len(servers) {
+				start = time.After(0)
+			} else if pending == 0 {
+				return nil, nameserver{}, lastErr
+			}
+		}
+	}
+}
+
+// nameserverAddresses resolves the addresses of a nameserver whose referral came without glue,
+// asking for the address families the Resolver may use
+func (r *resolution) nameserverAddresses(nsName string) ([]nameserver, error) {
+	r.nameserverDepth++
+	defer func() { r.nameserverDepth-- }()
+	var types []uint16
+	switch r.Network {
+	case "ip4":
+		types = []uint16{query.TYPE_A}
+	case "ip6":
+		types = []uint16{query.TYPE_AAAA}
+	default:
+		types = []uint16{query.TYPE_AAAA, query.TYPE_A}
+	}
+
+	var servers []nameserver
+	var lastErr error
+	for _, qtype := range types {
+		result, err := r.resolve(nsName, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, record := range result.Records {
+			if record.Type == qtype {
+				servers = append(servers, nameserver{addr: net.IP(record.Data).String(), name: nsName})
+			}
+		}
+	}
+	if len(servers) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("nameserver %s has no address", nsName)
+	}
+	return servers, nil
+}
@@ -0,0 +1,44 @@
+package resolver
+
+import (
+	"fmt"
+	"time"
+)
+
+// A LimitError is returned when a resolution gives up because it used up one of its budgets
+type LimitError struct {
+	Name  string
+	Limit string
+	Max   int
+}
+
+var _ error = (*LimitError)(nil)
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("resolving %s: too many %s (limit %d)", e.Name, e.Limit, e.Max)
+}
+
+// A DeadlineError is returned when a resolution runs past its deadline
+type DeadlineError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+var _ error = (*DeadlineError)(nil)
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("resolving %s: deadline of %s exceeded", e.Name, e.Timeout)
+}
+
+// A LoopError is returned when a resolution would ask a question it is already waiting on,
+// e.g. two zones whose nameservers are only named inside each other
+type LoopError struct {
+	Name   string
+	Detail string
+}
+
+var _ error = (*LoopError)(nil)
+
+func (e *LoopError) Error() string {
+	return fmt.Sprintf("resolving %s: loop detected: %s", e.Name, e.Detail)
+}
@@ -0,0 +1,46 @@
+package resolver
+
+import (
+	"fmt"
+	"recursive-dns-resolver/query"
+)
+
+// forward resolves a name through the Forwarders instead of iterating from the roots. A
+// forwarder recurses on our behalf, so its answer is final, with the CNAMEs it followed on the
+// way. The forwarders are tried in order, and one that fails or answers anything but NOERROR
+// or NXDOMAIN hands the question to the next.
+func (r *resolution) forward(domainName string, recordType uint16) (*Result, error) {
+	var lastErr error
+	for _, forwarder := range r.Forwarders {
+		if err := r.beforeQuery(domainName, forwarder, domainName, recordType); err != nil {
+			return nil, err
+		}
+		response, err := r.exchange(r.ctx, domainName, recordType, forwarder, r.subnet)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rcode := query.GetRcode(*response)
+		if rcode != query.RCODE_NOERROR && rcode != query.RCODE_NXDOMAIN {
+			lastErr = fmt.Errorf("forwarder %s answered rcode %d for %s", forwarder, rcode, domainName)
+			continue
+		}
+		if response.Header.Flags&query.FLAG_RA == 0 && len(response.Answers) == 0 && query.GetReferralZone(*response) != "" {
+			lastErr = fmt.Errorf("forwarder %s does not offer recursion, it answered with a referral", forwarder)
+			continue
+		}
+
+		scope := answerScope(response, r.subnet)
+		sanitiseResponse(response, domainName, "")
+		return &Result{
+			Name:         domainName,
+			Type:         recordType,
+			Rcode:        rcode,
+			Records:      response.Answers,
+			SOA:          authoritySOA(response),
+			Server:       forwarder,
+			ClientSubnet: scope,
+		}, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,83 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"recursive-dns-resolver/internal/dnstest"
+	"recursive-dns-resolver/query"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForward(t *testing.T) {
+	var rootQueries atomic.Int32
+	root := dnstest.Start(t, dnstest.Answer(func(string, uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+		rootQueries.Add(1)
+		return query.RCODE_REFUSED, nil, nil
+	}))
+	var failingQueries atomic.Int32
+	failing := dnstest.Start(t, dnstest.Answer(func(string, uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+		failingQueries.Add(1)
+		return query.RCODE_SERVFAIL, nil, nil
+	}))
+	soa := dnstest.Record("example", query.TYPE_SOA, 3600, query.EncodeSOA(query.SOAData{MName: "ns.example", RName: "hostmaster.example", Serial: 1, Minimum: 60}))
+	working := dnstest.Start(t, dnstest.Answer(func(name string, qtype uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+		switch name {
+		case "www.example":
+			return query.RCODE_NOERROR, []query.DNSRecord{
+				dnstest.Record(name, query.TYPE_CNAME, 300, query.EncodeName("web.example")),
+				dnstest.Record("web.example", query.TYPE_A, 300, []byte{192, 0, 2, 1}),
+			}, nil
+		default:
+			return query.RCODE_NXDOMAIN, nil, []query.DNSRecord{soa}
+		}
+	}))
+	r := New(
+		WithRoots(root.Addr),
+		WithForwarders(failing.Addr, working.Addr),
+		WithTimeouts(time.Second, 2*time.Second),
+	)
+
+	result, err := r.Lookup(context.Background(), "www.example", query.TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Server != working.Addr {
+		t.Errorf("answered by %s, want %s", result.Server, working.Addr)
+	}
+	if result.Rcode != query.RCODE_NOERROR || len(result.Records) != 2 {
+		t.Fatalf("rcode %s, records %v", query.RcodeName(result.Rcode), result.Records)
+	}
+	if result.Records[0].Type != query.TYPE_CNAME || result.Records[1].Type != query.TYPE_A || net.IP(result.Records[1].Data).String() != "192.0.2.1" {
+		t.Errorf("records %v, want the CNAME then the A record", result.Records)
+	}
+
+	result, err = r.Lookup(context.Background(), "missing.example", query.TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rcode != query.RCODE_NXDOMAIN || len(result.Records) != 0 {
+		t.Errorf("rcode %s, records %v, want NXDOMAIN", query.RcodeName(result.Rcode), result.Records)
+	}
+	if result.SOA == nil || string(result.SOA.Name) != "example" {
+		t.Errorf("SOA %v, want the forwarder's", result.SOA)
+	}
+
+	if n := failingQueries.Load(); n != 2 {
+		t.Errorf("the failing forwarder was asked %d times, want 2", n)
+	}
+	if n := rootQueries.Load(); n != 0 {
+		t.Errorf("the roots were asked %d times", n)
+	}
+}
+
+func TestForwardAllFail(t *testing.T) {
+	failing := dnstest.Start(t, dnstest.Answer(func(string, uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+		return query.RCODE_REFUSED, nil, nil
+	}))
+	r := New(WithForwarders(failing.Addr), WithTimeouts(time.Second, 2*time.Second))
+	if result, err := r.Lookup(context.Background(), "www.example", query.TYPE_A); err == nil {
+		t.Errorf("got %+v, want an error", result)
+	}
+}
@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"recursive-dns-resolver/query"
+	"strings"
+)
+
+// Hosts holds the entries of an /etc/hosts format file, which answer A, AAAA and PTR lookups
+// before any recursion, the way the "files" source of a system resolver does
+type Hosts struct {
+	addrs map[string][]net.IP // by lower-case name
+	names map[string][]string // by reverse lookup name, e.g. 1.0.0.127.in-addr.arpa
+}
+
+// LoadHosts reads a hosts file
+func LoadHosts(path string) (*Hosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening hosts file: %w", err)
+	}
+	defer f.Close()
+	return ParseHosts(f)
+}
+
+// ParseHosts reads lines of an address followed by its canonical name and any aliases.
+// Everything after a # is a comment.
+func ParseHosts(r io.Reader) (*Hosts, error) {
+	h := &Hosts{addrs: make(map[string][]net.IP), names: make(map[string][]string)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// Scoped IPv6 addresses like fe80::1%eth0 cannot be returned in a record, so they are skipped
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		reverse := query.ReverseName(ip)
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			h.addrs[name] = append(h.addrs[name], ip)
+			h.names[reverse] = append(h.names[reverse], name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading hosts file: %w", err)
+	}
+	return h, nil
+}
+
+// lookup answers a query from the hosts file. It reports false when the file does not know
+// the name, so the lookup goes on to recursion. A name that is listed only with addresses of
+// the other family gets an empty answer, like a NODATA response.
+func (h *Hosts) lookup(name string, qtype uint16) ([]query.DNSRecord, bool) {
+	if h == nil {
+		return nil, false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var records []query.DNSRecord
+	switch qtype {
+	case query.TYPE_A, query.TYPE_AAAA:
+		ips, ok := h.addrs[name]
+		if !ok {
+			return nil, false
+		}
+		for _, ip := range ips {
+			record := query.DNSRecord{Name: []byte(name), Type: qtype, Class: 1}
+			if qtype == query.TYPE_A && ip.To4() != nil {
+				record.Data = ip.To4()
+			} else if qtype == query.TYPE_AAAA && ip.To4() == nil {
+				record.Data = ip.To16()
+			} else {
+				continue
+			}
+			records = append(records, record)
+		}
+	case query.TYPE_PTR:
+		names, ok := h.names[name]
+		if !ok {
+			return nil, false
+		}
+		// Only the first name of an address is its canonical name
+		records = append(records, query.DNSRecord{
+			Name:  []byte(name),
+			Type:  query.TYPE_PTR,
+			Class: 1,
+			Data:  query.EncodeName(names[0]),
+		})
+	default:
+		return nil, false
+	}
+	return records, true
+}
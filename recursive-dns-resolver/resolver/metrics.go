@@ -0,0 +1,43 @@
+package resolver
+
+import (
+	"recursive-dns-resolver/cache"
+	"recursive-dns-resolver/metrics"
+)
+
+// Metrics for every Resolver in the process. They are exposed by metrics.Handler.
+var (
+	lookupsTotal = metrics.NewCounterVec("dns_resolver_lookups_total",
+		"Client lookups by query type and response code.", "type", "rcode")
+	lookupDuration = metrics.NewHistogramVec("dns_resolver_lookup_duration_seconds",
+		"Time taken to answer client lookups by query type and response code.", nil, "type", "rcode")
+	cacheHits = metrics.NewCounterVec("dns_resolver_cache_hits_total",
+		"Lookups answered from the cache.")
+	cacheMisses = metrics.NewCounterVec("dns_resolver_cache_misses_total",
+		"Cacheable lookups that had to recurse.")
+	upstreamRTT = metrics.NewHistogramVec("dns_resolver_upstream_rtt_seconds",
+		"Round trip time of queries to authoritative servers.", nil, "server")
+	upstreamTimeouts = metrics.NewCounterVec("dns_resolver_upstream_timeouts_total",
+		"Queries to authoritative servers that timed out.", "server")
+	tcpFallbacks = metrics.NewCounterVec("dns_resolver_tcp_fallbacks_total",
+		"Truncated UDP responses retried over TCP.")
+	coalescedLookups = metrics.NewCounterVec("dns_resolver_coalesced_lookups_total",
+		"Lookups that joined an identical recursion already in flight.")
+	coalescedQueries = metrics.NewCounterVec("dns_resolver_coalesced_upstream_queries_total",
+		"Upstream queries that joined an identical query to the same server already in flight.")
+	policyRewrites = metrics.NewCounterVec("dns_resolver_policy_rewrites_total",
+		"Answer records changed by the answer policy, by policy.", "policy")
+	inflightRecursions = metrics.NewGaugeVec("dns_resolver_inflight_recursions",
+		"Iterative resolutions currently running.")
+)
+
+// RegisterCacheMetrics exposes the size and evictions of a cache. The values are read from the
+// cache itself on every scrape.
+func RegisterCacheMetrics(c *cache.DNSCache) {
+	metrics.NewGaugeFunc("dns_cache_entries", "Records currently held in the cache.", func() float64 {
+		return float64(c.Len())
+	})
+	metrics.NewCounterFunc("dns_cache_evictions_total", "Expired records removed from the cache.", func() float64 {
+		return float64(c.Evictions())
+	})
+}
@@ -0,0 +1,40 @@
+package resolver
+
+import (
+	"recursive-dns-resolver/query"
+	"strings"
+)
+
+// QNAME minimisation (RFC 9156) is switched on with Resolver.Minimise. Instead of sending
+// the full name to every server on the way down, each zone cut is only asked for one more
+// label than the zone it is authoritative for.
+
+// splitLabels breaks a domain name into its labels, ignoring the trailing root dot
+func splitLabels(domainName string) []string {
+	domainName = strings.Trim(domainName, ".")
+	if domainName == "" {
+		return nil
+	}
+	return strings.Split(domainName, ".")
+}
+
+// ancestorName returns the last n labels of domainName, e.g. ancestorName("www.example.com", 2) is "example.com"
+func ancestorName(domainName string, n int) string {
+	labels := splitLabels(domainName)
+	if n >= len(labels) {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// isMinimisationFailure reports whether a response to a minimised query looks like a
+// server that cannot handle it. Some authoritative servers answer NXDOMAIN, REFUSED or
+// SERVFAIL for empty non-terminals, so those are retried with the full name.
+func isMinimisationFailure(response *query.DNSPacket, knownLabels int) bool {
+	if query.GetRcode(*response) != query.RCODE_NOERROR {
+		return true
+	}
+	// A referral that does not take us below the zone we already know is lame
+	zone := query.GetReferralZone(*response)
+	return zone != "" && len(splitLabels(zone)) <= knownLabels
+}
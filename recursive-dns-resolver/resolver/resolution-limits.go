@@ -0,0 +1,81 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"recursive-dns-resolver/query"
+	"strings"
+)
+
+// resolution tracks the work done on behalf of a single Lookup. It is shared by everything
+// the lookup does, including resolving the names of glueless nameservers, so all of that
+// counts against the same budgets.
+type resolution struct {
+	*Resolver
+	ctx       context.Context
+	name      string
+	referrals int
+	queries   int
+	asked     map[string]bool // questions already sent to a server while resolving a name
+	pending   map[string]bool // name/type pairs currently being resolved
+	// subnet is sent as EDNS Client Subnet with the queries for the name being looked up, but
+	// not with those for the addresses of glueless nameservers (nameserverDepth > 0)
+	subnet          *query.ClientSubnet
+	nameserverDepth int
+}
+
+func (r *Resolver) newResolution(ctx context.Context, domainName string) *resolution {
+	return &resolution{
+		Resolver: r,
+		ctx:      ctx,
+		name:     domainName,
+		asked:    make(map[string]bool),
+		pending:  make(map[string]bool),
+	}
+}
+
+// beforeQuery is called before every upstream query and fails once the query budget or the
+// deadline is used up, or if the walk for domainName already sent the same question to the same server
+func (r *resolution) beforeQuery(domainName string, server string, qname string, recordType uint16) error {
+	if err := r.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &DeadlineError{Name: r.name, Timeout: r.ResolutionTimeout}
+		}
+		return err
+	}
+	r.queries++
+	if r.queries > r.MaxQueries {
+		return &LimitError{Name: r.name, Limit: "upstream queries", Max: r.MaxQueries}
+	}
+	key := fmt.Sprintf("%s|%s|%s|%d", strings.ToLower(domainName), server, strings.ToLower(qname), recordType)
+	if r.asked[key] {
+		return &LoopError{Name: r.name, Detail: fmt.Sprintf("%s asked twice for %s type %d", server, qname, recordType)}
+	}
+	r.asked[key] = true
+	return nil
+}
+
+// followReferral counts one step down the delegation tree
+func (r *resolution) followReferral() error {
+	r.referrals++
+	if r.referrals > r.MaxReferrals {
+		return &LimitError{Name: r.name, Limit: "referrals", Max: r.MaxReferrals}
+	}
+	return nil
+}
+
+// enter marks a name as being resolved. Resolving it again before leave is called means
+// the delegation depends on itself.
+func (r *resolution) enter(domainName string, recordType uint16) error {
+	key := fmt.Sprintf("%s|%d", strings.ToLower(domainName), recordType)
+	if r.pending[key] {
+		return &LoopError{Name: r.name, Detail: fmt.Sprintf("%s type %d depends on itself", domainName, recordType)}
+	}
+	r.pending[key] = true
+	return nil
+}
+
+func (r *resolution) leave(domainName string, recordType uint16) {
+	delete(r.pending, fmt.Sprintf("%s|%d", strings.ToLower(domainName), recordType))
+}
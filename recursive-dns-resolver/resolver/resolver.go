@@ -0,0 +1,499 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"recursive-dns-resolver/cache"
+	"recursive-dns-resolver/mdns"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/querylog"
+	"recursive-dns-resolver/socket"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver is an iterative resolver that can be embedded in other programs, in the same
+// spirit as net.Resolver. The zero value is not usable, create one with New.
+type Resolver struct {
+	// Roots are the servers every lookup starts from. An entry may carry a port, otherwise 53 is used.
+	Roots []string
+	// Forwarders, when set, answer every lookup in place of the roots: they are asked to
+	// recurse, in order, and their answer is taken as it is. Entries are written like Roots.
+	Forwarders []string
+	// Cache keeps A answers between lookups. Nil disables caching.
+	Cache *cache.DNSCache
+	// Dial opens the connection to a nameserver, like net.Resolver.Dial
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Network restricts which nameserver addresses are used: "ip4", "ip6", or "ip" (the
+	// default) for both, with IPv6 tried first and IPv4 started AttemptDelay later
+	Network      string
+	AttemptDelay time.Duration
+	// Timeout bounds each upstream query, ResolutionTimeout bounds a whole Lookup
+	Timeout           time.Duration
+	ResolutionTimeout time.Duration
+	Logger            *log.Logger
+	// QueryLog receives one event per query sent to an authoritative server. Nil disables it.
+	QueryLog *querylog.Logger
+
+	// Hosts answers A, AAAA and PTR lookups for the names it lists before any recursion. Nil disables it.
+	Hosts *Hosts
+	// MDNS resolves names under .local and link-local reverse names on the local link instead
+	// of sending them to the roots. Nil, the default, disables it.
+	MDNS *mdns.Client
+	// Search and Ndots complete short names in LookupSearch, like the search and ndots
+	// settings of resolv.conf
+	Search []string
+	Ndots  int
+
+	// Minimise turns on QNAME minimisation (RFC 9156)
+	Minimise bool
+	// Policy rewrites answers from authoritative servers before they are cached, and its
+	// overrides answer their names before any recursion. Nil leaves answers as they are.
+	Policy *AnswerPolicy
+
+	MaxReferrals  int
+	MaxQueries    int
+	MaxCNAMEDepth int
+
+	// ClientSubnetIPv4 and ClientSubnetIPv6 are how many bits of a client's address are sent
+	// upstream as EDNS Client Subnet (RFC 7871) for the lookups given one with
+	// ContextWithClientIP. 0 disables it for that address family.
+	ClientSubnetIPv4 int
+	ClientSubnetIPv6 int
+	// Cookies sends DNS cookies (RFC 7873) with every upstream query
+	Cookies bool
+	cookies *cookieJar
+
+	// lookups and exchanges coalesce identical work that is already in flight
+	lookups   flightGroup[*Result]
+	exchanges flightGroup[*query.DNSPacket]
+}
+
+// An Option changes one setting of a Resolver created with New
+type Option func(*Resolver)
+
+func WithRoots(roots ...string) Option {
+	return func(r *Resolver) { r.Roots = roots }
+}
+
+func WithCache(c *cache.DNSCache) Option {
+	return func(r *Resolver) { r.Cache = c }
+}
+
+// WithForwarders sends every lookup to the forwarders, in order, instead of iterating from
+// the roots
+func WithForwarders(forwarders ...string) Option {
+	return func(r *Resolver) { r.Forwarders = forwarders }
+}
+
+func WithDial(dial func(ctx context.Context, network, address string) (net.Conn, error)) Option {
+	return func(r *Resolver) { r.Dial = dial }
+}
+
+// WithTimeouts sets the timeout of a single upstream query and of a whole lookup
+func WithTimeouts(perQuery time.Duration, perLookup time.Duration) Option {
+	return func(r *Resolver) {
+		r.Timeout = perQuery
+		r.ResolutionTimeout = perLookup
+	}
+}
+
+// WithNetwork restricts the resolver to "ip4" or "ip6" nameservers, or allows both with "ip"
+func WithNetwork(network string) Option {
+	return func(r *Resolver) { r.Network = network }
+}
+
+func WithLogger(logger *log.Logger) Option {
+	return func(r *Resolver) { r.Logger = logger }
+}
+
+func WithQueryLog(queryLog *querylog.Logger) Option {
+	return func(r *Resolver) { r.QueryLog = queryLog }
+}
+
+func WithHosts(hosts *Hosts) Option {
+	return func(r *Resolver) { r.Hosts = hosts }
+}
+
+// WithMDNS resolves .local and link-local reverse names with multicast DNS through client.
+// Nil sends them to the roots like any other name.
+func WithMDNS(client *mdns.Client) Option {
+	return func(r *Resolver) { r.MDNS = client }
+}
+
+// WithSearch sets the search domains and ndots used by LookupSearch
+func WithSearch(domains []string, ndots int) Option {
+	return func(r *Resolver) {
+		r.Search = domains
+		r.Ndots = ndots
+	}
+}
+
+func WithAnswerPolicy(policy *AnswerPolicy) Option {
+	return func(r *Resolver) { r.Policy = policy }
+}
+
+func WithQNAMEMinimisation(enabled bool) Option {
+	return func(r *Resolver) { r.Minimise = enabled }
+}
+
+// WithLimits sets the referral, upstream query and CNAME chain budgets of each lookup
+func WithLimits(referrals int, queries int, cnameDepth int) Option {
+	return func(r *Resolver) {
+		r.MaxReferrals = referrals
+		r.MaxQueries = queries
+		r.MaxCNAMEDepth = cnameDepth
+	}
+}
+
+// WithClientSubnet sends the first ipv4 or ipv6 bits of the client's address upstream, e.g.
+// 24 and 56. 0 leaves that address family out.
+func WithClientSubnet(ipv4 int, ipv6 int) Option {
+	return func(r *Resolver) {
+		r.ClientSubnetIPv4 = ipv4
+		r.ClientSubnetIPv6 = ipv6
+	}
+}
+
+// WithCookies sends DNS cookies with every upstream query and checks the ones servers send
+// back, which makes spoofed responses to them harder
+func WithCookies(enabled bool) Option {
+	return func(r *Resolver) { r.Cookies = enabled }
+}
+
+// New creates a Resolver with sensible defaults, then applies the options in order
+func New(opts ...Option) *Resolver {
+	r := &Resolver{
+		Roots:             []string{rootServer, rootServerIPv6},
+		Dial:              socket.DialContext,
+		Network:           "ip",
+		AttemptDelay:      250 * time.Millisecond,
+		Timeout:           5 * time.Second,
+		ResolutionTimeout: 15 * time.Second,
+		Logger:            log.Default(),
+		MaxReferrals:      30,
+		MaxQueries:        100,
+		MaxCNAMEDepth:     8,
+		Ndots:             1,
+		cookies:           newCookieJar(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// DefaultResolver is used by the package level SendQuery and ResolveQuery functions
+var DefaultResolver = New()
+
+// Result is the outcome of a Lookup
+type Result struct {
+	Name  string
+	Type  uint16
+	Rcode uint16
+	// Records is the answer section, including any CNAMEs that were followed on the way
+	Records []query.DNSRecord
+	// SOA is the SOA record a negative answer (NXDOMAIN, or no records of Type) carried in its
+	// authority section, nil if there was none. Its TTL and minimum bound how long the absence
+	// may be cached (RFC 2308).
+	SOA *query.DNSRecord
+	// Server is the address of the nameserver that gave the final answer and
+	// ServerName its name, when a referral told us
+	Server     string
+	ServerName string
+	Cached     bool
+	// FromHosts is set when the answer came from the hosts file, FromPolicy when it is an
+	// override of the answer policy, FromMDNS when it came from a multicast DNS responder on
+	// the local link
+	FromHosts  bool
+	FromPolicy bool
+	FromMDNS   bool
+	// ClientSubnet is the client network the answer was given for through EDNS Client Subnet,
+	// nil when it is valid for every client
+	ClientSubnet *net.IPNet
+	Queries      int
+	Duration     time.Duration
+}
+
+// Lookup resolves name iteratively from the roots and returns the records of type qtype.
+// A name that does not exist or has no records of that type is not an error; the Rcode and
+// an empty Records slice say so.
+func (r *Resolver) Lookup(ctx context.Context, name string, qtype uint16) (result *Result, err error) {
+	start := time.Now()
+	defer func() {
+		rcode := query.RcodeName(query.RCODE_SERVFAIL)
+		if err == nil {
+			rcode = query.RcodeName(result.Rcode)
+		}
+		lookupsTotal.Inc(query.TypeName(qtype), rcode)
+		lookupDuration.Observe(time.Since(start).Seconds(), query.TypeName(qtype), rcode)
+	}()
+
+	if records, ok := r.Hosts.lookup(name, qtype); ok {
+		return &Result{
+			Name:      name,
+			Type:      qtype,
+			Records:   records,
+			FromHosts: true,
+			Duration:  time.Since(start),
+		}, nil
+	}
+
+	if records, ok := r.Policy.lookup(name, qtype); ok {
+		return &Result{
+			Name:       name,
+			Type:       qtype,
+			Records:    records,
+			FromPolicy: true,
+			Duration:   time.Since(start),
+		}, nil
+	}
+
+	if r.MDNS != nil && mdns.IsLocal(name) {
+		return r.lookupMDNS(ctx, name, qtype, start)
+	}
+
+	subnet := r.clientSubnet(ctx)
+	if qtype == query.TYPE_A && r.Cache != nil {
+		var record cache.CacheRecord
+		var ok bool
+		if subnet != nil {
+			record, ok = r.Cache.LookupScoped(name, subnet.IP, int(subnet.SourcePrefix))
+		} else {
+			record, ok = r.Cache.Lookup(name)
+		}
+		if ok {
+			cacheHits.Inc()
+			_, scope, _ := net.ParseCIDR(record.Scope)
+			return &Result{
+				Name:         name,
+				Type:         qtype,
+				Records:      []query.DNSRecord{cachedRecord(record)},
+				Cached:       true,
+				ClientSubnet: scope,
+				Duration:     time.Since(start),
+			}, nil
+		}
+		cacheMisses.Inc()
+	}
+
+	// Concurrent lookups of the same name and type for the same client network share one recursion
+	key := strings.ToLower(name) + "|" + strconv.Itoa(int(qtype))
+	if subnet != nil {
+		key += "|" + subnet.Network(subnet.SourcePrefix).String()
+	}
+	shared, coalesced, err := r.lookups.do(ctx, key, func() (*Result, error) {
+		return r.recurse(name, qtype, subnet)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if coalesced {
+		coalescedLookups.Inc()
+	}
+	// Every caller gets its own copy, the records themselves are never modified
+	result = &Result{}
+	*result = *shared
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// recurse does the iterative resolution behind Lookup and caches the answer. It is not tied
+// to any one caller's context because other callers may be waiting on it too. subnet is sent
+// upstream as EDNS Client Subnet unless it is nil.
+func (r *Resolver) recurse(name string, qtype uint16, subnet *query.ClientSubnet) (*Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.ResolutionTimeout)
+	defer cancel()
+	inflightRecursions.Inc()
+	defer inflightRecursions.Dec()
+	state := r.newResolution(ctx, name)
+	state.subnet = subnet
+	resolve := state.resolve
+	if len(r.Forwarders) > 0 {
+		resolve = state.forward
+	}
+	result, err := resolve(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	result.Queries = state.queries
+	r.Policy.apply(result)
+
+	if qtype == query.TYPE_A && r.Cache != nil {
+		if ip, ttl := query.GetAnswerIP(query.DNSPacket{Answers: result.Records}); ip != "" {
+			if err := r.Cache.AddScoped(name, net.ParseIP(ip), time.Duration(ttl)*time.Second, result.ClientSubnet); err != nil {
+				r.Logger.Printf("Error adding to cache: %v", err)
+			}
+		}
+	}
+	return result, nil
+}
+
+// LookupIP returns the addresses of host, completed with the search domains like net.Resolver
+// does. network is "ip", "ip4" or "ip6" as with net.Resolver.
+func (r *Resolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	var types []uint16
+	switch network {
+	case "ip":
+		types = []uint16{query.TYPE_A, query.TYPE_AAAA}
+	case "ip4":
+		types = []uint16{query.TYPE_A}
+	case "ip6":
+		types = []uint16{query.TYPE_AAAA}
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	// Like net.Resolver, the addresses of one family are returned even if the other lookup fails
+	var ips []net.IP
+	var lookupErr error
+	for _, qtype := range types {
+		result, err := r.LookupSearch(ctx, host, qtype)
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		for _, record := range result.Records {
+			if record.Type == qtype {
+				ips = append(ips, net.IP(record.Data))
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return ips, nil
+}
+
+// LookupCNAME returns the canonical name of host, or host itself if it is not an alias
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	result, err := r.Lookup(ctx, host, query.TYPE_A)
+	if err != nil {
+		return "", err
+	}
+	if target := query.GetAnswerCNAME(query.DNSPacket{Answers: result.Records}); target != "" {
+		return target, nil
+	}
+	return host, nil
+}
+
+// LookupNS returns the names of the nameservers of the zone name
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]string, error) {
+	result, err := r.Lookup(ctx, name, query.TYPE_NS)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, record := range result.Records {
+		if record.Type == query.TYPE_NS {
+			names = append(names, query.DecodeNSName(record.Data))
+		}
+	}
+	return names, nil
+}
+
+// LookupMX returns the mail exchangers of name sorted by preference
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]query.MXData, error) {
+	result, err := r.Lookup(ctx, name, query.TYPE_MX)
+	if err != nil {
+		return nil, err
+	}
+	var mxs []query.MXData
+	for _, record := range result.Records {
+		if record.Type != query.TYPE_MX {
+			continue
+		}
+		mx, err := query.DecodeMX(record.Data)
+		if err != nil {
+			return nil, err
+		}
+		mxs = append(mxs, mx)
+	}
+	sort.Slice(mxs, func(i, j int) bool { return mxs[i].Preference < mxs[j].Preference })
+	return mxs, nil
+}
+
+// LookupSRV looks up _service._proto.name like net.Resolver.LookupSRV and returns the
+// targets sorted by priority
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) ([]query.SRVData, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	result, err := r.Lookup(ctx, target, query.TYPE_SRV)
+	if err != nil {
+		return nil, err
+	}
+	var srvs []query.SRVData
+	for _, record := range result.Records {
+		if record.Type != query.TYPE_SRV {
+			continue
+		}
+		srv, err := query.DecodeSRV(record.Data)
+		if err != nil {
+			return nil, err
+		}
+		srvs = append(srvs, srv)
+	}
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	return srvs, nil
+}
+
+// LookupAddr returns the names an address maps back to through its PTR records
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	result, err := r.Lookup(ctx, query.ReverseName(ip), query.TYPE_PTR)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, record := range result.Records {
+		if record.Type == query.TYPE_PTR {
+			names = append(names, query.DecodeNSName(record.Data))
+		}
+	}
+	return names, nil
+}
+
+// lookupMDNS resolves a link-local name with a one-shot mDNS query. Nobody answering means the
+// name does not exist. The answers are not cached, as names on the link come and go.
+func (r *Resolver) lookupMDNS(ctx context.Context, name string, qtype uint16, start time.Time) (*Result, error) {
+	records, err := r.MDNS.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, fmt.Errorf("mDNS query for %s: %w", name, err)
+	}
+	result := &Result{Name: name, Type: qtype, Rcode: query.RCODE_NXDOMAIN, FromMDNS: true}
+	if len(records) > 0 {
+		result.Rcode = query.RCODE_NOERROR
+	}
+	for _, record := range records {
+		result.Records = append(result.Records, record.DNSRecord)
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// cachedRecord turns a cache entry back into an A record with whatever TTL it has left
+func cachedRecord(record cache.CacheRecord) query.DNSRecord {
+	ttl := time.Until(record.ExpiresAt) / time.Second
+	if ttl < 0 {
+		ttl = 0
+	}
+	return query.DNSRecord{
+		Name:  []byte(record.Domain),
+		Type:  query.TYPE_A,
+		Class: 1,
+		TTL:   uint32(ttl),
+		Data:  record.IPAddress.To4(),
+	}
+}
@@ -0,0 +1,47 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"recursive-dns-resolver/internal/dnstest"
+	"recursive-dns-resolver/query"
+	"testing"
+	"time"
+)
+
+// A failed lookup of one address family does not hide the addresses of the other
+func TestLookupIPPartial(t *testing.T) {
+	root := dnstest.Start(t, dnstest.Answer(func(name string, qtype uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+		switch {
+		case name == "v4.example" && qtype == query.TYPE_A:
+			return query.RCODE_NOERROR, []query.DNSRecord{dnstest.Record(name, query.TYPE_A, 300, []byte{192, 0, 2, 1})}, nil
+		case name == "v6.example" && qtype == query.TYPE_AAAA:
+			return query.RCODE_NOERROR, []query.DNSRecord{dnstest.Record(name, query.TYPE_AAAA, 300, net.ParseIP("2001:db8::1"))}, nil
+		case name == "empty.example":
+			return query.RCODE_NOERROR, nil, nil
+		}
+		return query.RCODE_SERVFAIL, nil, nil
+	}, dnstest.Authoritative))
+	r := New(WithRoots(root.Addr), WithQNAMEMinimisation(false), WithTimeouts(time.Second, 2*time.Second))
+
+	tests := []struct {
+		host    string
+		network string
+		want    string // the one address, empty for an error
+	}{
+		{"v4.example.", "ip", "192.0.2.1"},
+		{"v6.example.", "ip", "2001:db8::1"},
+		{"v4.example.", "ip6", ""},
+		{"broken.example.", "ip", ""},
+		{"empty.example.", "ip", ""},
+	}
+	for _, test := range tests {
+		ips, err := r.LookupIP(context.Background(), test.network, test.host)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("LookupIP(%s, %s) = %v, want an error", test.network, test.host, ips)
+		case test.want != "" && (err != nil || len(ips) != 1 || ips[0].String() != test.want):
+			t.Errorf("LookupIP(%s, %s) = %v, %v, want %s", test.network, test.host, ips, err, test.want)
+		}
+	}
+}
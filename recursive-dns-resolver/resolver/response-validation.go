@@ -0,0 +1,98 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"recursive-dns-resolver/query"
+	"strings"
+)
+
+// randomiseCase flips the case of every letter in the name at random (draft-vixie-dnsext-dns0x20).
+// Servers copy the question name back byte for byte, so an off-path attacker has to guess
+// the case pattern on top of the 16 bit query ID and the source port.
+func randomiseCase(domainName string) string {
+	name := []byte(domainName)
+	for i, c := range name {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if rand.Intn(2) == 0 {
+				name[i] = c ^ 0x20
+			}
+		}
+	}
+	return string(name)
+}
+
+// matchResponse checks that a packet really answers the query we sent: the ID must match,
+// the QR bit must be set and the question must be echoed back with the exact same case.
+func matchResponse(dnsquery []byte, response *query.DNSPacket, qname string, recordType uint16) error {
+	if id := binary.BigEndian.Uint16(dnsquery[0:2]); response.Header.ID != id {
+		return fmt.Errorf("response ID %d does not match query ID %d", response.Header.ID, id)
+	}
+	if response.Header.Flags&0x8000 == 0 {
+		return fmt.Errorf("packet is not a response")
+	}
+	if len(response.Questions) != 1 {
+		return fmt.Errorf("response has %d questions, expected 1", len(response.Questions))
+	}
+	question := response.Questions[0]
+	if string(question.Name) != strings.Trim(qname, ".") {
+		return fmt.Errorf("response question %q does not match %q", question.Name, qname)
+	}
+	if question.Type != recordType || question.Class != 1 {
+		return fmt.Errorf("response question type %d class %d does not match type %d", question.Type, question.Class, recordType)
+	}
+	return nil
+}
+
+// inBailiwick reports whether name is at or below zone. Every name is below the root zone "".
+func inBailiwick(name string, zone string) bool {
+	name = strings.ToLower(strings.Trim(name, "."))
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// sanitiseResponse drops records that the server had no business sending before anything
+// from the packet is used or cached. Records outside the zone the server is authoritative
+// for are removed from every section, answers must belong to qname or a CNAME chain
+// starting at it, and NS records must delegate a zone that contains qname.
+func sanitiseResponse(response *query.DNSPacket, qname string, zone string) {
+	owners := map[string]bool{strings.ToLower(strings.Trim(qname, ".")): true}
+	var answers []query.DNSRecord
+	for _, record := range response.Answers {
+		name := strings.ToLower(string(record.Name))
+		if !inBailiwick(name, zone) || !owners[name] {
+			continue
+		}
+		if record.Type == query.TYPE_CNAME {
+			owners[strings.ToLower(query.DecodeNSName(record.Data))] = true
+		}
+		// The server copies our randomised case into the owner name, so put back the name we were asked for
+		if strings.EqualFold(name, strings.Trim(qname, ".")) {
+			record.Name = []byte(strings.Trim(qname, "."))
+		}
+		answers = append(answers, record)
+	}
+	response.Answers = answers
+
+	var authorities []query.DNSRecord
+	for _, record := range response.Authorities {
+		name := string(record.Name)
+		if !inBailiwick(name, zone) {
+			continue
+		}
+		if record.Type == query.TYPE_NS && !inBailiwick(qname, name) {
+			continue
+		}
+		authorities = append(authorities, record)
+	}
+	response.Authorities = authorities
+
+	var additionals []query.DNSRecord
+	for _, record := range response.Additionals {
+		if inBailiwick(string(record.Name), zone) {
+			additionals = append(additionals, record)
+		}
+	}
+	response.Additionals = additionals
+}
@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"context"
+	"io"
+	"log"
+	"recursive-dns-resolver/internal/dnstest"
+	"recursive-dns-resolver/query"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRandomiseCase(t *testing.T) {
+	name := "www.example-1.com."
+	seen := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		randomised := randomiseCase(name)
+		if !strings.EqualFold(randomised, name) {
+			t.Fatalf("randomiseCase(%q) = %q changes more than the case", name, randomised)
+		}
+		seen[randomised] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("64 calls gave the same case every time: %v", seen)
+	}
+}
+
+// Responses that do not match the query are ignored, so a query that only gets forged ones
+// waits for the real answer until it times out
+func TestMatchResponse(t *testing.T) {
+	a := []query.DNSRecord{dnstest.Record("www.example", query.TYPE_A, 300, []byte{192, 0, 2, 1})}
+	tests := []struct {
+		name   string
+		tamper dnstest.Option
+		match  bool
+	}{
+		{"matching", func(*query.DNSPacket) {}, true},
+		{"wrong id", func(response *query.DNSPacket) { response.Header.ID++ }, false},
+		{"not a response", func(response *query.DNSPacket) { response.Header.Flags &^= query.FLAG_QR }, false},
+		{"question in another case", func(response *query.DNSPacket) {
+			name := []byte(string(response.Questions[0].Name))
+			for i, c := range name {
+				if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+					name[i] = c ^ 0x20
+				}
+			}
+			response.Questions[0].Name = name
+		}, false},
+		{"question of another type", func(response *query.DNSPacket) { response.Questions[0].Type = query.TYPE_AAAA }, false},
+		{"second question", func(response *query.DNSPacket) {
+			response.Questions = append(response.Questions, response.Questions[0])
+		}, false},
+		{"no question", func(response *query.DNSPacket) { response.Questions = nil }, false},
+	}
+	for _, test := range tests {
+		server := dnstest.Start(t, dnstest.Answer(func(string, uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+			return query.RCODE_NOERROR, a, nil
+		}, test.tamper))
+		r := New(WithTimeouts(200*time.Millisecond, time.Second))
+		r.Logger = log.New(io.Discard, "", 0)
+		response, err := r.sendQuery(context.Background(), "www.example", query.TYPE_A, server.Addr, nil)
+		switch {
+		case test.match && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.match && len(response.Answers) != 1:
+			t.Errorf("%s: answers %v", test.name, response.Answers)
+		case !test.match && err == nil:
+			t.Errorf("%s: the response was accepted", test.name)
+		}
+	}
+}
+
+func TestSanitiseResponse(t *testing.T) {
+	ns := func(name, target string) query.DNSRecord {
+		return dnstest.Record(name, query.TYPE_NS, 300, query.EncodeName(target))
+	}
+	a := func(name string) query.DNSRecord {
+		return dnstest.Record(name, query.TYPE_A, 300, []byte{192, 0, 2, 1})
+	}
+	cname := func(name, target string) query.DNSRecord {
+		return dnstest.Record(name, query.TYPE_CNAME, 300, query.EncodeName(target))
+	}
+	tests := []struct {
+		name        string
+		qname       string
+		zone        string
+		response    query.DNSPacket
+		answers     []string
+		authorities []string
+		additionals []string
+	}{
+		{
+			name:  "out of bailiwick records",
+			qname: "www.example.com",
+			zone:  "example.com",
+			response: query.DNSPacket{
+				Answers:     []query.DNSRecord{a("www.example.com"), a("www.example.net")},
+				Authorities: []query.DNSRecord{ns("example.com", "ns1.example.com"), ns("com", "ns.attacker.example")},
+				Additionals: []query.DNSRecord{a("ns1.example.com"), a("ns.attacker.example")},
+			},
+			answers:     []string{"www.example.com A"},
+			authorities: []string{"example.com NS"},
+			additionals: []string{"ns1.example.com A"},
+		},
+		{
+			name:  "answers off the cname chain",
+			qname: "www.example.com",
+			zone:  "example.com",
+			response: query.DNSPacket{
+				Answers: []query.DNSRecord{
+					cname("www.example.com", "web.example.com"), a("web.example.com"),
+					a("mail.example.com"), cname("ftp.example.com", "web.example.com"),
+				},
+			},
+			answers: []string{"www.example.com CNAME", "web.example.com A"},
+		},
+		{
+			name:  "cname chain leaving the zone",
+			qname: "www.example.com",
+			zone:  "example.com",
+			response: query.DNSPacket{
+				Answers: []query.DNSRecord{cname("www.example.com", "cdn.example.net"), a("cdn.example.net")},
+			},
+			answers: []string{"www.example.com CNAME"},
+		},
+		{
+			name:  "ns records not covering the qname",
+			qname: "www.example.com",
+			zone:  "com",
+			response: query.DNSPacket{
+				Authorities: []query.DNSRecord{ns("example.com", "ns1.example.com"), ns("other.com", "ns1.other.com"), ns("www.example.com.evil.com", "ns1.evil.com")},
+				Additionals: []query.DNSRecord{a("ns1.example.com"), a("ns1.other.com")},
+			},
+			authorities: []string{"example.com NS"},
+			additionals: []string{"ns1.example.com A", "ns1.other.com A"},
+		},
+		{
+			name:  "owner name case put back",
+			qname: "www.Example.com",
+			zone:  "example.com",
+			response: query.DNSPacket{
+				Answers: []query.DNSRecord{a("WWW.EXAMPLE.COM")},
+			},
+			answers: []string{"www.Example.com A"},
+		},
+	}
+	owners := func(records []query.DNSRecord) []string {
+		var names []string
+		for _, record := range records {
+			names = append(names, string(record.Name)+" "+query.TypeName(record.Type))
+		}
+		return names
+	}
+	for _, test := range tests {
+		response := test.response
+		sanitiseResponse(&response, test.qname, test.zone)
+		if got := owners(response.Answers); !slices.Equal(got, test.answers) {
+			t.Errorf("%s: answers %q, want %q", test.name, got, test.answers)
+		}
+		if got := owners(response.Authorities); !slices.Equal(got, test.authorities) {
+			t.Errorf("%s: authorities %q, want %q", test.name, got, test.authorities)
+		}
+		if got := owners(response.Additionals); !slices.Equal(got, test.additionals) {
+			t.Errorf("%s: additionals %q, want %q", test.name, got, test.additionals)
+		}
+	}
+}
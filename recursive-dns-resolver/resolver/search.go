@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"recursive-dns-resolver/query"
+	"strconv"
+	"strings"
+)
+
+// ReadResolvConf reads the search domains and ndots option of a resolv.conf file. The
+// nameserver lines are ignored, as we resolve from the roots ourselves.
+func ReadResolvConf(path string) (search []string, ndots int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening resolv.conf: %w", err)
+	}
+	defer f.Close()
+
+	ndots = 1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "search":
+			search = fields[1:]
+		case "domain":
+			// domain is the older single entry form, and the last of domain and search wins
+			if len(fields) > 1 {
+				search = fields[1:2]
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				if value, ok := strings.CutPrefix(option, "ndots:"); ok {
+					if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+						ndots = min(n, 15) // the same cap glibc applies
+					}
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("reading resolv.conf: %w", err)
+	}
+	return search, ndots, nil
+}
+
+// searchNames lists the names to try for name in order, the way a stub resolver applies its
+// search list. A name ending in a dot is absolute and tried alone. A name with at least Ndots
+// dots is tried as is before the search domains, any other name after them.
+func (r *Resolver) searchNames(name string) []string {
+	if strings.HasSuffix(name, ".") || len(r.Search) == 0 {
+		return []string{strings.TrimSuffix(name, ".")}
+	}
+	asIs := strings.Count(name, ".") >= r.Ndots
+	var names []string
+	if asIs {
+		names = append(names, name)
+	}
+	for _, domain := range r.Search {
+		names = append(names, name+"."+strings.Trim(domain, "."))
+	}
+	if !asIs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// LookupSearch is Lookup for names typed by a person, such as "db", which are completed with the
+// search domains. It returns the first candidate that has records of qtype. When none does,
+// it returns the first that exists without such records, or else the last NXDOMAIN.
+func (r *Resolver) LookupSearch(ctx context.Context, name string, qtype uint16) (*Result, error) {
+	var nodata, last *Result
+	for _, candidate := range r.searchNames(name) {
+		result, err := r.Lookup(ctx, candidate, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Records) > 0 {
+			return result, nil
+		}
+		if nodata == nil && result.Rcode == query.RCODE_NOERROR {
+			nodata = result
+		}
+		last = result
+	}
+	if nodata != nil {
+		return nodata, nil
+	}
+	return last, nil
+}
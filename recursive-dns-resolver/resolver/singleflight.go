@@ -0,0 +1,51 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls with the same key into one, in the manner of
+// golang.org/x/sync/singleflight. The zero value is ready to use.
+type flightGroup[T any] struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// do runs fn once for every key that is not already in flight. Callers that arrive while it
+// runs wait for the same result instead; shared tells them so. fn runs detached from the
+// callers, so one caller giving up does not fail the others, and ctx only bounds how long
+// this caller waits.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func() (T, error)) (value T, shared bool, err error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	call, inFlight := g.calls[key]
+	if !inFlight {
+		call = &flightCall[T]{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			call.value, call.err = fn()
+			g.mutex.Lock()
+			delete(g.calls, key)
+			g.mutex.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, inFlight, call.err
+	case <-ctx.Done():
+		var zero T
+		return zero, inFlight, ctx.Err()
+	}
+}
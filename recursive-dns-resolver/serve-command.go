@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"recursive-dns-resolver/blocklist"
+	"recursive-dns-resolver/cache"
+	"recursive-dns-resolver/config"
+	"recursive-dns-resolver/mdns"
+	"recursive-dns-resolver/metrics"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/querylog"
+	"recursive-dns-resolver/resolver"
+	"recursive-dns-resolver/server"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serveCommand runs the resolver as a DNS server for other clients. Settings come from the
+// -config file with the flags given on the command line on top. SIGHUP reads both again and
+// swaps in a server with the new settings, while the queries in flight finish with the old.
+func serveCommand(args []string) {
+	cfg, err := loadServeConfig(args)
+	if err != nil {
+		fmt.Println("Error in config:", err)
+		os.Exit(1)
+	}
+	if cfg.Log.File != "" {
+		f, err := os.OpenFile(cfg.Log.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Println("Error opening log file:", err)
+			os.Exit(1)
+		}
+		log.SetOutput(f)
+	}
+
+	dnsCache, err := cache.NewDNSCache(cfg.Cache.File)
+	if err != nil {
+		fmt.Println("Error loading cache:", err)
+		os.Exit(1)
+	}
+	dnsCache.SetMaxEntries(cfg.Cache.MaxEntries)
+	resolver.RegisterCacheMetrics(dnsCache)
+
+	queryLog, err := openQueryLog(cfg.Log.QueryLog, cfg.Log.QueryLogSample, cfg.Log.Dnstap)
+	if err != nil {
+		fmt.Println("Error opening query log:", err)
+		os.Exit(1)
+	}
+	// Close the query log on the way out so a dnstap stream ends with its STOP frame
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		queryLog.Close()
+		os.Exit(0)
+	}()
+
+	// The secret outlives reloads, so the server cookies clients hold stay valid
+	cookieSecret := make([]byte, 16)
+	rand.Read(cookieSecret)
+	dnsServer, err := buildServer(cfg, dnsCache, queryLog, cookieSecret)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if cfg.Server.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		// Ask for the blocklist on every request, a reload may have replaced it
+		mux.HandleFunc("/blocklist/reload", func(w http.ResponseWriter, req *http.Request) {
+			filter := dnsServer.Active().Blocklist
+			if filter == nil {
+				http.Error(w, "no blocklists are configured", http.StatusNotFound)
+				return
+			}
+			filter.ReloadHandler().ServeHTTP(w, req)
+		})
+		go func() {
+			log.Printf("Serving metrics on http://%s/metrics", cfg.Server.Metrics)
+			if err := http.ListenAndServe(cfg.Server.Metrics, mux); err != nil {
+				log.Fatalf("Metrics endpoint failed: %v", err)
+			}
+		}()
+	}
+
+	if cfg.Cache.Warmup != "" {
+		questions, err := loadWarmUp(cfg.Cache.Warmup)
+		if err != nil {
+			fmt.Println("Error reading -warmup:", err)
+			os.Exit(1)
+		}
+		warmUp(dnsServer.Resolver, questions, cfg.Cache.WarmupConcurrency)
+	}
+
+	// Reloads compare against what serve started with, as that is what the listeners and logs use
+	started := cfg
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			next, err := loadServeConfig(args)
+			if err != nil {
+				log.Printf("Not reloading, the config is invalid: %v", err)
+				continue
+			}
+			nextServer, err := buildServer(next, dnsCache, queryLog, cookieSecret)
+			if err != nil {
+				log.Printf("Not reloading: %v", err)
+				continue
+			}
+			for _, setting := range restartOnly(started, next) {
+				log.Printf("The new %s only takes effect after a restart", setting)
+			}
+			dnsCache.SetMaxEntries(next.Cache.MaxEntries)
+			dnsServer.Reload(nextServer)
+			log.Printf("Reloaded config")
+		}
+	}()
+
+	log.Printf("Answering DNS queries on %s", cfg.Server.Listen)
+	if err := dnsServer.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveFlags defines the flags of serve on top of the settings in cfg, so that only the flags
+// given on the command line change them. It also returns the -config flag.
+func serveFlags(cfg *config.Config) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := flags.String("config", "", "TOML file to read the settings from, flags given here override it and SIGHUP reloads it")
+	flags.StringVar(&cfg.Server.Listen, "listen", cfg.Server.Listen, "address to answer DNS queries on, over UDP and TCP")
+	flags.StringVar(&cfg.Server.Metrics, "metrics", cfg.Server.Metrics, "HTTP address for Prometheus metrics at /metrics and blocklist reloads at /blocklist/reload, e.g. 127.0.0.1:9153")
+	flags.StringVar(&cfg.Cache.File, "cache", cfg.Cache.File, "file the cache is kept in")
+	flags.IntVar(&cfg.Cache.MaxEntries, "cache-size", cfg.Cache.MaxEntries, "most records to keep in the cache, 0 for no limit")
+	flags.BoolVar(&cfg.Resolver.Minimise, "minimise", cfg.Resolver.Minimise, "only send each nameserver the labels it needs to see (RFC 9156)")
+	flags.StringVar(&cfg.Resolver.Network, "network", cfg.Resolver.Network, "nameserver address families to use: ip, ip4 or ip6")
+	flags.Var((*listFlag)(&cfg.Resolver.Roots), "roots", "comma separated root servers to start from instead of the built in ones")
+	flags.Var((*listFlag)(&cfg.Resolver.Forwarders), "forwarders", "comma separated resolvers to send every lookup to, in order, instead of recursing from the roots")
+	flags.StringVar(&cfg.Log.File, "log", cfg.Log.File, "write the server log to this file instead of stderr")
+	flags.StringVar(&cfg.Log.QueryLog, "querylog", cfg.Log.QueryLog, "write one JSON event per client and upstream query to this file, - for stdout")
+	flags.Float64Var(&cfg.Log.QueryLogSample, "querylog-sample", cfg.Log.QueryLogSample, "fraction of queries to log, between 0 and 1")
+	flags.StringVar(&cfg.Log.Dnstap, "dnstap", cfg.Log.Dnstap, "also write dnstap frames to this file, or to a collector at unix:/path")
+	flags.Var((*listFlag)(&cfg.Blocklist.Files), "blocklist", "comma separated hosts files and RPZ zones (.rpz or .zone) of names to filter")
+	flags.StringVar(&cfg.Blocklist.Action, "block-action", cfg.Blocklist.Action, "answer for names blocked by a hosts file: nxdomain, nodata or sinkhole")
+	flags.Var((*listFlag)(&cfg.Blocklist.Sinkhole), "sinkhole", "comma separated addresses to answer with when -block-action is sinkhole")
+	flags.BoolVar(&cfg.Resolver.MDNS, "mdns", cfg.Resolver.MDNS, "resolve .local and link-local reverse names with multicast DNS on the local link")
+	flags.StringVar(&cfg.Resolver.Hosts, "hosts", cfg.Resolver.Hosts, "hosts file to answer A, AAAA and PTR queries from before recursing")
+	flags.Var((*listFlag)(&cfg.Server.Allow), "allow", "comma separated networks that may use the server, others get REFUSED")
+	flags.Float64Var(&cfg.Server.QueryRate, "query-rate", cfg.Server.QueryRate, "queries per second allowed from each /24 or /56 client prefix, 0 for no limit")
+	flags.Float64Var(&cfg.Server.RRLRate, "rrl-rate", cfg.Server.RRLRate, "identical UDP responses per second sent to each client prefix, 0 for no response rate limiting")
+	flags.IntVar(&cfg.Server.RRLSlip, "rrl-slip", cfg.Server.RRLSlip, "send every n-th rate limited response truncated instead of dropping it, 0 to always drop")
+	flags.Var((*listFlag)(&cfg.Server.TSIGKeys), "tsig-keys", "comma separated TSIG keys, as [hmac-sha256:]name:base64secret, to verify signed queries with")
+	flags.BoolVar(&cfg.Server.RequireTSIG, "require-tsig", cfg.Server.RequireTSIG, "refuse queries that are not signed with one of -tsig-keys")
+	flags.Var(&subnetFlag{&cfg.Resolver.ECSIPv4, &cfg.Resolver.ECSIPv6}, "ecs", "send this many bits of client addresses upstream as EDNS Client Subnet, as ipv4,ipv6 prefix lengths, e.g. 24,56")
+	flags.BoolVar(&cfg.Server.Cookies, "cookies", cfg.Server.Cookies, "send DNS cookies upstream and answer clients that send them with server cookies")
+	flags.BoolVar(&cfg.Server.DNS64, "dns64", cfg.Server.DNS64, "synthesise AAAA records from A records for names without IPv6 addresses (RFC 6147)")
+	flags.StringVar(&cfg.Server.DNS64Prefix, "dns64-prefix", cfg.Server.DNS64Prefix, "NAT64 prefix to synthesise AAAA records in")
+	flags.Var((*listFlag)(&cfg.Server.DNS64Exclude), "dns64-exclude", "comma separated networks whose addresses DNS64 neither returns nor synthesises from")
+	flags.IntVar(&cfg.Policy.MinTTL, "min-ttl", cfg.Policy.MinTTL, "raise answer TTLs below this many seconds to it, 0 to leave them")
+	flags.IntVar(&cfg.Policy.MaxTTL, "max-ttl", cfg.Policy.MaxTTL, "lower answer TTLs above this many seconds to it, 0 to leave them")
+	flags.BoolVar(&cfg.Policy.RebindingProtection, "rebinding-protection", cfg.Policy.RebindingProtection, "remove private, loopback and link-local addresses from answers for names outside -private-domains")
+	flags.Var((*listFlag)(&cfg.Policy.PrivateDomains), "private-domains", "comma separated domains whose names may resolve to private addresses")
+	flags.Var((*listFlag)(&cfg.Policy.Overrides), "override", "comma separated records, as name [ttl] type data, to answer with instead of what the authoritative servers say")
+	flags.StringVar(&cfg.Cache.Warmup, "warmup", cfg.Cache.Warmup, "file with one name per line to resolve into the cache before answering queries")
+	flags.IntVar(&cfg.Cache.WarmupConcurrency, "warmup-concurrency", cfg.Cache.WarmupConcurrency, "how many -warmup names to resolve at a time")
+	return flags, configFile
+}
+
+// loadServeConfig reads the -config file, if any, and applies the flags in args on top of it.
+// The flags are parsed twice: first to find -config, then again over what the file set.
+func loadServeConfig(args []string) (*config.Config, error) {
+	flags, configFile := serveFlags(config.Default())
+	flags.Parse(args)
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	flags, _ = serveFlags(cfg)
+	flags.Parse(args)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// restartOnly returns the settings that differ between two configs but are only read when
+// serve starts: the listeners, the cache file and where logs go
+func restartOnly(old *config.Config, next *config.Config) []string {
+	var changed []string
+	for setting, differs := range map[string]bool{
+		"server.listen":  old.Server.Listen != next.Server.Listen,
+		"server.metrics": old.Server.Metrics != next.Server.Metrics,
+		"cache.file":     old.Cache.File != next.Cache.File,
+		"log.file":       old.Log.File != next.Log.File,
+		"log.querylog":   old.Log.QueryLog != next.Log.QueryLog || old.Log.QueryLogSample != next.Log.QueryLogSample,
+		"log.dnstap":     old.Log.Dnstap != next.Log.Dnstap,
+	} {
+		if differs {
+			changed = append(changed, setting)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// buildServer creates the server and resolver for a config. The cache, query log and cookie
+// secret are shared by every server a reload creates.
+func buildServer(cfg *config.Config, dnsCache *cache.DNSCache, queryLog *querylog.Logger, cookieSecret []byte) (*server.Server, error) {
+	r := resolver.New(
+		resolver.WithCache(dnsCache),
+		resolver.WithQNAMEMinimisation(cfg.Resolver.Minimise),
+		resolver.WithNetwork(cfg.Resolver.Network),
+		resolver.WithTimeouts(cfg.Resolver.Timeout, cfg.Resolver.ResolutionTimeout),
+		resolver.WithLimits(cfg.Resolver.MaxReferrals, cfg.Resolver.MaxQueries, cfg.Resolver.MaxCNAMEDepth),
+		resolver.WithClientSubnet(cfg.Resolver.ECSIPv4, cfg.Resolver.ECSIPv6),
+		resolver.WithCookies(cfg.Server.Cookies),
+		resolver.WithQueryLog(queryLog),
+	)
+	r.AttemptDelay = cfg.Resolver.AttemptDelay
+	r.Policy = answerPolicy(cfg.Policy)
+	if len(cfg.Resolver.Roots) > 0 {
+		r.Roots = cfg.Resolver.Roots
+	}
+	r.Forwarders = cfg.Resolver.Forwarders
+	if cfg.Resolver.MDNS {
+		r.MDNS = mdns.NewClient()
+	}
+	if cfg.Resolver.Hosts != "" {
+		hosts, err := resolver.LoadHosts(cfg.Resolver.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("error loading hosts file: %w", err)
+		}
+		r.Hosts = hosts
+	}
+	filter, err := openBlocklist(cfg.Blocklist.Files, cfg.Blocklist.Action, cfg.Blocklist.Sinkhole)
+	if err != nil {
+		return nil, fmt.Errorf("error loading blocklist: %w", err)
+	}
+
+	// The settings were validated with the config, so parsing them again cannot fail
+	s := server.New(cfg.Server.Listen, r)
+	s.Timeout = cfg.Server.Timeout
+	s.QueryLog = queryLog
+	s.Blocklist = filter
+	s.AllowRecursion, _ = server.ParseACL(cfg.Server.Allow)
+	// Both limits allow bursts of one second's worth of traffic
+	if cfg.Server.QueryRate > 0 {
+		s.QueryLimit = server.NewRateLimit(cfg.Server.QueryRate, cfg.Server.QueryRate, 0)
+	}
+	if cfg.Server.RRLRate > 0 {
+		s.ResponseLimit = server.NewRateLimit(cfg.Server.RRLRate, cfg.Server.RRLRate, cfg.Server.RRLSlip)
+	}
+	if len(cfg.Server.TSIGKeys) > 0 {
+		s.TSIGKeys = make(map[string]query.TSIGKey)
+		for _, spec := range cfg.Server.TSIGKeys {
+			key, _ := query.ParseTSIGKey(spec)
+			s.TSIGKeys[key.Name] = key
+		}
+	}
+	s.RequireTSIG = cfg.Server.RequireTSIG
+	if cfg.Server.DNS64 {
+		s.DNS64Prefix, _ = server.ParseDNS64Prefix(cfg.Server.DNS64Prefix)
+		s.DNS64Exclude, _ = server.ParseACL(cfg.Server.DNS64Exclude)
+	}
+	if cfg.Server.Cookies {
+		s.CookieSecret = cookieSecret
+	}
+	return s, nil
+}
+
+// answerPolicy creates the answer policy of a config, or returns nil when it changes nothing
+func answerPolicy(cfg config.PolicyConfig) *resolver.AnswerPolicy {
+	if cfg.MinTTL == 0 && cfg.MaxTTL == 0 && !cfg.RebindingProtection && len(cfg.Overrides) == 0 {
+		return nil
+	}
+	policy := &resolver.AnswerPolicy{
+		MinTTL:         uint32(cfg.MinTTL),
+		MaxTTL:         uint32(cfg.MaxTTL),
+		StripPrivate:   cfg.RebindingProtection,
+		PrivateDomains: cfg.PrivateDomains,
+	}
+	for _, spec := range cfg.Overrides {
+		record, _ := resolver.ParseOverride(spec)
+		policy.AddOverride(record)
+	}
+	return policy
+}
+
+// listFlag is a flag holding a comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// subnetFlag is the -ecs flag, which sets the IPv4 and IPv6 prefix lengths together
+type subnetFlag struct {
+	ipv4 *int
+	ipv6 *int
+}
+
+func (f *subnetFlag) String() string {
+	if f.ipv4 == nil || (*f.ipv4 == 0 && *f.ipv6 == 0) {
+		return ""
+	}
+	return fmt.Sprintf("%d,%d", *f.ipv4, *f.ipv6)
+}
+
+func (f *subnetFlag) Set(value string) error {
+	ipv4, ipv6, err := parseSubnetPrefixes(value)
+	if err != nil {
+		return err
+	}
+	*f.ipv4, *f.ipv6 = ipv4, ipv6
+	return nil
+}
+
+// loadWarmUp reads the names to warm the cache up with. The cache only keeps A records, so a
+// name listed with any other type could only waste a lookup and is refused.
+func loadWarmUp(file string) ([]benchQuestion, error) {
+	questions, err := loadBenchQuestions(file, nil, query.TYPE_A)
+	if err != nil {
+		return nil, err
+	}
+	for _, question := range questions {
+		if question.qtype != query.TYPE_A {
+			return nil, fmt.Errorf("%s is listed with type %s, only A records are cached", question.name, query.TypeName(question.qtype))
+		}
+	}
+	return questions, nil
+}
+
+// warmUp resolves a list of names to fill the cache before the server takes queries. Only
+// concurrency lookups run at a time, so a restart does not send the authoritative servers a
+// burst of queries for every popular name at once.
+func warmUp(r *resolver.Resolver, questions []benchQuestion, concurrency int) {
+	start := time.Now()
+	log.Printf("Warming up the cache with %d names", len(questions))
+	var failed atomic.Int64
+	slots := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for _, question := range questions {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), r.ResolutionTimeout)
+			defer cancel()
+			if _, err := r.Lookup(ctx, question.name, question.qtype); err != nil {
+				log.Printf("Warm-up lookup of %s failed: %v", question.name, err)
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	log.Printf("Warmed up %d of %d names in %s", len(questions)-int(failed.Load()), len(questions), time.Since(start).Round(time.Millisecond))
+}
+
+// parseSubnetPrefixes parses the IPv4 and IPv6 prefix lengths of -ecs. A single number only
+// enables IPv4.
+func parseSubnetPrefixes(spec string) (int, int, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("expected ipv4,ipv6 prefix lengths, got %q", spec)
+	}
+	var prefixes [2]int
+	for i, part := range parts {
+		prefix, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || prefix < 0 || prefix > []int{32, 128}[i] {
+			return 0, 0, fmt.Errorf("invalid prefix length %q", part)
+		}
+		prefixes[i] = prefix
+	}
+	return prefixes[0], prefixes[1], nil
+}
+
+// openQueryLog sets up the structured query log, or returns nil when neither JSON nor dnstap output is wanted
+func openQueryLog(file string, sampleRate float64, dnstap string) (*querylog.Logger, error) {
+	if file == "" && dnstap == "" {
+		return nil, nil
+	}
+	var out io.Writer
+	switch file {
+	case "":
+	case "-":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	queryLog := querylog.New(out, sampleRate)
+	if dnstap != "" {
+		frames, err := querylog.OpenFrameWriter(dnstap)
+		if err != nil {
+			return nil, err
+		}
+		queryLog.SetDnstap(frames)
+	}
+	return queryLog, nil
+}
+
+// openBlocklist loads the blocklists, or returns nil when none are given
+func openBlocklist(files []string, actionName string, sinkhole []string) (*blocklist.Blocklist, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	action, err := blocklist.ParseAction(actionName)
+	if err != nil {
+		return nil, err
+	}
+	if action != blocklist.ActionNXDOMAIN && action != blocklist.ActionNODATA && action != blocklist.ActionSinkhole {
+		return nil, fmt.Errorf("-block-action must be nxdomain, nodata or sinkhole")
+	}
+	var addresses []net.IP
+	for _, addr := range sinkhole {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid sinkhole address %q", addr)
+		}
+		addresses = append(addresses, ip)
+	}
+	filter := blocklist.New(files, action, addresses)
+	count, err := filter.Reload()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d blocklist rules", count)
+	return filter, nil
+}
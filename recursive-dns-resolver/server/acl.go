@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultRecursionACL lets loopback and private networks recurse, like BIND's default of
+// "localhost; localnets;"
+var DefaultRecursionACL = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// ParseACL parses a list of networks in CIDR notation. A bare address is taken as a single host.
+func ParseACL(networks []string) ([]*net.IPNet, error) {
+	var acl []*net.IPNet
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network in ACL: %w", err)
+		}
+		acl = append(acl, ipNet)
+	}
+	return acl, nil
+}
+
+// mayRecurse reports whether a client is allowed to use the server. A nil ACL allows everyone.
+func (s *Server) mayRecurse(ip net.IP) bool {
+	if s.AllowRecursion == nil {
+		return true
+	}
+	for _, network := range s.AllowRecursion {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of a client
+func clientIP(client net.Addr) net.IP {
+	switch addr := client.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(client.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"recursive-dns-resolver/query"
+	"time"
+)
+
+// Server cookies (RFC 7873) use the layout of RFC 9018: version 1, three reserved bytes, the
+// time the cookie was made and an eight byte hash over the client cookie, those fields and the
+// client's address. The hash is a truncated HMAC-SHA256 keyed with CookieSecret.
+const (
+	cookieVersion   = 1
+	cookieLifetime  = time.Hour       // how old a server cookie may be before it is no longer valid
+	cookieClockSkew = 5 * time.Minute // how far in the future a server cookie may be dated
+)
+
+// serverCookie returns the server cookie for a client cookie from ip, made at now
+func (s *Server) serverCookie(client []byte, ip net.IP, now time.Time) []byte {
+	cookie := []byte{cookieVersion, 0, 0, 0}
+	cookie = binary.BigEndian.AppendUint32(cookie, uint32(now.Unix()))
+	mac := hmac.New(sha256.New, s.CookieSecret)
+	mac.Write(client)
+	mac.Write(cookie)
+	mac.Write(ip.To16())
+	return append(cookie, mac.Sum(nil)[:8]...)
+}
+
+// validCookie reports whether data, the COOKIE option of a request from ip, carries a server
+// cookie we made recently for this client
+func (s *Server) validCookie(data []byte, ip net.IP, now time.Time) bool {
+	client, server, err := query.DecodeCookie(data)
+	if err != nil || len(server) != 16 || server[0] != cookieVersion {
+		return false
+	}
+	made := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if made.Before(now.Add(-cookieLifetime)) || made.After(now.Add(cookieClockSkew)) {
+		return false
+	}
+	expected := s.serverCookie(client, ip, made)
+	return hmac.Equal(server, expected)
+}
+
+// cookieOption returns the COOKIE option for the response to a request that sent one: its
+// client cookie followed by a fresh server cookie. It returns nil when cookies are disabled or
+// the request has no well-formed cookie.
+func (s *Server) cookieOption(request query.DNSPacket, client net.Addr) *query.EDNSOption {
+	if s.CookieSecret == nil {
+		return nil
+	}
+	data, ok := query.GetOption(request, query.OPTION_COOKIE)
+	if !ok {
+		return nil
+	}
+	clientCookie, _, err := query.DecodeCookie(data)
+	if err != nil {
+		return nil
+	}
+	cookie := append(append([]byte(nil), clientCookie...), s.serverCookie(clientCookie, clientIP(client), time.Now())...)
+	return &query.EDNSOption{Code: query.OPTION_COOKIE, Data: cookie}
+}
+
+// malformedCookie reports whether a request carries a COOKIE option that cannot be decoded,
+// which is answered with FORMERR
+func (s *Server) malformedCookie(request query.DNSPacket) bool {
+	if s.CookieSecret == nil {
+		return false
+	}
+	data, ok := query.GetOption(request, query.OPTION_COOKIE)
+	if !ok {
+		return false
+	}
+	_, _, err := query.DecodeCookie(data)
+	return err != nil
+}
+
+// hasValidCookie reports whether a request from ip carries a valid server cookie, which
+// proves the client got a response from us before at that address. The request is read in
+// place, as this runs before it is parsed.
+func (s *Server) hasValidCookie(message []byte, ip net.IP) bool {
+	if s.CookieSecret == nil {
+		return false
+	}
+	var parsed query.Message
+	if parsed.Reset(message) != nil {
+		return false
+	}
+	for {
+		record, ok, err := parsed.NextRecord()
+		if err != nil || !ok {
+			return false
+		}
+		if record.Section != query.SectionAdditional || record.Type != query.TYPE_OPT {
+			continue
+		}
+		options, err := query.Options(query.DNSRecord{Data: record.Data})
+		if err != nil {
+			return false
+		}
+		for _, option := range options {
+			if option.Code == query.OPTION_COOKIE {
+				return s.validCookie(option.Data, ip, time.Now())
+			}
+		}
+		return false
+	}
+}
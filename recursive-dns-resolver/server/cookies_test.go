@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidCookie(t *testing.T) {
+	s := &Server{CookieSecret: []byte("0123456789abcdef")}
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Unix(1700000000, 0)
+	cookieAt := func(made time.Time) []byte {
+		return append(append([]byte(nil), client...), s.serverCookie(client, ip, made)...)
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		ip    string
+		valid bool
+	}{
+		{"fresh", cookieAt(now), "192.0.2.1", true},
+		{"nearly expired", cookieAt(now.Add(-cookieLifetime + time.Second)), "192.0.2.1", true},
+		{"expired", cookieAt(now.Add(-cookieLifetime - time.Second)), "192.0.2.1", false},
+		{"dated within the clock skew", cookieAt(now.Add(cookieClockSkew - time.Second)), "192.0.2.1", true},
+		{"dated too far ahead", cookieAt(now.Add(cookieClockSkew + time.Second)), "192.0.2.1", false},
+		{"from another address", cookieAt(now), "192.0.2.2", false},
+		{"same address as IPv4-mapped IPv6", cookieAt(now), "::ffff:192.0.2.1", true},
+		{"for another client cookie", append([]byte{8, 7, 6, 5, 4, 3, 2, 1}, s.serverCookie(client, ip, now)...), "192.0.2.1", false},
+		{"client cookie only", client, "192.0.2.1", false},
+		{"made with another secret", append(append([]byte(nil), client...), (&Server{CookieSecret: []byte("another secret")}).serverCookie(client, ip, now)...), "192.0.2.1", false},
+	}
+	for _, test := range tests {
+		if got := s.validCookie(test.data, net.ParseIP(test.ip), now); got != test.valid {
+			t.Errorf("%s: validCookie = %v, want %v", test.name, got, test.valid)
+		}
+	}
+
+	// A cookie whose time was moved forward no longer matches its hash
+	tampered := cookieAt(now.Add(-2 * cookieLifetime))
+	copy(tampered[12:16], cookieAt(now)[12:16])
+	if s.validCookie(tampered, ip, now) {
+		t.Error("a cookie with a rewritten time was accepted")
+	}
+	// Another version of the layout is not ours to check
+	other := cookieAt(now)
+	other[8] = 2
+	if s.validCookie(other, ip, now) {
+		t.Error("a cookie of another version was accepted")
+	}
+}
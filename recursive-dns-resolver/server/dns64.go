@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+)
+
+// DNS64 (RFC 6147) lets IPv6-only clients reach IPv4-only names through a NAT64 gateway. An
+// AAAA query for a name without usable IPv6 addresses is answered with its IPv4 addresses
+// embedded in the NAT64 prefix as RFC 6052 describes, and PTR queries for such synthesised
+// addresses are redirected to the in-addr.arpa name of the embedded IPv4 address.
+
+// DefaultDNS64Prefix is the Well-Known Prefix of RFC 6052
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// DefaultDNS64Exclude leaves out IPv4-mapped addresses, which no IPv6-only client can use
+// (RFC 6147 section 5.1.4)
+var DefaultDNS64Exclude = []string{"::ffff:0:0/96"}
+
+// dns64CNAMETTL is the TTL of the CNAME record that redirects a reverse lookup, and
+// dns64DefaultTTL the longest TTL of a synthesised AAAA record when the AAAA answer did not
+// say how long it may be cached
+const (
+	dns64CNAMETTL   = 600
+	dns64DefaultTTL = 600
+)
+
+// ParseDNS64Prefix parses a NAT64 prefix. RFC 6052 allows lengths of 32, 40, 48, 56, 64 and
+// 96 bits, and bits 64 to 71 must be zero.
+func ParseDNS64Prefix(prefix string) (*net.IPNet, error) {
+	ip, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix: %w", err)
+	}
+	ones, bits := network.Mask.Size()
+	if ip.To4() != nil || bits != 128 {
+		return nil, fmt.Errorf("DNS64 prefix %s is not an IPv6 prefix", prefix)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("DNS64 prefix %s must be 32, 40, 48, 56, 64 or 96 bits long", prefix)
+	}
+	if network.IP[8] != 0 {
+		return nil, fmt.Errorf("DNS64 prefix %s sets bits 64 to 71, which must be zero", prefix)
+	}
+	return network, nil
+}
+
+// embedIPv4 synthesises the IPv6 address of ip4 in prefix. The IPv4 address follows the
+// prefix and skips the reserved octet at bits 64 to 71, the rest stays zero.
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP[:ones/8])
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// extractIPv4 returns the IPv4 address embedded in an address synthesised by embedIPv4
+func extractIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip4 := make(net.IP, 0, net.IPv4len)
+	for pos := ones / 8; len(ip4) < net.IPv4len; pos++ {
+		if pos != 8 {
+			ip4 = append(ip4, ip[pos])
+		}
+	}
+	return ip4
+}
+
+// dns64Excluded reports whether the data of an A or AAAA record is in one of the DNS64Exclude
+// networks of its own address family. net.IPNet.Contains would take ::ffff:0:0/96 to hold
+// every IPv4 address and so exclude all A records.
+func (s *Server) dns64Excluded(ip net.IP) bool {
+	for _, network := range s.DNS64Exclude {
+		prefix := network.IP.To16()
+		if len(network.Mask) == net.IPv4len {
+			prefix = network.IP.To4()
+		}
+		if len(ip) != len(network.Mask) || len(prefix) != len(ip) {
+			continue
+		}
+		if ip.Mask(network.Mask).Equal(prefix.Mask(network.Mask)) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves a question for a client, with DNS64 applied when DNS64Prefix is set
+func (s *Server) lookup(ctx context.Context, name string, qtype uint16) (*resolver.Result, error) {
+	if s.DNS64Prefix != nil && qtype == query.TYPE_PTR {
+		if ip := query.ParseReverseName(name); ip != nil && ip.To4() == nil && s.DNS64Prefix.Contains(ip) {
+			return s.synthesisePTR(ctx, name, extractIPv4(s.DNS64Prefix, ip))
+		}
+	}
+	result, err := s.Resolver.Lookup(ctx, name, qtype)
+	if s.DNS64Prefix == nil || qtype != query.TYPE_AAAA {
+		return result, err
+	}
+	if err == nil && result.Rcode == query.RCODE_NXDOMAIN {
+		// A name that does not exist has no A records either, so NXDOMAIN is passed on as is
+		return result, nil
+	}
+	return s.synthesiseAAAA(ctx, name, result, err)
+}
+
+// synthesiseAAAA returns the AAAA answer for name given what the AAAA lookup returned.
+// Addresses in DNS64Exclude are dropped from a native answer, and if none are left the AAAA
+// records are synthesised from the A records found by the usual lookup. A failed AAAA lookup
+// is treated as having no AAAA records (RFC 6147 section 5.1.2). When the A lookup fails too,
+// the AAAA result and error are returned unchanged.
+func (s *Server) synthesiseAAAA(ctx context.Context, name string, result *resolver.Result, aaaaErr error) (*resolver.Result, error) {
+	var records []query.DNSRecord
+	if aaaaErr == nil && result.Rcode == query.RCODE_NOERROR {
+		native := false
+		for _, record := range result.Records {
+			if record.Type == query.TYPE_AAAA {
+				if s.dns64Excluded(net.IP(record.Data)) {
+					continue
+				}
+				native = true
+			}
+			records = append(records, record)
+		}
+		if native {
+			filtered := *result
+			filtered.Records = records
+			return &filtered, nil
+		}
+	}
+
+	aResult, err := s.Resolver.Lookup(ctx, name, query.TYPE_A)
+	if err != nil || aResult.Rcode != query.RCODE_NOERROR {
+		return result, aaaaErr
+	}
+	maxTTL := dns64TTL(result, aaaaErr)
+	records = nil
+	synthesised := 0
+	for _, record := range aResult.Records {
+		switch record.Type {
+		case query.TYPE_A:
+			if s.dns64Excluded(net.IP(record.Data)) {
+				continue
+			}
+			record.Type = query.TYPE_AAAA
+			record.Data = embedIPv4(s.DNS64Prefix, net.IP(record.Data))
+			record.TTL = min(record.TTL, maxTTL)
+			synthesised++
+		case query.TYPE_CNAME:
+		default:
+			continue
+		}
+		records = append(records, record)
+	}
+	if synthesised == 0 {
+		return result, aaaaErr
+	}
+	dns64Synthesised.Inc("AAAA")
+	answer := *aResult
+	answer.Type = query.TYPE_AAAA
+	answer.Records = records
+	answer.SOA = nil
+	return &answer, nil
+}
+
+// dns64TTL returns the longest TTL a synthesised AAAA record may have: no longer than the
+// absence of AAAA records may be cached, which the SOA of the negative AAAA answer says
+// (RFC 6147 section 5.1.7), or dns64DefaultTTL when that answer had no SOA
+func dns64TTL(result *resolver.Result, err error) uint32 {
+	if err != nil || result.SOA == nil {
+		return dns64DefaultTTL
+	}
+	soa, decodeErr := query.DecodeSOA(result.SOA.Data)
+	if decodeErr != nil {
+		return dns64DefaultTTL
+	}
+	return min(result.SOA.TTL, soa.Minimum)
+}
+
+// synthesisePTR answers a reverse lookup of a synthesised address with a CNAME to the
+// in-addr.arpa name of the IPv4 address embedded in it, followed by whatever that name holds
+func (s *Server) synthesisePTR(ctx context.Context, name string, ip4 net.IP) (*resolver.Result, error) {
+	target := query.ReverseName(ip4)
+	result, err := s.Resolver.Lookup(ctx, target, query.TYPE_PTR)
+	if err != nil {
+		return nil, err
+	}
+	dns64Synthesised.Inc("PTR")
+	alias := query.DNSRecord{
+		Name:  []byte(name),
+		Type:  query.TYPE_CNAME,
+		Class: query.CLASS_IN,
+		TTL:   dns64CNAMETTL,
+		Data:  query.EncodeName(target),
+	}
+	answer := *result
+	answer.Name = name
+	answer.Records = append([]query.DNSRecord{alias}, result.Records...)
+	return &answer, nil
+}
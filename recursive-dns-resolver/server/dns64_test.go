@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net"
+	"recursive-dns-resolver/internal/dnstest"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+	"testing"
+	"time"
+)
+
+func TestDNS64(t *testing.T) {
+	record := dnstest.Record
+	soa := func(ttl uint32, minimum uint32) []query.DNSRecord {
+		data := query.EncodeSOA(query.SOAData{MName: "ns.example", RName: "hostmaster.example", Serial: 1, Minimum: minimum})
+		return []query.DNSRecord{record("example", query.TYPE_SOA, ttl, data)}
+	}
+	root := dnstest.Start(t, dnstest.Answer(func(name string, qtype uint16) (uint16, []query.DNSRecord, []query.DNSRecord) {
+		a := []query.DNSRecord{record(name, query.TYPE_A, 300, []byte{192, 0, 2, 1})}
+		switch {
+		case name == "dual.example" && qtype == query.TYPE_AAAA:
+			return query.RCODE_NOERROR, []query.DNSRecord{record(name, query.TYPE_AAAA, 300, net.ParseIP("2001:db8::1"))}, nil
+		case name == "missing.example":
+			return query.RCODE_NXDOMAIN, nil, soa(3600, 60)
+		case qtype == query.TYPE_A:
+			return query.RCODE_NOERROR, a, nil
+		case name == "short-soa.example":
+			return query.RCODE_NOERROR, nil, soa(3600, 60)
+		case name == "short-soa-ttl.example":
+			return query.RCODE_NOERROR, nil, soa(30, 3600)
+		case name == "long-soa.example":
+			return query.RCODE_NOERROR, nil, soa(3600, 3600)
+		case name == "no-soa.example":
+			return query.RCODE_NOERROR, nil, nil
+		default:
+			// broken.example: the AAAA lookup fails
+			return query.RCODE_SERVFAIL, nil, nil
+		}
+	}, dnstest.Authoritative))
+	prefix, _ := ParseDNS64Prefix(DefaultDNS64Prefix)
+	s := New("127.0.0.1:0", resolver.New(
+		resolver.WithRoots(root.Addr),
+		resolver.WithQNAMEMinimisation(false),
+		resolver.WithTimeouts(time.Second, 2*time.Second),
+	))
+	s.DNS64Prefix = prefix
+
+	tests := []struct {
+		name    string
+		rcode   uint16
+		address string
+		ttl     uint32
+	}{
+		{"dual.example", query.RCODE_NOERROR, "2001:db8::1", 300},
+		// The TTL is the shorter of the A record's and how long the empty AAAA answer may be cached
+		{"short-soa.example", query.RCODE_NOERROR, "64:ff9b::c000:201", 60},
+		{"short-soa-ttl.example", query.RCODE_NOERROR, "64:ff9b::c000:201", 30},
+		{"long-soa.example", query.RCODE_NOERROR, "64:ff9b::c000:201", 300},
+		{"no-soa.example", query.RCODE_NOERROR, "64:ff9b::c000:201", 300},
+		// A failed AAAA lookup is treated like an empty answer
+		{"broken.example", query.RCODE_NOERROR, "64:ff9b::c000:201", 300},
+		{"missing.example", query.RCODE_NXDOMAIN, "", 0},
+	}
+	for _, test := range tests {
+		result, err := s.lookup(context.Background(), test.name, query.TYPE_AAAA)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if result.Rcode != test.rcode {
+			t.Errorf("%s: rcode %s, want %s", test.name, query.RcodeName(result.Rcode), query.RcodeName(test.rcode))
+		}
+		if test.address == "" {
+			if len(result.Records) != 0 {
+				t.Errorf("%s: got records %v", test.name, result.Records)
+			}
+			continue
+		}
+		if len(result.Records) != 1 || result.Records[0].Type != query.TYPE_AAAA {
+			t.Errorf("%s: got records %v", test.name, result.Records)
+			continue
+		}
+		if got := net.IP(result.Records[0].Data).String(); got != test.address || result.Records[0].TTL != test.ttl {
+			t.Errorf("%s: got %s with TTL %d, want %s with TTL %d", test.name, got, result.Records[0].TTL, test.address, test.ttl)
+		}
+	}
+}
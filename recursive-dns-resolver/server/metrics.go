@@ -0,0 +1,15 @@
+package server
+
+import "recursive-dns-resolver/metrics"
+
+// Metrics for every Server in the process. They are exposed by metrics.Handler.
+var (
+	refusedQueries = metrics.NewCounterVec("dns_server_refused_total",
+		"Queries refused because the client may not recurse.")
+	rateLimited = metrics.NewCounterVec("dns_server_rate_limited_total",
+		"Queries and responses held back by rate limiting, by limit and action.", "limit", "action")
+	tsigFailures = metrics.NewCounterVec("dns_server_tsig_failures_total",
+		"Requests rejected because their TSIG signature was missing or did not verify, by reason.", "reason")
+	dns64Synthesised = metrics.NewCounterVec("dns_server_dns64_synthesised_total",
+		"Answers synthesised by DNS64, by query type.", "type")
+)
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"recursive-dns-resolver/blocklist"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+	"strings"
+)
+
+// sinkholeTTL is the TTL of the addresses we make up for sinkholed names
+const sinkholeTTL = 60
+
+// matchPolicy finds the rule that applies to a query: a rule for the name asked about, or
+// failing that a rule for any CNAME target in the answer, so an alias cannot sneak a
+// blocked name past the list. Passthru rules for the name asked about win over everything.
+func (s *Server) matchPolicy(name string, result *resolver.Result) *blocklist.Rule {
+	if rule := s.Blocklist.Match(name); rule != nil {
+		return rule
+	}
+	if result == nil {
+		return nil
+	}
+	for _, record := range result.Records {
+		if record.Type != query.TYPE_CNAME {
+			continue
+		}
+		if rule := s.Blocklist.Match(query.DecodeNSName(record.Data)); rule != nil && rule.Action != blocklist.ActionPassthru {
+			return rule
+		}
+	}
+	return nil
+}
+
+// policyResponse builds the answer a rule calls for. It returns nil for ActionDrop.
+func policyResponse(request query.DNSPacket, rule *blocklist.Rule) *query.DNSPacket {
+	question := request.Questions[0]
+	var response query.DNSPacket
+	switch rule.Action {
+	case blocklist.ActionNXDOMAIN:
+		response = query.BuildResponse(request, query.RCODE_NXDOMAIN, nil)
+	case blocklist.ActionNODATA:
+		response = query.BuildResponse(request, query.RCODE_NOERROR, nil)
+	case blocklist.ActionSinkhole:
+		// Only the addresses of the asked family are returned, other types get NODATA
+		var answers []query.DNSRecord
+		for _, ip := range rule.Addresses {
+			record := query.DNSRecord{Name: question.Name, Class: 1, TTL: sinkholeTTL}
+			switch {
+			case question.Type == query.TYPE_A && ip.To4() != nil:
+				record.Type, record.Data = query.TYPE_A, ip.To4()
+			case question.Type == query.TYPE_AAAA && ip.To4() == nil:
+				record.Type, record.Data = query.TYPE_AAAA, ip.To16()
+			default:
+				continue
+			}
+			answers = append(answers, record)
+		}
+		response = query.BuildResponse(request, query.RCODE_NOERROR, answers)
+	default:
+		return nil
+	}
+	return &response
+}
+
+// describePolicy renders a decision for the query log, e.g. "nxdomain *.ads.example.com (hosts.txt)"
+func describePolicy(rule *blocklist.Rule) string {
+	name := rule.Name
+	if rule.Subdomains {
+		name = "*." + name
+	}
+	return fmt.Sprintf("%s %s (%s)", rule.Action, strings.TrimPrefix(name, "."), rule.Source)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a set of token buckets, one per key, that refill at Rate per second up to Burst.
+// Clients are grouped by prefix like BIND's response rate limiting, so an attacker cannot
+// get around a limit by spreading queries over the addresses of one network.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+	// Slip sends every Slip-th limited response truncated instead of dropping it, so a real
+	// client whose address is being spoofed can still get its answer over TCP. 0 never slips.
+	Slip       int
+	IPv4Prefix int
+	IPv6Prefix int
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limited int
+}
+
+// NewRateLimit creates a limit of rate per second with the given burst and slip, grouping
+// IPv4 clients by /24 and IPv6 clients by /56
+func NewRateLimit(rate float64, burst float64, slip int) *RateLimit {
+	return &RateLimit{
+		Rate:       rate,
+		Burst:      burst,
+		Slip:       slip,
+		IPv4Prefix: 24,
+		IPv6Prefix: 56,
+		buckets:    make(map[string]*bucket),
+	}
+}
+
+// clientPrefix returns the network a client address is grouped into
+func (l *RateLimit) clientPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.IPv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(l.IPv6Prefix, 128)).String()
+}
+
+// take spends a token from the bucket of key. When the bucket is empty it reports whether the
+// response should slip through truncated rather than be dropped.
+func (l *RateLimit) take(key string) (allowed bool, slip bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.Burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.Rate
+	if b.tokens > l.Burst {
+		b.tokens = l.Burst
+	}
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+	b.limited++
+	return false, l.Slip > 0 && b.limited%l.Slip == 0
+}
+
+// sweep forgets buckets that have refilled completely once a minute, so the map only holds
+// clients that were active recently
+func (l *RateLimit) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// AllowQuery applies a per client query limit
+func (l *RateLimit) AllowQuery(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	allowed, _ := l.take(l.clientPrefix(ip))
+	return allowed
+}
+
+// AllowResponse applies response rate limiting: identical responses to one client prefix
+// share a bucket. NXDOMAIN responses are counted per parent domain so that random subdomains
+// do not each get a bucket of their own, and errors are counted per prefix alone.
+func (l *RateLimit) AllowResponse(ip net.IP, qname string, qtype uint16, rcode uint16) (allowed bool, slip bool) {
+	if l == nil {
+		return true, false
+	}
+	key := l.clientPrefix(ip)
+	qname = strings.ToLower(strings.Trim(qname, "."))
+	switch rcode {
+	case 0:
+		key += "|" + qname + "|" + strconv.Itoa(int(qtype))
+	case 3:
+		if dot := strings.IndexByte(qname, '.'); dot >= 0 {
+			qname = qname[dot+1:]
+		}
+		key += "|nxdomain|" + qname
+	default:
+		key += "|error"
+	}
+	return l.take(key)
+}
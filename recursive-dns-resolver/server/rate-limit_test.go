@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+	"testing"
+	"time"
+)
+
+func TestRateLimitRefill(t *testing.T) {
+	limit := NewRateLimit(2, 3, 0)
+	client := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		if !limit.AllowQuery(client) {
+			t.Fatalf("query %d of a burst of 3 was limited", i+1)
+		}
+	}
+	if limit.AllowQuery(client) {
+		t.Fatal("a query over the burst was allowed")
+	}
+
+	// Pretend time passes by moving the last refill back
+	age := func(d time.Duration) {
+		limit.mutex.Lock()
+		for _, b := range limit.buckets {
+			b.updated = b.updated.Add(-d)
+		}
+		limit.mutex.Unlock()
+	}
+	age(time.Second)
+	for i := 0; i < 2; i++ {
+		if !limit.AllowQuery(client) {
+			t.Errorf("query %d after a second at 2 per second was limited", i+1)
+		}
+	}
+	if limit.AllowQuery(client) {
+		t.Error("more queries were allowed than refilled in a second")
+	}
+	// A bucket never holds more than the burst however long it waits
+	age(time.Hour)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if limit.AllowQuery(client) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("%d queries allowed after an hour, want the burst of 3", allowed)
+	}
+}
+
+// Every Slip-th limited response goes out truncated and empty so the client retries over TCP,
+// the others are dropped
+func TestLimitResponseSlip(t *testing.T) {
+	s := &Server{ResponseLimit: NewRateLimit(0.001, 2, 3)}
+	request := query.DNSPacket{
+		Header:    query.DNSHeader{ID: 7, Flags: query.FLAG_RD},
+		Questions: []query.DNSQuestion{{Name: []byte("www.example.com"), Type: query.TYPE_A, Class: query.CLASS_IN}},
+	}
+	answers := []query.DNSRecord{{Name: []byte("www.example.com"), Type: query.TYPE_A, Class: query.CLASS_IN, TTL: 300, Data: []byte{192, 0, 2, 1}}}
+	response := query.PacketToBytes(query.BuildResponse(request, query.RCODE_NOERROR, answers))
+	client := net.ParseIP("192.0.2.1")
+
+	// "answer" is the full response, "tc" the truncated one and "" nothing at all
+	want := []string{"answer", "answer", "", "", "tc", "", "", "tc"}
+	for i, w := range want {
+		got := ""
+		if limited := s.limitResponse(client, response); limited != nil {
+			packet, err := query.ParseDNSResponse(limited)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case packet.Header.Flags&query.FLAG_TC != 0 && len(packet.Answers) == 0 && packet.Header.ID == 7:
+				got = "tc"
+			case packet.Header.Flags&query.FLAG_TC == 0 && len(packet.Answers) == 1:
+				got = "answer"
+			default:
+				got = fmt.Sprintf("%+v", packet)
+			}
+		}
+		if got != w {
+			t.Errorf("response %d: got %q, want %q", i+1, got, w)
+		}
+	}
+
+	never := NewRateLimit(0.001, 1, 0)
+	never.AllowResponse(client, "www.example.com", query.TYPE_A, query.RCODE_NOERROR)
+	for i := 0; i < 5; i++ {
+		if allowed, slip := never.AllowResponse(client, "www.example.com", query.TYPE_A, query.RCODE_NOERROR); allowed || slip {
+			t.Errorf("a limit with slip 0 let response %d through, slipped %v", i+1, slip)
+		}
+	}
+}
+
+func TestRateLimitResponseKeys(t *testing.T) {
+	type response struct {
+		client string
+		qname  string
+		qtype  uint16
+		rcode  uint16
+	}
+	www := response{"192.0.2.1", "www.example.com", query.TYPE_A, query.RCODE_NOERROR}
+	tests := []struct {
+		name    string
+		first   response
+		second  response
+		sharing bool
+	}{
+		{"same network", www, response{"192.0.2.200", "WWW.example.com.", query.TYPE_A, query.RCODE_NOERROR}, true},
+		{"other network", www, response{"192.0.3.1", "www.example.com", query.TYPE_A, query.RCODE_NOERROR}, false},
+		{"same IPv6 /56", response{"2001:db8:0:1::1", "www.example.com", query.TYPE_A, query.RCODE_NOERROR}, response{"2001:db8:0:2::1", "www.example.com", query.TYPE_A, query.RCODE_NOERROR}, true},
+		{"other name", www, response{"192.0.2.1", "mail.example.com", query.TYPE_A, query.RCODE_NOERROR}, false},
+		{"other type", www, response{"192.0.2.1", "www.example.com", query.TYPE_AAAA, query.RCODE_NOERROR}, false},
+		// Random subdomains that do not exist all count against their parent
+		{"nxdomain subdomains", response{"192.0.2.1", "x1.example.com", query.TYPE_A, query.RCODE_NXDOMAIN}, response{"192.0.2.1", "x2.example.com", query.TYPE_A, query.RCODE_NXDOMAIN}, true},
+		{"errors", response{"192.0.2.1", "a.example", query.TYPE_A, query.RCODE_SERVFAIL}, response{"192.0.2.1", "b.example", query.TYPE_MX, query.RCODE_REFUSED}, true},
+	}
+	respond := func(limit *RateLimit, r response) bool {
+		allowed, _ := limit.AllowResponse(net.ParseIP(r.client), r.qname, r.qtype, r.rcode)
+		return allowed
+	}
+	for _, test := range tests {
+		limit := NewRateLimit(0.001, 1, 0)
+		respond(limit, test.first)
+		if shared := !respond(limit, test.second); shared != test.sharing {
+			t.Errorf("%s: the responses share a bucket: %v, want %v", test.name, shared, test.sharing)
+		}
+	}
+
+	var none *RateLimit
+	if allowed, slip := none.AllowResponse(net.ParseIP("192.0.2.1"), "www.example.com", query.TYPE_A, query.RCODE_NOERROR); !allowed || slip || !none.AllowQuery(net.ParseIP("192.0.2.1")) {
+		t.Error("a nil RateLimit limited a response")
+	}
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"recursive-dns-resolver/blocklist"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/querylog"
+	"recursive-dns-resolver/resolver"
+	"recursive-dns-resolver/socket"
+	"sync/atomic"
+	"time"
+)
+
+// Server answers DNS queries from clients over UDP and TCP by resolving them with a Resolver
+type Server struct {
+	Addr     string
+	Resolver *resolver.Resolver
+	Logger   *log.Logger
+	// QueryLog receives one event per client query. Nil disables it.
+	QueryLog *querylog.Logger
+	// Blocklist filters the names clients may resolve. Nil lets everything through.
+	Blocklist *blocklist.Blocklist
+	// AllowRecursion lists the networks that may use the server, everyone else is REFUSED.
+	// Nil allows every client.
+	AllowRecursion []*net.IPNet
+	// QueryLimit bounds the queries per second of each client prefix and ResponseLimit the
+	// identical UDP responses sent to it. Nil disables either.
+	QueryLimit    *RateLimit
+	ResponseLimit *RateLimit
+	// TSIGKeys are the keys signed requests are verified with, by lowercase key name. Responses
+	// to signed requests are signed with the same key. Nil disables TSIG, and RequireTSIG
+	// refuses unsigned requests.
+	TSIGKeys    map[string]query.TSIGKey
+	RequireTSIG bool
+	// CookieSecret keys the server cookies (RFC 7873) sent to clients that send a client
+	// cookie. UDP clients that return a valid one are exempt from ResponseLimit, as their
+	// address cannot be spoofed. Nil disables cookies.
+	CookieSecret []byte
+	// DNS64Prefix turns on DNS64 (RFC 6147) with this NAT64 prefix: names without IPv6
+	// addresses get AAAA records synthesised from their A records. Nil disables it.
+	// DNS64Exclude lists the networks whose addresses are neither used nor synthesised.
+	DNS64Prefix  *net.IPNet
+	DNS64Exclude []*net.IPNet
+	// Timeout bounds how long a single client query may take to answer
+	Timeout time.Duration
+
+	// active is the Server that answers queries in place of this one since the last Reload
+	active atomic.Pointer[Server]
+}
+
+// New creates a Server listening on addr, e.g. "127.0.0.1:5300"
+func New(addr string, r *resolver.Resolver) *Server {
+	return &Server{
+		Addr:     addr,
+		Resolver: r,
+		Logger:   log.Default(),
+		Timeout:  10 * time.Second,
+	}
+}
+
+// Reload makes next answer every query that arrives from now on, keeping the listeners of s.
+// Queries already being answered finish with the settings they started with. Only the
+// listening address of next is ignored.
+func (s *Server) Reload(next *Server) {
+	s.active.Store(next)
+}
+
+// Active returns the Server whose settings answer the next query: s itself, or the one it was
+// last reloaded with
+func (s *Server) Active() *Server {
+	if next := s.active.Load(); next != nil {
+		return next
+	}
+	return s
+}
+
+// ListenAndServe listens on Addr over both UDP and TCP and serves until one of them fails
+func (s *Server) ListenAndServe() error {
+	packetConn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", s.Addr, err)
+	}
+	defer packetConn.Close()
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on tcp %s: %w", s.Addr, err)
+	}
+	defer listener.Close()
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServeUDP(packetConn) }()
+	go func() { errs <- s.ServeTCP(listener) }()
+	return <-errs
+}
+
+// ServeUDP answers every datagram that arrives on conn in its own goroutine
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buffer := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		pooled := query.GetMessageBuffer()
+		request := append((*pooled)[:0], buffer[:n]...)
+		go func() {
+			if response := s.Active().handle(request, client, false); response != nil {
+				conn.WriteTo(response, client)
+			}
+			query.PutMessageBuffer(pooled)
+		}()
+	}
+}
+
+// ServeTCP accepts connections and answers the queries sent over each of them in turn
+func (s *Server) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(s.Active().Timeout))
+				request, err := socket.ReadTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				response := s.Active().handle(request, conn.RemoteAddr(), true)
+				if response == nil {
+					return
+				}
+				if err := socket.WriteTCPMessage(conn, response); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle builds the wire format response to one request. A nil response means the request
+// is not worth answering at all, e.g. because it is not a DNS query or the client is over
+// its rate limit.
+func (s *Server) handle(message []byte, client net.Addr, tcp bool) []byte {
+	ip := clientIP(client)
+	if !s.QueryLimit.AllowQuery(ip) {
+		rateLimited.Inc("query", "drop")
+		return nil
+	}
+	response := s.answer(message, client, tcp)
+	// TCP needs a handshake and a valid server cookie proves an earlier response reached the
+	// client, so neither source can be spoofed and both are exempt from RRL
+	if tcp || response == nil || s.hasValidCookie(message, ip) {
+		return response
+	}
+	return s.limitResponse(ip, response)
+}
+
+// limitResponse applies response rate limiting to a UDP response. A limited response is
+// dropped, or sent truncated without any records when it slips.
+func (s *Server) limitResponse(ip net.IP, response []byte) []byte {
+	if s.ResponseLimit == nil {
+		return response
+	}
+	// Only the question and rcode are needed, so read them in place
+	var message query.Message
+	if message.Reset(response) != nil {
+		return response
+	}
+	question, ok, err := message.NextQuestion()
+	if err != nil || !ok {
+		return response
+	}
+	var nameBuffer [query.MaxNameLength]byte
+	name, err := message.AppendName(nameBuffer[:0], question.Name)
+	if err != nil {
+		return response
+	}
+	allowed, slip := s.ResponseLimit.AllowResponse(ip, string(name), question.Type, message.Header.Flags&0x000F)
+	if allowed {
+		return response
+	}
+	if !slip {
+		rateLimited.Inc("response", "drop")
+		return nil
+	}
+	rateLimited.Inc("response", "slip")
+	packet, err := query.ParseDNSResponse(response)
+	if err != nil {
+		return nil
+	}
+	packet.Header.Flags |= query.FLAG_TC
+	packet.Answers, packet.Authorities = nil, nil
+	var opt []query.DNSRecord
+	if record := query.GetOPT(*packet); record != nil {
+		opt = append(opt, *record)
+	}
+	packet.Additionals = opt
+	return query.PacketToBytes(*packet)
+}
+
+// answer resolves one request and builds the response, or returns nil when there is nothing to answer
+func (s *Server) answer(message []byte, client net.Addr, tcp bool) []byte {
+	if len(message) < 12 {
+		return nil
+	}
+	request, err := query.ParseDNSResponse(message)
+	if err != nil || request.Header.Flags&query.FLAG_QR != 0 {
+		return nil
+	}
+	if s.malformedCookie(*request) {
+		return s.finish(*request, query.BuildResponse(*request, query.RCODE_FORMERR, nil), client, tcp)
+	}
+	tsig, rejected := s.checkTSIG(*request, message, client, tcp)
+	if rejected != nil {
+		return rejected
+	}
+	return s.signResponse(s.respond(request, message, client, tcp), tsig)
+}
+
+// respond answers a parsed request, or returns nil when there is nothing to answer
+func (s *Server) respond(request *query.DNSPacket, message []byte, client net.Addr, tcp bool) []byte {
+	// Only standard queries (opcode 0) with exactly one question are supported
+	if opcode := (request.Header.Flags >> 11) & 0xF; opcode != 0 || len(request.Questions) != 1 {
+		return s.finish(*request, query.BuildResponse(*request, query.RCODE_NOTIMP, nil), client, tcp)
+	}
+
+	start := time.Now()
+	if !s.mayRecurse(clientIP(client)) {
+		refusedQueries.Inc()
+		response := s.finish(*request, query.BuildResponse(*request, query.RCODE_REFUSED, nil), client, tcp)
+		s.logClient(start, client, tcp, message, response, nil, nil, "")
+		return response
+	}
+	question := request.Questions[0]
+	name := string(question.Name)
+	// A blocked name is answered without resolving it at all
+	if rule := s.matchPolicy(name, nil); rule != nil && rule.Action != blocklist.ActionPassthru {
+		return s.block(start, *request, message, client, tcp, rule)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	ctx = resolver.ContextWithClientIP(ctx, clientIP(client))
+	result, err := s.lookup(ctx, name, question.Type)
+	policy := ""
+	if err == nil {
+		if rule := s.matchPolicy(name, result); rule != nil {
+			if rule.Action != blocklist.ActionPassthru {
+				return s.block(start, *request, message, client, tcp, rule)
+			}
+			policy = describePolicy(rule)
+		}
+	}
+	var response []byte
+	if err != nil {
+		s.Logger.Printf("Error resolving %s for %s: %v", question.Name, client, err)
+		response = s.finish(*request, query.BuildResponse(*request, query.RCODE_SERVFAIL, nil), client, tcp)
+	} else {
+		response = s.finish(*request, query.BuildResponse(*request, result.Rcode, result.Records), client, tcp)
+	}
+	s.logClient(start, client, tcp, message, response, result, err, policy)
+	return response
+}
+
+// block answers a query the way a blocklist rule says, or not at all for ActionDrop
+func (s *Server) block(start time.Time, request query.DNSPacket, message []byte, client net.Addr, tcp bool, rule *blocklist.Rule) []byte {
+	var response []byte
+	if packet := policyResponse(request, rule); packet != nil {
+		response = s.finish(request, *packet, client, tcp)
+	}
+	s.logClient(start, client, tcp, message, response, nil, nil, describePolicy(rule))
+	return response
+}
+
+// logClient records a client query and our answer in the query log
+func (s *Server) logClient(start time.Time, client net.Addr, tcp bool, request []byte, response []byte, result *resolver.Result, err error, policy string) {
+	if s.QueryLog == nil {
+		return
+	}
+	parsed, _ := query.ParseDNSResponse(request)
+	event := querylog.Event{
+		Time:     start,
+		Kind:     querylog.ClientResponse,
+		Client:   client.String(),
+		Protocol: "udp",
+		RTT:      float64(time.Since(start).Microseconds()) / 1000,
+		Policy:   policy,
+		Query:    request,
+		Response: response,
+	}
+	if tcp {
+		event.Protocol = "tcp"
+	}
+	if parsed != nil && len(parsed.Questions) > 0 {
+		event.QName = string(parsed.Questions[0].Name)
+		event.QType = query.TypeName(parsed.Questions[0].Type)
+	}
+	// A dropped query has no response to take the rcode from
+	if len(response) > 0 {
+		if answer, _ := query.ParseDNSResponse(response); answer != nil {
+			event.Rcode = query.RcodeName(query.GetRcode(*answer))
+		}
+	}
+	switch {
+	case err != nil:
+		event.Error = err.Error()
+	case result != nil && result.Cached:
+		event.Cache = "hit"
+	case result != nil:
+		event.Cache = "miss"
+	}
+	s.QueryLog.Log(event)
+}
+
+// finish adds an OPT record if the client used EDNS, with a server cookie for client if it sent
+// a cookie, and serialises the response. A UDP response that is too large for the client is
+// sent without its records and with TC set, so the client retries over TCP.
+func (s *Server) finish(request query.DNSPacket, response query.DNSPacket, client net.Addr, tcp bool) []byte {
+	if query.GetOPT(request) != nil {
+		var options []query.EDNSOption
+		if cookie := s.cookieOption(request, client); cookie != nil {
+			options = append(options, *cookie)
+		}
+		response.Additionals = append(response.Additionals, query.NewOPT(query.DefaultUDPSize, options...))
+	}
+	wire := query.PacketToBytes(response)
+	if tcp || len(wire) <= query.MaxUDPSize(request) {
+		return wire
+	}
+	response.Header.Flags |= query.FLAG_TC
+	response.Answers, response.Authorities = nil, nil
+	return query.PacketToBytes(response)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"recursive-dns-resolver/query"
+	"time"
+)
+
+// checkTSIG verifies the TSIG record of a request against TSIGKeys. It returns the request's
+// TSIG, nil for an unsigned request, and the response to send instead of an answer when the
+// request fails verification or is unsigned although RequireTSIG is set.
+func (s *Server) checkTSIG(request query.DNSPacket, message []byte, client net.Addr, tcp bool) (*query.TSIG, []byte) {
+	if s.TSIGKeys == nil {
+		return nil, nil
+	}
+	tsig, err := query.VerifyTSIG(message, s.TSIGKeys, nil, time.Now())
+	var tsigErr *query.TSIGError
+	switch {
+	case err == nil && tsig == nil && s.RequireTSIG:
+		tsigFailures.Inc("UNSIGNED")
+		return nil, s.finish(request, query.BuildResponse(request, query.RCODE_REFUSED, nil), client, tcp)
+	case err == nil:
+		return tsig, nil
+	case errors.As(err, &tsigErr):
+		tsigFailures.Inc(tsigErr.CodeName())
+		s.Logger.Printf("Rejecting request: %v", err)
+		response := s.finish(request, query.BuildResponse(request, query.RCODE_NOTAUTH, nil), client, tcp)
+		return nil, query.TSIGErrorResponse(response, tsig, s.TSIGKeys[tsig.KeyName], tsigErr, time.Now())
+	default:
+		// The TSIG record itself is malformed or misplaced
+		tsigFailures.Inc("FORMERR")
+		return nil, s.finish(request, query.BuildResponse(request, query.RCODE_FORMERR, nil), client, tcp)
+	}
+}
+
+// signResponse signs the response to a signed request with the same key
+func (s *Server) signResponse(response []byte, tsig *query.TSIG) []byte {
+	if tsig == nil || response == nil {
+		return response
+	}
+	signed, _, err := query.SignTSIG(response, s.TSIGKeys[tsig.KeyName], tsig.MAC, time.Now())
+	if err != nil {
+		s.Logger.Printf("Error signing response: %v", err)
+		return nil
+	}
+	return signed
+}
@@ -1,6 +1,7 @@
 package socket
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"time"
@@ -12,6 +13,11 @@ func SetupUDPConnection(serverAddr string, timeout time.Duration) (net.Conn, err
 	if err != nil {
 		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
 	}
+	// Bound how long we wait, otherwise a dropped or spoofed-and-ignored reply blocks forever
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set UDP deadline: %w", err)
+	}
 
 	return conn, nil
 }
@@ -26,3 +32,33 @@ func OpenUDPConnection(rootserver string) (net.Conn, error) {
 func CloseUDPConnection(connection net.Conn) {
 	connection.Close()
 }
+
+// DialContext connects to a nameserver at address (host:port) over network ("udp" or "tcp").
+// The connection deadline follows the context, and cancelling the context closes the
+// connection, so either one unblocks reads.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s connection: %w", network, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set %s deadline: %w", network, err)
+		}
+	}
+	return &contextConn{Conn: conn, stop: context.AfterFunc(ctx, func() { conn.Close() })}, nil
+}
+
+// contextConn is a connection that is closed when its context is done. Closing it first
+// unregisters it from the context.
+type contextConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *contextConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
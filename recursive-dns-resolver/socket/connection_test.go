@@ -0,0 +1,39 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialContextCancelUnblocksRead(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// No deadline, so only the cancel can end the read
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := DialContext(ctx, "udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 512))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read returned without an error after the context was cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the context was cancelled")
+	}
+}
@@ -0,0 +1,59 @@
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// WriteTCPMessage sends one DNS message over a stream connection, prefixed with its
+// two byte length as RFC 1035 section 4.2.2 requires
+func WriteTCPMessage(conn net.Conn, message []byte) error {
+	if len(message) > 0xFFFF {
+		return fmt.Errorf("message of %d bytes is too long for TCP", len(message))
+	}
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+	_, err := conn.Write(framed)
+	return err
+}
+
+// ReadTCPMessage reads one length prefixed DNS message from a stream connection
+func ReadTCPMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, fmt.Errorf("reading %d byte TCP message: %w", len(message), err)
+	}
+	return message, nil
+}
+
+// ReadTCPMessages reads length prefixed messages from a stream connection one after another
+// and hands each to fn until fn reports it has seen the last one, as a zone transfer needs.
+// The slice passed to fn is reused for the next message.
+func ReadTCPMessages(conn net.Conn, fn func(message []byte) (done bool, err error)) error {
+	var buffer []byte
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return fmt.Errorf("reading TCP message length: %w", err)
+		}
+		size := int(binary.BigEndian.Uint16(length[:]))
+		if cap(buffer) < size {
+			buffer = make([]byte, size)
+		}
+		message := buffer[:size]
+		if _, err := io.ReadFull(conn, message); err != nil {
+			return fmt.Errorf("reading %d byte TCP message: %w", size, err)
+		}
+		done, err := fn(message)
+		if err != nil || done {
+			return err
+		}
+	}
+}
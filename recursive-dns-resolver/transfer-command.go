@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+	"recursive-dns-resolver/transfer"
+	"strings"
+	"time"
+)
+
+// transferCommand copies a zone from one of its servers with AXFR, or only what changed with
+// IXFR, and prints the records in master file format as they arrive
+func transferCommand(args []string) {
+	flags := flag.NewFlagSet("transfer", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: transfer [flags] <zone> [@server]")
+		flags.PrintDefaults()
+	}
+	incremental := flags.Bool("ixfr", false, "only transfer the changes since the serial we saw last")
+	serial := flags.Uint("serial", 0, "serial to ask for changes since, instead of the one we saw last")
+	serialsFile := flags.String("serials", "zone-serials.json", "file the last serial of each zone is kept in")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long the whole transfer may take")
+
+	positional := parseInterspersed(flags, args)
+	if len(positional) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	zone := strings.ToLower(strings.Trim(positional[0], "."))
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	server := ""
+	if len(positional) > 1 {
+		server = strings.TrimPrefix(positional[1], "@")
+	}
+	server, err := transferServer(ctx, zone, server)
+	if err != nil {
+		fmt.Println("Error finding a server for the zone:", err)
+		os.Exit(1)
+	}
+
+	serials, err := loadSerials(*serialsFile)
+	if err != nil {
+		fmt.Println("Error reading serials:", err)
+		os.Exit(1)
+	}
+	since := uint32(*serial)
+	if since == 0 {
+		since = serials[zone]
+	}
+
+	var lastOp transfer.Op = -1
+	var lastSerial uint32
+	printChange := func(change transfer.Change) error {
+		// Master files cannot say that a record goes away, so incremental changes are
+		// grouped under comments saying what each group does
+		if *incremental && (change.Op != lastOp || change.Serial != lastSerial) {
+			fmt.Printf("; %s, serial %d\n", change.Op, change.Serial)
+			lastOp, lastSerial = change.Op, change.Serial
+		}
+		fmt.Println(query.FormatRecord(change.Record))
+		return nil
+	}
+
+	var result *transfer.Result
+	if *incremental && since != 0 {
+		result, err = transfer.IXFR(ctx, server, zone, since, printChange)
+	} else {
+		if *incremental {
+			fmt.Fprintf(os.Stderr, "No serial known for %s, transferring the whole zone\n", zone)
+			*incremental = false
+		}
+		result, err = transfer.AXFR(ctx, server, zone, printChange)
+	}
+	if err != nil {
+		fmt.Println("Error transferring zone:", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case result.UpToDate:
+		fmt.Printf("; %s is up to date at serial %d\n", zone, result.Serial)
+	case result.Incremental:
+		fmt.Printf("; %d changes from serial %d to %d in %d messages\n", result.Records, since, result.Serial, result.Messages)
+	default:
+		fmt.Printf("; %d records at serial %d in %d messages\n", result.Records, result.Serial, result.Messages)
+	}
+	serials[zone] = result.Serial
+	if err := saveSerials(*serialsFile, serials); err != nil {
+		fmt.Println("Error saving serials:", err)
+		os.Exit(1)
+	}
+}
+
+// transferServer turns the server given on the command line into an address, and picks the
+// first nameserver of the zone when none was given
+func transferServer(ctx context.Context, zone string, server string) (string, error) {
+	if server == "" {
+		names, err := resolver.DefaultResolver.LookupNS(ctx, zone)
+		if err != nil {
+			return "", err
+		}
+		if len(names) == 0 {
+			return "", fmt.Errorf("%s has no nameservers", zone)
+		}
+		server = names[0]
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "53"
+	}
+	if net.ParseIP(host) != nil {
+		return net.JoinHostPort(host, port), nil
+	}
+	ips, err := resolver.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// loadSerials reads the serial we last transferred of each zone. A missing file means none yet.
+func loadSerials(path string) (map[string]uint32, error) {
+	serials := make(map[string]uint32)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return serials, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &serials); err != nil {
+		return nil, err
+	}
+	return serials, nil
+}
+
+func saveSerials(path string, serials map[string]uint32) error {
+	data, err := json.MarshalIndent(serials, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,209 @@
+package transfer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/socket"
+	"strings"
+)
+
+// Op says whether a record of an incremental transfer is being removed from or added to the zone
+type Op int
+
+const (
+	Add Op = iota
+	Delete
+)
+
+func (op Op) String() string {
+	if op == Delete {
+		return "delete"
+	}
+	return "add"
+}
+
+// Change is one record of a transfer. A full transfer only ever adds records.
+type Change struct {
+	Op     Op
+	Record query.DNSRecord
+	// Serial is the version of the zone the change belongs to: the old version for a
+	// deletion and the new version for an addition
+	Serial uint32
+}
+
+// Result describes a finished transfer
+type Result struct {
+	Serial uint32
+	// Incremental is false when the server sent the whole zone
+	Incremental bool
+	// UpToDate is set when an IXFR found nothing newer than the serial we have
+	UpToDate bool
+	Records  int
+	Messages int
+}
+
+// AXFR transfers the whole of zone from server (RFC 5936) and hands each record to fn as it
+// arrives, so even large zones are streamed rather than held in memory
+func AXFR(ctx context.Context, server string, zone string, fn func(Change) error) (*Result, error) {
+	message := query.BuildQuery(strings.Trim(zone, "."), query.TYPE_AXFR)
+	return run(ctx, server, zone, message, false, 0, fn)
+}
+
+// IXFR asks server only for the changes to zone since serial (RFC 1995). The server may send
+// the whole zone instead, in which case the Result is not Incremental.
+func IXFR(ctx context.Context, server string, zone string, serial uint32, fn func(Change) error) (*Result, error) {
+	zone = strings.Trim(zone, ".")
+	request := query.DNSPacket{
+		Header:    query.DNSHeader{ID: uint16(rand.Intn(65536))},
+		Questions: []query.DNSQuestion{{Name: []byte(zone), Type: query.TYPE_IXFR, Class: 1}},
+		// The SOA we have goes in the authority section, only its serial matters
+		Authorities: []query.DNSRecord{{
+			Name:  []byte(zone),
+			Type:  query.TYPE_SOA,
+			Class: 1,
+			Data:  query.EncodeSOA(query.SOAData{Serial: serial}),
+		}},
+	}
+	return run(ctx, server, zone, query.PacketToBytes(request), true, serial, fn)
+}
+
+// run sends a transfer request over TCP and feeds the records of every response message
+// through a stream that knows where the transfer ends
+func run(ctx context.Context, server string, zone string, request []byte, incremental bool, serial uint32, fn func(Change) error) (*Result, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	conn, err := socket.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := socket.WriteTCPMessage(conn, request); err != nil {
+		return nil, fmt.Errorf("sending transfer request: %w", err)
+	}
+
+	id := binary.BigEndian.Uint16(request[0:2])
+	s := &stream{incremental: incremental, fn: fn, result: &Result{}}
+	err = socket.ReadTCPMessages(conn, func(message []byte) (bool, error) {
+		response, err := query.ParseDNSResponse(message)
+		if err != nil {
+			return false, fmt.Errorf("parsing transfer response: %w", err)
+		}
+		if response.Header.ID != id {
+			return false, fmt.Errorf("transfer response ID %d does not match request ID %d", response.Header.ID, id)
+		}
+		if rcode := query.GetRcode(*response); rcode != query.RCODE_NOERROR {
+			return false, fmt.Errorf("transfer of %s refused by %s: %s", zone, server, query.RcodeName(rcode))
+		}
+		s.result.Messages++
+		for _, record := range response.Answers {
+			if err := s.next(record); err != nil {
+				return false, err
+			}
+			if s.done {
+				return true, nil
+			}
+		}
+		// A server that is up to date answers an IXFR with nothing but its SOA
+		if incremental && s.count == 1 && !query.SerialNewer(s.result.Serial, serial) {
+			s.result.UpToDate = true
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.result, nil
+}
+
+// stream follows the record sequence of a transfer. A full transfer is the SOA, every other
+// record and the SOA again. An incremental one is the new SOA, then for each version an old
+// SOA with the records it removes and a newer SOA with the records it adds, and the new SOA again.
+type stream struct {
+	incremental bool // whether an incremental answer is possible, i.e. we sent an IXFR
+	fn          func(Change) error
+	result      *Result
+
+	opening  query.DNSRecord // the first SOA, held until we know what kind of transfer it opens
+	count    int
+	op       Op
+	serial   uint32 // the version records are currently being added to
+	deleting uint32 // the version records are currently being deleted from
+	done     bool
+}
+
+func (s *stream) next(record query.DNSRecord) error {
+	s.count++
+	soa, isSOA := decodeSOA(record)
+	switch {
+	case s.count == 1:
+		if !isSOA {
+			return fmt.Errorf("transfer does not start with an SOA record")
+		}
+		s.result.Serial = soa.Serial
+		s.serial = soa.Serial
+		s.opening = record
+		return nil
+	case s.count == 2:
+		if isSOA && s.incremental && soa.Serial != s.result.Serial {
+			s.result.Incremental = true
+			s.op, s.deleting = Delete, soa.Serial
+			return s.emit(Delete, record, soa.Serial)
+		}
+		// A full transfer, which starts with the SOA we held back
+		if err := s.emit(Add, s.opening, s.serial); err != nil {
+			return err
+		}
+		if isSOA {
+			s.done = true // a zone with nothing but an SOA
+			return nil
+		}
+		return s.emit(Add, record, s.serial)
+	}
+
+	if !s.result.Incremental {
+		if isSOA {
+			s.done = true
+			return nil
+		}
+		return s.emit(Add, record, s.serial)
+	}
+
+	if isSOA {
+		switch s.op {
+		case Delete:
+			// The newer SOA starts the additions of this version
+			s.op, s.serial = Add, soa.Serial
+			return s.emit(Add, record, soa.Serial)
+		case Add:
+			if soa.Serial == s.result.Serial {
+				s.done = true
+				return nil
+			}
+			s.op, s.deleting = Delete, soa.Serial
+			return s.emit(Delete, record, soa.Serial)
+		}
+	}
+	if s.op == Delete {
+		return s.emit(Delete, record, s.deleting)
+	}
+	return s.emit(Add, record, s.serial)
+}
+
+func (s *stream) emit(op Op, record query.DNSRecord, serial uint32) error {
+	s.result.Records++
+	return s.fn(Change{Op: op, Record: record, Serial: serial})
+}
+
+func decodeSOA(record query.DNSRecord) (query.SOAData, bool) {
+	if record.Type != query.TYPE_SOA {
+		return query.SOAData{}, false
+	}
+	soa, err := query.DecodeSOA(record.Data)
+	return soa, err == nil
+}
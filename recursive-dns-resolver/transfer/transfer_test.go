@@ -0,0 +1,153 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"recursive-dns-resolver/internal/dnstest"
+	"recursive-dns-resolver/query"
+	"slices"
+	"testing"
+	"time"
+)
+
+func soa(serial uint32) query.DNSRecord {
+	return dnstest.Record("example.com", query.TYPE_SOA, 3600, query.EncodeSOA(query.SOAData{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: serial}))
+}
+
+func a(name string, last byte) query.DNSRecord {
+	return dnstest.Record(name, query.TYPE_A, 300, []byte{192, 0, 2, last})
+}
+
+// primary answers every transfer request with messages, each holding the records of one
+// slice in its answer section
+func primary(t *testing.T, messages ...[]query.DNSRecord) *dnstest.Server {
+	return dnstest.Start(t, func(network string, request []byte) [][]byte {
+		packet, err := query.ParseDNSResponse(request)
+		if err != nil {
+			t.Errorf("primary could not parse the request: %v", err)
+			return nil
+		}
+		var responses [][]byte
+		for _, answers := range messages {
+			response := query.BuildResponse(*packet, query.RCODE_NOERROR, answers)
+			response.Header.Flags |= query.FLAG_AA
+			responses = append(responses, query.PacketToBytes(response))
+		}
+		return responses
+	})
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name        string
+		ixfr        bool
+		messages    [][]query.DNSRecord
+		changes     []string
+		serial      uint32
+		incremental bool
+		upToDate    bool
+	}{
+		{
+			name: "axfr over several messages",
+			messages: [][]query.DNSRecord{
+				{soa(5), a("www.example.com", 1)},
+				{a("mail.example.com", 2), a("ftp.example.com", 3)},
+				{a("db.example.com", 4), soa(5)},
+			},
+			changes: []string{
+				"add 5 example.com SOA", "add 5 www.example.com A", "add 5 mail.example.com A",
+				"add 5 ftp.example.com A", "add 5 db.example.com A",
+			},
+			serial: 5,
+		},
+		{
+			name: "ixfr of two versions",
+			ixfr: true,
+			messages: [][]query.DNSRecord{
+				{soa(3), soa(1), a("old.example.com", 1), soa(2), a("new.example.com", 2)},
+				{soa(2), a("new.example.com", 2), soa(3), a("newer.example.com", 3), a("extra.example.com", 4)},
+				{soa(3)},
+			},
+			changes: []string{
+				"delete 1 example.com SOA", "delete 1 old.example.com A", "add 2 example.com SOA", "add 2 new.example.com A",
+				"delete 2 example.com SOA", "delete 2 new.example.com A",
+				"add 3 example.com SOA", "add 3 newer.example.com A", "add 3 extra.example.com A",
+			},
+			serial:      3,
+			incremental: true,
+		},
+		{
+			name:     "ixfr already up to date",
+			ixfr:     true,
+			messages: [][]query.DNSRecord{{soa(1)}},
+			serial:   1,
+			upToDate: true,
+		},
+		{
+			name:     "ixfr answered with the whole zone",
+			ixfr:     true,
+			messages: [][]query.DNSRecord{{soa(3), a("www.example.com", 1), soa(3)}},
+			changes:  []string{"add 3 example.com SOA", "add 3 www.example.com A"},
+			serial:   3,
+		},
+		{
+			name:     "zone of only its soa",
+			messages: [][]query.DNSRecord{{soa(7)}, {soa(7)}},
+			changes:  []string{"add 7 example.com SOA"},
+			serial:   7,
+		},
+	}
+	for _, test := range tests {
+		server := primary(t, test.messages...)
+		var changes []string
+		collect := func(change Change) error {
+			changes = append(changes, fmt.Sprintf("%s %d %s %s", change.Op, change.Serial, change.Record.Name, query.TypeName(change.Record.Type)))
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		var result *Result
+		var err error
+		if test.ixfr {
+			result, err = IXFR(ctx, server.Addr, "example.com", 1, collect)
+		} else {
+			result, err = AXFR(ctx, server.Addr, "example.com.", collect)
+		}
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(changes, test.changes) {
+			t.Errorf("%s: changes\n%q\nwant\n%q", test.name, changes, test.changes)
+		}
+		if result.Serial != test.serial || result.Incremental != test.incremental || result.UpToDate != test.upToDate {
+			t.Errorf("%s: result %+v", test.name, result)
+		}
+		if result.Records != len(test.changes) || result.Messages != len(test.messages) {
+			t.Errorf("%s: %d records in %d messages, want %d in %d", test.name, result.Records, result.Messages, len(test.changes), len(test.messages))
+		}
+		if got := server.Networks(); got != "tcp" {
+			t.Errorf("%s: requests came over %s", test.name, got)
+		}
+	}
+}
+
+func TestTransferErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages [][]query.DNSRecord
+	}{
+		{"no soa first", [][]query.DNSRecord{{a("www.example.com", 1), soa(1)}}},
+		// The server stops sending before the closing SOA
+		{"cut short", [][]query.DNSRecord{{soa(2), a("www.example.com", 1)}}},
+	}
+	for _, test := range tests {
+		server := primary(t, test.messages...)
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		_, err := AXFR(ctx, server.Addr, "example.com", func(Change) error { return nil })
+		cancel()
+		if err == nil {
+			t.Errorf("%s: the transfer succeeded", test.name)
+		}
+	}
+}
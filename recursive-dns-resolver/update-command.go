@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/resolver"
+	"recursive-dns-resolver/update"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// updateCommand reads nsupdate style commands from a file or stdin and sends the dynamic
+// updates they describe, e.g.
+//
+//	server 127.0.0.1
+//	zone example.com
+//	update add _http._tcp.example.com 300 SRV 0 5 80 web.example.com
+//	send
+func updateCommand(args []string) {
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: update [flags] [file]")
+		flags.PrintDefaults()
+	}
+	keySpec := flags.String("y", "", "TSIG key to sign updates with, as [hmac-sha256:]name:base64secret")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long each update may take")
+	roots := flags.String("roots", "", "comma separated root servers to find zones and primaries from instead of the built in ones")
+	flags.Parse(args)
+
+	input := io.Reader(os.Stdin)
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Println("Error opening update file:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	session := &updateSession{timeout: *timeout, resolver: resolver.New()}
+	if *roots != "" {
+		session.resolver.Roots = strings.Split(*roots, ",")
+	}
+	if *keySpec != "" {
+		key, err := query.ParseTSIGKey(*keySpec)
+		if err != nil {
+			fmt.Println("Error parsing -y:", err)
+			os.Exit(1)
+		}
+		session.key = &key
+	}
+
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		if err := session.exec(scanner.Text()); err != nil {
+			fmt.Printf("line %d: %v\n", line, err)
+			os.Exit(1)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error reading updates:", err)
+		os.Exit(1)
+	}
+	// Whatever is still pending at the end of the input is sent as well
+	if err := session.send(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// updateSession is the state the commands of an update script build up
+type updateSession struct {
+	server   string
+	zone     string
+	key      *query.TSIGKey
+	ttl      uint32
+	timeout  time.Duration
+	resolver *resolver.Resolver
+
+	pending *query.Update
+	owner   string // the first name the pending update touches, to find its zone from
+}
+
+// exec runs one line of an update script
+func (s *updateSession) exec(line string) error {
+	fields, err := splitQuoted(line)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		// A blank line sends the pending update, like in nsupdate
+		return s.send()
+	}
+	if strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+		return nil
+	}
+
+	switch command, rest := strings.ToLower(fields[0]), fields[1:]; command {
+	case "server":
+		if len(rest) == 0 || len(rest) > 2 {
+			return fmt.Errorf("usage: server host [port]")
+		}
+		s.server = rest[0]
+		if len(rest) == 2 {
+			s.server = net.JoinHostPort(rest[0], rest[1])
+		}
+	case "zone":
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: zone name")
+		}
+		s.zone = strings.Trim(rest[0], ".")
+	case "key":
+		if len(rest) != 2 {
+			return fmt.Errorf("usage: key [hmac-sha256:]name secret")
+		}
+		key, err := query.ParseTSIGKey(rest[0] + ":" + rest[1])
+		if err != nil {
+			return err
+		}
+		s.key = &key
+	case "ttl":
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: ttl seconds")
+		}
+		ttl, err := strconv.ParseUint(rest[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("ttl %q: %w", rest[0], err)
+		}
+		s.ttl = uint32(ttl)
+	case "prereq":
+		return s.prereq(rest)
+	case "update":
+		if len(rest) > 0 {
+			switch strings.ToLower(rest[0]) {
+			case "add":
+				return s.add(rest[1:])
+			case "delete", "del":
+				return s.delete(rest[1:])
+			}
+		}
+		return fmt.Errorf("usage: update add|delete ...")
+	case "add":
+		return s.add(rest)
+	case "delete", "del":
+		return s.delete(rest)
+	case "show":
+		s.show()
+	case "send":
+		return s.send()
+	case "quit":
+		if err := s.send(); err != nil {
+			return err
+		}
+		os.Exit(0)
+	default:
+		return fmt.Errorf("unknown command %q", fields[0])
+	}
+	return nil
+}
+
+// prereq handles: prereq nxdomain|yxdomain name, prereq nxrrset name [IN] type, and
+// prereq yxrrset name [IN] type [data...]
+func (s *updateSession) prereq(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: prereq nxdomain|yxdomain|nxrrset|yxrrset name ...")
+	}
+	kind, name := strings.ToLower(args[0]), args[1]
+	u := s.update(name)
+	switch kind {
+	case "nxdomain", "yxdomain":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: prereq %s name", kind)
+		}
+		if kind == "nxdomain" {
+			u.NameNotInUse(name)
+		} else {
+			u.NameInUse(name)
+		}
+	case "nxrrset", "yxrrset":
+		rest := skipClass(args[2:])
+		if len(rest) == 0 {
+			return fmt.Errorf("usage: prereq %s name [IN] type", kind)
+		}
+		recordType, err := parseType(rest[0])
+		if err != nil {
+			return err
+		}
+		switch {
+		case kind == "nxrrset":
+			if len(rest) != 1 {
+				return fmt.Errorf("usage: prereq nxrrset name [IN] type")
+			}
+			u.RRsetNotExists(name, recordType)
+		case len(rest) == 1:
+			u.RRsetExists(name, recordType)
+		default:
+			data, err := query.ParseRecordData(recordType, rest[1:])
+			if err != nil {
+				return err
+			}
+			u.RRsetExistsWith(query.DNSRecord{Name: []byte(strings.Trim(name, ".")), Type: recordType, Data: data})
+		}
+	default:
+		return fmt.Errorf("unknown prerequisite %q", args[0])
+	}
+	return nil
+}
+
+// add handles: add name [ttl] [IN] type data...
+func (s *updateSession) add(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: update add name [ttl] [IN] type data...")
+	}
+	name, rest := args[0], args[1:]
+	ttl := s.ttl
+	if n, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+		ttl, rest = uint32(n), rest[1:]
+	} else if s.ttl == 0 {
+		return fmt.Errorf("update add needs a TTL, on the line or set with the ttl command")
+	}
+	rest = skipClass(rest)
+	if len(rest) < 2 {
+		return fmt.Errorf("usage: update add name [ttl] [IN] type data...")
+	}
+	recordType, err := parseType(rest[0])
+	if err != nil {
+		return err
+	}
+	data, err := query.ParseRecordData(recordType, rest[1:])
+	if err != nil {
+		return err
+	}
+	s.update(name).Add(query.DNSRecord{Name: []byte(strings.Trim(name, ".")), Type: recordType, TTL: ttl, Data: data})
+	return nil
+}
+
+// delete handles: delete name [ttl] [IN] [type [data...]]
+func (s *updateSession) delete(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: update delete name [IN] [type [data...]]")
+	}
+	name, rest := args[0], args[1:]
+	// nsupdate accepts and ignores a TTL here
+	if len(rest) > 0 {
+		if _, err := strconv.ParseUint(rest[0], 10, 32); err == nil {
+			rest = rest[1:]
+		}
+	}
+	rest = skipClass(rest)
+	u := s.update(name)
+	if len(rest) == 0 {
+		u.DeleteName(name)
+		return nil
+	}
+	recordType, err := parseType(rest[0])
+	if err != nil {
+		return err
+	}
+	if len(rest) == 1 {
+		u.DeleteRRset(name, recordType)
+		return nil
+	}
+	data, err := query.ParseRecordData(recordType, rest[1:])
+	if err != nil {
+		return err
+	}
+	u.Delete(query.DNSRecord{Name: []byte(strings.Trim(name, ".")), Type: recordType, Data: data})
+	return nil
+}
+
+// update returns the pending update, starting one if needed
+func (s *updateSession) update(name string) *query.Update {
+	if s.pending == nil {
+		s.pending = query.NewUpdate(s.zone)
+		s.owner = name
+	}
+	return s.pending
+}
+
+// show prints the pending update
+func (s *updateSession) show() {
+	if s.pending == nil {
+		fmt.Println("; nothing to send")
+		return
+	}
+	fmt.Printf("; zone %s\n", s.pending.Zone)
+	fmt.Println("; prerequisites")
+	for _, record := range s.pending.Prerequisites {
+		fmt.Println(formatUpdateRecord(record))
+	}
+	fmt.Println("; updates")
+	for _, record := range s.pending.Updates {
+		fmt.Println(formatUpdateRecord(record))
+	}
+}
+
+// send sends the pending update, finding the zone and its primary server first when the
+// script did not name them
+func (s *updateSession) send() error {
+	if s.pending == nil {
+		return nil
+	}
+	u := s.pending
+	s.pending = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if u.Zone == "" {
+		u.Zone = s.zone
+	}
+	if u.Zone == "" {
+		delegation, err := s.resolver.FindZone(ctx, s.owner)
+		if err != nil {
+			return fmt.Errorf("finding the zone of %s: %w", s.owner, err)
+		}
+		u.Zone = delegation.Zone
+	}
+	server := s.server
+	if server == "" {
+		primary, err := s.primary(ctx, u.Zone)
+		if err != nil {
+			return fmt.Errorf("finding the primary server of %s: %w", u.Zone, err)
+		}
+		server = primary
+	}
+
+	err := update.Send(ctx, server, u, s.key)
+	var rcodeErr *update.RcodeError
+	if errors.As(err, &rcodeErr) {
+		return fmt.Errorf("update of %s failed: %s", u.Zone, query.RcodeName(rcodeErr.Rcode))
+	}
+	if err != nil {
+		return fmt.Errorf("update of %s failed: %w", u.Zone, err)
+	}
+	fmt.Printf("Updated %s on %s: %d prerequisites, %d changes\n", u.Zone, server, len(u.Prerequisites), len(u.Updates))
+	return nil
+}
+
+// primary returns the address of the server named in the MNAME field of the zone's SOA,
+// which is where nsupdate sends updates too
+func (s *updateSession) primary(ctx context.Context, zone string) (string, error) {
+	result, err := s.resolver.Lookup(ctx, zone, query.TYPE_SOA)
+	if err != nil {
+		return "", err
+	}
+	for _, record := range result.Records {
+		if record.Type != query.TYPE_SOA {
+			continue
+		}
+		soa, err := query.DecodeSOA(record.Data)
+		if err != nil {
+			return "", err
+		}
+		ips, err := s.resolver.LookupIP(ctx, "ip", soa.MName+".")
+		if err != nil {
+			return "", err
+		}
+		return ips[0].String(), nil
+	}
+	return "", fmt.Errorf("%s has no SOA record", zone)
+}
+
+// splitQuoted splits a line into fields at spaces, except inside double quotes, and removes
+// the quotes. A backslash escapes the next character inside quotes.
+func splitQuoted(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// skipClass drops a leading IN class, the only one updates can carry
+func skipClass(fields []string) []string {
+	if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+		return fields[1:]
+	}
+	return fields
+}
+
+func parseType(name string) (uint16, error) {
+	if recordType, ok := RecordTypes[strings.ToUpper(name)]; ok {
+		return uint16(recordType), nil
+	}
+	return 0, fmt.Errorf("unknown record type %s", name)
+}
+
+// formatUpdateRecord renders a prerequisite or update the way nsupdate shows them, with the
+// class that gives it its meaning and without data when it has none
+func formatUpdateRecord(record query.DNSRecord) string {
+	class := "IN"
+	switch record.Class {
+	case query.CLASS_NONE:
+		class = "NONE"
+	case query.CLASS_ANY:
+		class = "ANY"
+	}
+	line := fmt.Sprintf("%s.\t%d\t%s\t%s", record.Name, record.TTL, class, query.TypeName(record.Type))
+	if len(record.Data) > 0 {
+		line += "\t" + query.FormatRecordData(record)
+	}
+	return line
+}
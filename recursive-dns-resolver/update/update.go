@@ -0,0 +1,108 @@
+package update
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"recursive-dns-resolver/query"
+	"recursive-dns-resolver/socket"
+	"time"
+)
+
+// RcodeError is an update the server received and refused, e.g. with NXRRSET because a
+// prerequisite did not hold
+type RcodeError struct {
+	Server string
+	Rcode  uint16
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("update refused by %s: %s", e.Server, query.RcodeName(e.Rcode))
+}
+
+// Send sends u to server (host or host:port), signed with key unless it is nil, and waits for
+// the response. A response to a signed update must be signed with the same key. Updates that
+// do not fit in a 512 byte datagram, or whose response comes back truncated, go over TCP.
+func Send(ctx context.Context, server string, u *query.Update, key *query.TSIGKey) error {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	message := u.Bytes()
+	var mac []byte
+	if key != nil {
+		var err error
+		if message, mac, err = query.SignTSIG(message, *key, nil, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	network := "udp"
+	if len(message) > 512 {
+		network = "tcp"
+	}
+	response, err := exchange(ctx, network, server, message)
+	if err == nil && network == "udp" && binary.BigEndian.Uint16(response[2:4])&query.FLAG_TC != 0 {
+		response, err = exchange(ctx, "tcp", server, message)
+	}
+	if err != nil {
+		return err
+	}
+
+	rcode := binary.BigEndian.Uint16(response[2:4]) & 0x000F
+	if key != nil {
+		keys := map[string]query.TSIGKey{key.Name: *key}
+		tsig, err := query.VerifyTSIG(response, keys, mac, time.Now())
+		if err != nil {
+			return fmt.Errorf("response from %s: %w", server, err)
+		}
+		// Only a server that does not know TSIG at all answers a signed update unsigned,
+		// and it is bound to have refused it
+		if tsig == nil && rcode == query.RCODE_NOERROR {
+			return fmt.Errorf("response from %s is not signed", server)
+		}
+	}
+	if rcode != query.RCODE_NOERROR {
+		return &RcodeError{Server: server, Rcode: rcode}
+	}
+	return nil
+}
+
+// exchange sends message to server and returns the response with the same ID
+func exchange(ctx context.Context, network string, server string, message []byte) ([]byte, error) {
+	conn, err := socket.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	id := binary.BigEndian.Uint16(message[0:2])
+	if network == "tcp" {
+		if err := socket.WriteTCPMessage(conn, message); err != nil {
+			return nil, fmt.Errorf("sending update: %w", err)
+		}
+		response, err := socket.ReadTCPMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("reading update response: %w", err)
+		}
+		if len(response) < 12 || binary.BigEndian.Uint16(response[0:2]) != id {
+			return nil, fmt.Errorf("update response from %s does not match the request", server)
+		}
+		return response, nil
+	}
+
+	if _, err := conn.Write(message); err != nil {
+		return nil, fmt.Errorf("sending update: %w", err)
+	}
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("reading update response: %w", err)
+		}
+		// Anything that is not a response to our update is ignored until the deadline
+		if n >= 12 && binary.BigEndian.Uint16(buffer[0:2]) == id && binary.BigEndian.Uint16(buffer[2:4])&query.FLAG_QR != 0 {
+			return buffer[:n], nil
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package update
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"recursive-dns-resolver/internal/dnstest"
+	"recursive-dns-resolver/query"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = query.TSIGKey{Name: "update-key", Algorithm: query.HMACSHA256, Secret: []byte("0123456789abcdef")}
+
+// respond answers request with rcode and flags, signed over the request MAC when it is signed
+func respond(t *testing.T, request []byte, rcode uint16, flags uint16, sign bool) []byte {
+	response := query.PacketToBytes(query.DNSPacket{Header: query.DNSHeader{
+		ID:    binary.BigEndian.Uint16(request[0:2]),
+		Flags: query.FLAG_QR | query.OPCODE_UPDATE<<11 | flags | rcode,
+	}})
+	if !sign {
+		return response
+	}
+	tsig, err := query.VerifyTSIG(request, map[string]query.TSIGKey{testKey.Name: testKey}, nil, time.Now())
+	if err != nil || tsig == nil {
+		t.Errorf("stand-in could not verify the update: %v", err)
+		return nil
+	}
+	signed, _, err := query.SignTSIG(response, testKey, tsig.MAC, time.Now())
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return signed
+}
+
+func testUpdate(records int) *query.Update {
+	u := query.NewUpdate("example.com")
+	u.NameNotInUse("new.example.com")
+	for i := 0; i < records; i++ {
+		u.Add(query.DNSRecord{Name: []byte("new.example.com"), Type: query.TYPE_A, Class: query.CLASS_IN, TTL: 300, Data: []byte{192, 0, 2, byte(i)}})
+	}
+	return u
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   *query.Update
+		key      *query.TSIGKey
+		answer   func(t *testing.T, network string, request []byte) []byte
+		networks string
+		err      string // part of the error, empty for none
+	}{
+		{
+			name:   "unsigned",
+			update: testUpdate(1),
+			answer: func(t *testing.T, network string, request []byte) []byte {
+				return respond(t, request, query.RCODE_NOERROR, 0, false)
+			},
+			networks: "udp",
+		},
+		{
+			name:   "signed",
+			update: testUpdate(1),
+			key:    &testKey,
+			answer: func(t *testing.T, network string, request []byte) []byte {
+				return respond(t, request, query.RCODE_NOERROR, 0, true)
+			},
+			networks: "udp",
+		},
+		{
+			name:   "prerequisite failed",
+			update: testUpdate(1),
+			answer: func(t *testing.T, network string, request []byte) []byte {
+				return respond(t, request, query.RCODE_YXDOMAIN, 0, false)
+			},
+			networks: "udp",
+			err:      "update refused by",
+		},
+		{
+			name:   "unsigned response to a signed update",
+			update: testUpdate(1),
+			key:    &testKey,
+			answer: func(t *testing.T, network string, request []byte) []byte {
+				return respond(t, request, query.RCODE_NOERROR, 0, false)
+			},
+			networks: "udp",
+			err:      "is not signed",
+		},
+		{
+			name:   "response signed with another key",
+			update: testUpdate(1),
+			key:    &testKey,
+			answer: func(t *testing.T, network string, request []byte) []byte {
+				response := respond(t, request, query.RCODE_NOERROR, 0, false)
+				signed, _, _ := query.SignTSIG(response, query.TSIGKey{Name: testKey.Name, Algorithm: query.HMACSHA256, Secret: []byte("another secret")}, nil, time.Now())
+				return signed
+			},
+			networks: "udp",
+			err:      "BADSIG",
+		},
+		{
+			name:   "truncated response is retried over TCP",
+			update: testUpdate(1),
+			answer: func(t *testing.T, network string, request []byte) []byte {
+				if network == "udp" {
+					return respond(t, request, query.RCODE_NOERROR, query.FLAG_TC, false)
+				}
+				return respond(t, request, query.RCODE_NOERROR, 0, false)
+			},
+			networks: "udp,tcp",
+		},
+		{
+			name:   "large update goes over TCP",
+			update: testUpdate(40),
+			key:    &testKey,
+			answer: func(t *testing.T, network string, request []byte) []byte {
+				return respond(t, request, query.RCODE_NOERROR, 0, true)
+			},
+			networks: "tcp",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := dnstest.Start(t, func(network string, request []byte) [][]byte {
+				return [][]byte{test.answer(t, network, request)}
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			err := Send(ctx, server.Addr, test.update, test.key)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("Send failed: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("Send gave %v, want an error with %q", err, test.err)
+			}
+			if got := server.Networks(); got != test.networks {
+				t.Errorf("update went over %s, want %s", got, test.networks)
+			}
+		})
+	}
+}
+
+func TestSendRcodeError(t *testing.T) {
+	server := dnstest.Start(t, func(network string, request []byte) [][]byte {
+		return [][]byte{respond(t, request, query.RCODE_NXRRSET, 0, false)}
+	})
+	err := Send(context.Background(), server.Addr, testUpdate(1), nil)
+	var rcodeErr *RcodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != query.RCODE_NXRRSET || rcodeErr.Server != server.Addr {
+		t.Errorf("Send gave %v, want an NXRRSET RcodeError from %s", err, server.Addr)
+	}
+}
+
+// A server that never answers leaves Send to the deadline of its context
+func TestSendTimeout(t *testing.T) {
+	server := dnstest.Start(t, func(network string, request []byte) [][]byte { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := Send(ctx, server.Addr, testUpdate(1), nil); err == nil {
+		t.Fatal("Send to a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send took %v to give up", elapsed)
+	}
+}